@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gbemulator/lib"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// compat [flags] <dir>: runs every ROM in the directory without a window and reports how
+// far each one gets
+func runCompat(args []string) {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	frames := fs.Uint64("frames", 1800, "frames to run each ROM for")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "ROMs to run at the same time")
+	output := fs.String("o", "compat", "directory for report.md, report.csv and the thumbnails")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *jobs < 1 {
+		fmt.Println("usage: compat [flags] <dir>")
+		fs.PrintDefaults()
+		os.Exit(lib.EXIT_USAGE)
+	}
+	if *patch != "" || *doctor != "" || *compare != "" {
+		fmt.Println("-patch, -doctor and -doctor-compare only work with a single ROM")
+		os.Exit(lib.EXIT_USAGE)
+	}
+	options, err := commonOptions()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(lib.EXIT_USAGE)
+	}
+	roms, err := lib.FindRoms(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(lib.EXIT_USAGE)
+	}
+
+	results := make([]lib.CompatResult, len(roms))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = lib.CheckCompatibility(roms[i], *frames, options...)
+				fmt.Printf("%-40s %s\n", filepath.Base(roms[i]), results[i].Class)
+			}
+		}()
+	}
+	for i := range roms {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := lib.WriteCompatReport(*output, results); err != nil {
+		fmt.Println(err)
+		os.Exit(lib.EXIT_USAGE)
+	}
+	fmt.Printf("%d ROMs, report in %s\n", len(roms), filepath.Join(*output, "report.md"))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gbemulator/lib"
+	"os"
+)
+
+// -doctor-compare with no subcommand: runs without a window until the reference log
+// ends or differs, or -doctor-cycles runs out
+func runDoctorCompare(e *lib.Emulator) {
+	result := e.RunHeadless(lib.HeadlessOptions{Cycles: *compareCycles})
+	switch {
+	case errors.Is(result.Err, lib.ErrDoctorLogEnd):
+		fmt.Printf("matched the whole reference log, %d M-cycles\n", result.Cycles)
+	case result.Err != nil:
+		os.Exit(lib.EXIT_CPU_ERROR) //the emulator already printed the error
+	default:
+		fmt.Printf("%s after %d M-cycles before the reference log ended, PC 0x%04X\n", result.Reason, result.Cycles, result.PC)
+		os.Exit(lib.EXIT_NO_MATCH)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gbemulator/lib"
+	"os"
+	"strconv"
+)
+
+// fix [flags] <rom>: rgbfix style header fixer, always recomputes both checksums
+func runFix(args []string) {
+	fs := flag.NewFlagSet("fix", flag.ExitOnError)
+	output := fs.String("o", "", "write the fixed ROM here instead of over the input")
+	dryRun := fs.Bool("n", false, "only report what would change")
+	logo := fs.Bool("logo", false, "write the Nintendo logo")
+	pad := fs.Bool("pad", false, "pad the ROM with 0xFF to a valid size and set the ROM size")
+	title := fs.String("title", "", "game title, up to 15 characters on CGB carts")
+	cartType := fs.String("type", "", "cartridge type byte, e.g. 0x1B for MBC5+RAM+BATTERY")
+	ram := fs.String("ram", "", "RAM size code, 0x00 none, 0x02 8KiB, 0x03 32KiB, 0x04 128KiB, 0x05 64KiB")
+	cgb := fs.String("cgb", "", "CGB flag: off, compatible, only or a byte")
+	sgb := fs.Bool("sgb", false, "set the SGB flag, -sgb=false clears it")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: fix [flags] <rom>")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	file := fs.Arg(0)
+
+	fix := lib.HeaderFix{Logo: *logo, Pad: *pad}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "title":
+			fix.Title = title
+		case "type":
+			fix.CartridgeType, err = parseByte(*cartType)
+		case "ram":
+			fix.RamSize, err = parseByte(*ram)
+		case "cgb":
+			fix.CgbFlag, err = parseCgbFlag(*cgb)
+		case "sgb":
+			fix.Sgb = sgb
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	changes, err := lib.FixHeaderFile(file, *output, fix, *dryRun)
+	if len(changes) == 0 && err == nil {
+		fmt.Println("nothing to change")
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func parseByte(s string) (*uint8, error) {
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a byte", s)
+	}
+	b := uint8(v)
+	return &b, nil
+}
+
+func parseCgbFlag(s string) (*uint8, error) {
+	var flag uint8
+	switch s {
+	case "off":
+		flag = 0x00
+	case "compatible":
+		flag = lib.CGB_COMPATIBLE
+	case "only":
+		flag = lib.CGB_ONLY
+	default:
+		return parseByte(s)
+	}
+	return &flag, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gbemulator/lib"
+	"image"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// headless [flags] <rom>: runs without a window until a limit, a serial match or a breakpoint
+func runHeadless(args []string) {
+	fs := flag.NewFlagSet("headless", flag.ExitOnError)
+	frames := fs.Uint64("frames", 0, "stop after this many frames")
+	cycles := fs.Uint64("cycles", 0, "stop after this many M-cycles")
+	serial := fs.String("serial", "", "stop once the serial output matches this regex")
+	breakpoints := fs.String("break", "", "comma separated PC addresses to stop at, e.g. 0x0150,0xC000")
+	ldbb := fs.Bool("ldbb", false, "stop at LD B,B, the breakpoint used by mooneye and acid2 tests")
+	output := fs.String("png", "", "write the last frame to this PNG")
+	every := fs.Uint64("every", 0, "also write every Nth frame as a PNG, see -frames-dir")
+	framesDir := fs.String("frames-dir", ".", "directory for the PNGs written by -every")
+	quiet := fs.Bool("quiet", false, "do not print the serial output")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: headless [flags] <rom>")
+		fs.PrintDefaults()
+		os.Exit(lib.EXIT_USAGE)
+	}
+	if *frames == 0 && *cycles == 0 && *serial == "" && *breakpoints == "" && !*ldbb {
+		fmt.Println("headless needs -frames, -cycles, -serial, -break or -ldbb to know when to stop")
+		os.Exit(lib.EXIT_USAGE)
+	}
+
+	o := lib.HeadlessOptions{Frames: *frames, Cycles: *cycles, FrameEvery: *every, BreakOnLdBB: *ldbb}
+	if *serial != "" {
+		r, err := regexp.Compile(*serial)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(lib.EXIT_USAGE)
+		}
+		o.SerialMatch = r
+	}
+	if *breakpoints != "" {
+		for _, b := range strings.Split(*breakpoints, ",") {
+			pc, err := strconv.ParseUint(strings.TrimSpace(b), 0, 16)
+			if err != nil {
+				fmt.Printf("bad breakpoint %q\n", b)
+				os.Exit(lib.EXIT_USAGE)
+			}
+			o.Breakpoints = append(o.Breakpoints, uint16(pc))
+		}
+	}
+	if *every != 0 {
+		o.OnFrame = func(frame uint64, screen *image.RGBA) {
+			if err := lib.WritePng(filepath.Join(*framesDir, fmt.Sprintf("frame_%06d.png", frame)), screen); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
+	e, err := loadEmulator(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(lib.EXIT_USAGE)
+	}
+
+	result := e.RunHeadless(o)
+
+	if !*quiet && e.SerialOutput() != "" {
+		fmt.Println(e.SerialOutput())
+	}
+	fmt.Printf("%s after %d frames, %d M-cycles, PC 0x%04X\n", result.Reason, result.Frames, result.Cycles, result.PC)
+	if *output != "" {
+		if err := lib.WritePng(*output, e.ScreenImage()); err != nil {
+			fmt.Println(err)
+			os.Exit(lib.EXIT_USAGE)
+		}
+	}
+
+	os.Exit(result.ExitCode(o)) //the emulator already printed any CPU error
+}
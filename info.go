@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"gbemulator/lib"
+	"os"
+)
+
+// info <rom>...: prints the decoded header of every ROM without running it
+func runInfo(files []string) {
+	if len(files) == 0 {
+		fmt.Println("usage: info <rom>...")
+		os.Exit(2)
+	}
+
+	failed := false
+	for i, f := range files {
+		if i > 0 {
+			fmt.Println()
+		}
+		info, err := lib.LoadCartInfo(f)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f, err)
+			failed = true
+			continue
+		}
+		if len(files) > 1 {
+			fmt.Printf("%s\n", f)
+		}
+		fmt.Print(info)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	DMG_BOOT_ROM_SIZE = 0x100 // DMG, MGB and SGB
+	CGB_BOOT_ROM_SIZE = 0x900 // CGB, the cart header at 0x100-0x1FF stays visible
+)
+
+func LoadBootRom(p string) ([]uint8, error) {
+	rom, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(rom) != DMG_BOOT_ROM_SIZE && len(rom) != CGB_BOOT_ROM_SIZE {
+		return nil, fmt.Errorf("boot rom has %d bytes, expected %d or %d", len(rom), DMG_BOOT_ROM_SIZE, CGB_BOOT_ROM_SIZE)
+	}
+	return rom, nil
+}
+
+// The boot ROM covers the cart until anything is written to 0xFF50
+func (m *MMU) bootRomMapped(a uint16) bool {
+	if m.bootRom == nil {
+		return false
+	}
+	if a < DMG_BOOT_ROM_SIZE {
+		return true
+	}
+	return len(m.bootRom) == CGB_BOOT_ROM_SIZE && a >= 0x200 && a < CGB_BOOT_ROM_SIZE
+}
+
+// A CGB boot ROM leaves DMG carts in compatibility mode, without the CGB registers
+func (m *MMU) UnmapBootRom(v uint8) {
+	if v == 0 {
+		return
+	}
+	if m.bootRom != nil && m.cgb && !m.cart.Header.IsCgb() {
+		m.cgb = false
+		m.wramBank = 1
+		m.ppu.dmgCompatibility()
+	}
+	m.bootRom = nil
+}
+
+// Power on state for running a boot ROM, everything starts from zero with the LCD off
+func (p *PPU) powerOn() {
+	p.lcdControl = 0
+	p.backgroundPalette = 0
+	p.obp0 = 0
+	p.obp1 = 0
+	p.SetMode(HBlank)
+}
+
+// DMG carts on CGB draw by DMG rules, bank 0 only and without attributes, but the colors
+// still come from the palettes the boot ROM picked for the cart
+func (p *PPU) dmgCompatibility() {
+	p.compat = true
+	p.vramBank = 0
+	p.fetcher.attribute = 0
+}
+
+// Picks up where the boot ROM left the PPU, somewhere in VBlank
+func (p *PPU) handOver(line uint8, dots uint16) {
+	p.line = line
+	p.ly = line
+	if line == LINES_PER_FRAME-1 && dots >= LY_153_WRAP_DOTS {
+		p.ly = 0
+	}
+	p.dots = dots
+	p.SetMode(VBlank)
+}
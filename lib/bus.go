@@ -0,0 +1,64 @@
+package lib
+
+// Everything the CPU reaches through its pins. MMU is the real one, TestBus stands in
+// for it in the single instruction tests
+type Bus interface {
+	Read(a uint16) uint8
+	Read16(a uint16) uint16
+	Write(a uint16, v uint8)
+	Write16(a uint16, v uint16)
+
+	RequestInterrupt(i InterruptorBit)
+	ClearInterrupt(i InterruptorBit)
+	InterruptFlags() uint8 // IF
+	GetIeRegister() uint8  // IE
+
+	SwitchSpeed() bool                // see MMU.SwitchSpeed
+	OamBug(a uint16, kind OamBugKind) // see MMU.OamBug
+}
+
+// Flat 64 KiB of RAM with nothing mapped in it. IF and IE are just the bytes at 0xFF0F
+// and 0xFFFF. Every read and write the CPU makes is kept in Accesses, in order
+type TestBus struct {
+	Memory   [0x10000]uint8
+	Accesses []BusAccess
+}
+
+type BusAccess struct {
+	Address uint16
+	Value   uint8
+	Write   bool
+}
+
+func (b *TestBus) Read(a uint16) uint8 {
+	b.Accesses = append(b.Accesses, BusAccess{Address: a, Value: b.Memory[a]})
+	return b.Memory[a]
+}
+
+func (b *TestBus) Write(a uint16, v uint8) {
+	b.Accesses = append(b.Accesses, BusAccess{Address: a, Value: v, Write: true})
+	b.Memory[a] = v
+}
+
+func (b *TestBus) Read16(a uint16) uint16 {
+	lo := uint16(b.Read(a))
+	return uint16(b.Read(a+1))<<8 | lo
+}
+
+func (b *TestBus) Write16(a uint16, v uint16) {
+	b.Write(a, uint8(v))
+	b.Write(a+1, uint8(v>>8))
+}
+
+func (b *TestBus) RequestInterrupt(i InterruptorBit) {
+	b.Memory[0xFF0F] = SetBit(b.Memory[0xFF0F], int(i))
+}
+
+func (b *TestBus) ClearInterrupt(i InterruptorBit) {
+	b.Memory[0xFF0F] = UnsetBit(b.Memory[0xFF0F], int(i))
+}
+
+func (b *TestBus) InterruptFlags() uint8            { return b.Memory[0xFF0F] }
+func (b *TestBus) GetIeRegister() uint8             { return b.Memory[0xFFFF] }
+func (b *TestBus) SwitchSpeed() bool                { return false }
+func (b *TestBus) OamBug(a uint16, kind OamBugKind) {}
@@ -1,9 +1,10 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
 )
 
 type header struct {
@@ -22,6 +23,15 @@ type header struct {
 	GlobalChecksum  uint16
 }
 
+const (
+	CGB_COMPATIBLE = 0x80 // works on DMG too, runs with CGB features on a CGB
+	CGB_ONLY       = 0xC0
+)
+
+// The CGB flag is the last byte of the title on newer carts (0x143)
+func (h header) CgbFlag() uint8 { return h.Title[15] }
+func (h header) IsCgb() bool    { return h.CgbFlag()&CGB_COMPATIBLE != 0 }
+
 type Cart struct {
 	Header header
 	Length int64
@@ -29,82 +39,79 @@ type Cart struct {
 	mbc1   *MBC1 //TODO: make this generic
 }
 
-func LoadCart(p string) (*Cart, error) {
-	file, err := os.Open(p)
+func loadCart(rom []uint8) (*Cart, error) {
+	cart, err := parseCart(rom)
 	if err != nil {
-		fmt.Println("Failed to open")
 		return nil, err
 	}
-	defer file.Close()
 
-	cart := &Cart{}
-
-	fi, err := file.Stat()
-	if err != nil {
-		fmt.Println("Couldn't get info")
-		return nil, err
+	//a short ROM would only fail on the first read past its end
+	if len(rom) < 0x8000 {
+		return nil, fmt.Errorf("ROM has %d bytes, carts have at least 32 KiB", len(rom))
 	}
-	cart.Length = fi.Size()
-
-	file.Seek(0x0100, 0)
-	cartHeader := header{}
-	if err := binary.Read(file, binary.LittleEndian, &cartHeader); err != nil {
-		fmt.Println("Invalid header")
-		return nil, err
+	if size := cart.Header.RomBytes(); len(rom) < size {
+		return nil, fmt.Errorf("header declares %d bytes of ROM, the file has %d", size, len(rom))
 	}
-	cart.Header = cartHeader
-	file.Seek(0, 0)
 
-	cartRom := make([]uint8, cart.Length)
-	if err := binary.Read(file, binary.LittleEndian, &cartRom); err != nil {
-		fmt.Println("Invalid rom", err)
+	if err := cart.initMBC(rom); err != nil {
 		return nil, err
 	}
-	cart.Rom = cartRom
 
-	if err := cart.initMBC(cartRom); err != nil {
-		return nil, err
-	}
+	return cart, nil
+}
 
-	fmt.Printf("Title: %s\n", cart.Header.Title)
-	fmt.Printf("Type: % x\n", cart.Header.CartridgeType)
-	fmt.Printf("Nintendo logo: % x\n", cart.Header.Logo)
-	fmt.Printf("Rom: %d KB\n", 32<<cart.Header.RomSize)
-	fmt.Printf("Ram: %x\n", cart.Header.RamSize)
-	fmt.Printf("Lic Code: %x\n", cart.Header.OldLicenseeCode)
-	fmt.Printf("Rom Version: %x\n", cart.Header.MaskRomVersion)
-	fmt.Printf("Cart length: %x\n", cart.Length)
-	fmt.Printf("Cartridge type: 0x%x\n", cart.Header.CartridgeType)
+// Header info of a ROM file, works for carts the emulator cannot run
+func LoadCartInfo(p string) (CartInfo, error) {
+	rom, err := ReadRom(p)
+	if err != nil {
+		return CartInfo{}, err
+	}
+	cart, err := parseCart(rom)
+	if err != nil {
+		return CartInfo{}, err
+	}
+	return cart.Info(), nil
+}
 
+func parseCart(rom []uint8) (*Cart, error) {
+	cart := &Cart{Length: int64(len(rom)), Rom: rom}
+	if err := binary.Read(bytes.NewReader(rom[min(len(rom), 0x100):]), binary.LittleEndian, &cart.Header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
 	return cart, nil
-
 }
 
+// Cartridge types the emulator has no MBC for, wrapped with the type
+var ErrUnsupportedMapper = errors.New("unsupported mapper")
+
 func (c *Cart) initMBC(rom []uint8) error {
 	switch c.Header.CartridgeType {
 	case 0x00:
 		c.Rom = rom
 		return nil
-	case 0x01:
-		c.mbc1 = loadMBC1(rom)
+	case 0x01, 0x02, 0x03:
+		c.mbc1 = loadMBC1(rom, ramSizes[c.Header.RamSize])
 	default:
-		return fmt.Errorf("Unsuported mbc")
+		return fmt.Errorf("%w: %s", ErrUnsupportedMapper, c.Info().Mapper)
 	}
 
 	return nil
 }
 
 func (c *Cart) CartRead(a uint16) uint8 {
-	if c.Header.CartridgeType == 0x01 {
+	if c.mbc1 != nil {
 		return c.mbc1.read(a)
 	}
+	if a >= 0xA000 { //no external RAM
+		return 0xFF
+	}
 	return c.Rom[a]
 }
 
 func (c *Cart) CartWrite(a uint16, v uint8) {
-	if c.Header.CartridgeType == 0x01 {
+	if c.mbc1 != nil {
 		c.mbc1.write(a, v)
-	} else {
+	} else if a < 0x8000 {
 		c.Rom[a] = v
 	}
 }
@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Decoded cartridge header with the checks the boot ROM and the header itself allow
+// https://gbdev.io/pandocs/The_Cartridge_Header.html
+type CartInfo struct {
+	Title            string
+	ManufacturerCode string // only on newer carts, empty otherwise
+	CgbFlag          uint8
+	SgbFlag          uint8
+	CartridgeType    uint8
+	Mapper           string
+	RomSize          int // bytes, from the header
+	RamSize          int // bytes, from the header
+	Destination      string
+	Licensee         string
+	Version          uint8
+	FileSize         int
+
+	LogoValid              bool
+	HeaderChecksum         uint8 // computed, compare against the header one
+	HeaderChecksumValid    bool
+	GlobalChecksum         uint16
+	GlobalChecksumValid    bool
+	ExpectedGlobalChecksum uint16 // the one in the header, big endian unlike everything else
+}
+
+var nintendoLogo = [0x30]uint8{
+	0xCE, 0xED, 0x66, 0x66, 0xCC, 0x0D, 0x00, 0x0B, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0C, 0x00, 0x0D,
+	0x00, 0x08, 0x11, 0x1F, 0x88, 0x89, 0x00, 0x0E, 0xDC, 0xCC, 0x6E, 0xE6, 0xDD, 0xDD, 0xD9, 0x99,
+	0xBB, 0xBB, 0x67, 0x63, 0x6E, 0x0E, 0xEC, 0xCC, 0xDD, 0xDC, 0x99, 0x9F, 0xBB, 0xB9, 0x33, 0x3E,
+}
+
+var mapperNames = map[uint8]string{
+	0x00: "ROM ONLY",
+	0x01: "MBC1",
+	0x02: "MBC1+RAM",
+	0x03: "MBC1+RAM+BATTERY",
+	0x05: "MBC2",
+	0x06: "MBC2+BATTERY",
+	0x08: "ROM+RAM",
+	0x09: "ROM+RAM+BATTERY",
+	0x0B: "MMM01",
+	0x0C: "MMM01+RAM",
+	0x0D: "MMM01+RAM+BATTERY",
+	0x0F: "MBC3+TIMER+BATTERY",
+	0x10: "MBC3+TIMER+RAM+BATTERY",
+	0x11: "MBC3",
+	0x12: "MBC3+RAM",
+	0x13: "MBC3+RAM+BATTERY",
+	0x19: "MBC5",
+	0x1A: "MBC5+RAM",
+	0x1B: "MBC5+RAM+BATTERY",
+	0x1C: "MBC5+RUMBLE",
+	0x1D: "MBC5+RUMBLE+RAM",
+	0x1E: "MBC5+RUMBLE+RAM+BATTERY",
+	0x20: "MBC6",
+	0x22: "MBC7+SENSOR+RUMBLE+RAM+BATTERY",
+	0xFC: "POCKET CAMERA",
+	0xFD: "BANDAI TAMA5",
+	0xFE: "HuC3",
+	0xFF: "HuC1+RAM+BATTERY",
+}
+
+var ramSizes = map[uint8]int{0x00: 0, 0x01: 2 << 10, 0x02: 8 << 10, 0x03: 32 << 10, 0x04: 128 << 10, 0x05: 64 << 10}
+
+// Sizes that are not a power of two, never seen in released carts
+var oddRomSizes = map[uint8]int{0x52: 72 * 0x4000, 0x53: 80 * 0x4000, 0x54: 96 * 0x4000}
+
+var oldLicensees = map[uint8]string{
+	0x00: "None", 0x01: "Nintendo", 0x08: "Capcom", 0x09: "HOT-B", 0x0A: "Jaleco", 0x0B: "Coconuts Japan",
+	0x0C: "Elite Systems", 0x13: "EA (Electronic Arts)", 0x18: "Hudson Soft", 0x19: "ITC Entertainment",
+	0x1A: "Yanoman", 0x1D: "Japan Clary", 0x1F: "Virgin Games Ltd.", 0x24: "PCM Complete", 0x25: "San-X",
+	0x28: "Kemco", 0x29: "SETA Corporation", 0x30: "Infogrames", 0x31: "Nintendo", 0x32: "Bandai",
+	0x34: "Konami", 0x35: "HectorSoft", 0x38: "Capcom", 0x39: "Banpresto", 0x3C: "Entertainment Interactive",
+	0x3E: "Gremlin", 0x41: "Ubi Soft", 0x42: "Atlus", 0x44: "Malibu Interactive", 0x46: "Angel",
+	0x47: "Spectrum HoloByte", 0x49: "Irem", 0x4A: "Virgin Games Ltd.", 0x4D: "Malibu Interactive",
+	0x4F: "U.S. Gold", 0x50: "Absolute", 0x51: "Acclaim Entertainment", 0x52: "Activision",
+	0x53: "Sammy USA Corporation", 0x54: "GameTek", 0x55: "Park Place", 0x56: "LJN", 0x57: "Matchbox",
+	0x59: "Milton Bradley Company", 0x5A: "Mindscape", 0x5B: "Romstar", 0x5C: "Naxat Soft", 0x5D: "Tradewest",
+	0x60: "Titus Interactive", 0x61: "Virgin Games Ltd.", 0x67: "Ocean Software", 0x69: "EA (Electronic Arts)",
+	0x6E: "Elite Systems", 0x6F: "Electro Brain", 0x70: "Infogrames", 0x71: "Interplay Entertainment",
+	0x72: "Broderbund", 0x73: "Sculptured Software", 0x75: "The Sales Curve Limited", 0x78: "THQ",
+	0x79: "Accolade", 0x7A: "Triffix Entertainment", 0x7C: "MicroProse", 0x7F: "Kemco",
+	0x80: "Misawa Entertainment", 0x83: "LOZC G.", 0x86: "Tokuma Shoten", 0x8B: "Bullet-Proof Software",
+	0x8C: "Vic Tokai Corp.", 0x8E: "Ape Inc.", 0x8F: "I'Max", 0x91: "Chunsoft Co.", 0x92: "Video System",
+	0x93: "Tsubaraya Productions", 0x95: "Varie", 0x96: "Yonezawa/S'Pal", 0x97: "Kemco", 0x99: "Arc",
+	0x9A: "Nihon Bussan", 0x9B: "Tecmo", 0x9C: "Imagineer", 0x9D: "Banpresto", 0x9F: "Nova",
+	0xA1: "Hori Electric", 0xA2: "Bandai", 0xA4: "Konami", 0xA6: "Kawada", 0xA7: "Takara",
+	0xA9: "Technos Japan", 0xAA: "Broderbund", 0xAC: "Toei Animation", 0xAD: "Toho", 0xAF: "Namco",
+	0xB0: "Acclaim Entertainment", 0xB1: "ASCII Corporation or Nexsoft", 0xB2: "Bandai", 0xB4: "Square Enix",
+	0xB6: "HAL Laboratory", 0xB7: "SNK", 0xB9: "Pony Canyon", 0xBA: "Culture Brain", 0xBB: "Sunsoft",
+	0xBD: "Sony Imagesoft", 0xBF: "Sammy Corporation", 0xC0: "Taito", 0xC2: "Kemco", 0xC3: "Square",
+	0xC4: "Tokuma Shoten", 0xC5: "Data East", 0xC6: "Tonkin House", 0xC8: "Koei", 0xC9: "UFL",
+	0xCA: "Ultra Games", 0xCB: "VAP, Inc.", 0xCC: "Use Corporation", 0xCD: "Meldac", 0xCE: "Pony Canyon",
+	0xCF: "Angel", 0xD0: "Taito", 0xD1: "SOFEL", 0xD2: "Quest", 0xD3: "Sigma Enterprises",
+	0xD4: "ASK Kodansha Co.", 0xD6: "Naxat Soft", 0xD7: "Copya System", 0xD9: "Banpresto", 0xDA: "Tomy",
+	0xDB: "LJN", 0xDD: "Nippon Computer Systems", 0xDE: "Human Ent.", 0xDF: "Altron", 0xE0: "Jaleco",
+	0xE1: "Towa Chiki", 0xE2: "Yutaka", 0xE3: "Varie", 0xE5: "Epoch", 0xE7: "Athena",
+	0xE8: "Asmik Ace Entertainment", 0xE9: "Natsume", 0xEA: "King Records", 0xEB: "Atlus",
+	0xEC: "Epic/Sony Records", 0xEE: "IGS", 0xF0: "A Wave", 0xF3: "Extreme Entertainment", 0xFF: "LJN",
+}
+
+// Used when the old code is 0x33
+var newLicensees = map[string]string{
+	"00": "None", "01": "Nintendo Research & Development 1", "08": "Capcom", "13": "EA (Electronic Arts)",
+	"18": "Hudson Soft", "19": "B-AI", "20": "KSS", "22": "Planning Office WADA", "24": "PCM Complete",
+	"25": "San-X", "28": "Kemco", "29": "SETA Corporation", "30": "Viacom", "31": "Nintendo", "32": "Bandai",
+	"33": "Ocean Software/Acclaim Entertainment", "34": "Konami", "35": "HectorSoft", "37": "Taito",
+	"38": "Hudson Soft", "39": "Banpresto", "41": "Ubi Soft", "42": "Atlus", "44": "Malibu Interactive",
+	"46": "Angel", "47": "Bullet-Proof Software", "49": "Irem", "50": "Absolute", "51": "Acclaim Entertainment",
+	"52": "Activision", "53": "Sammy USA Corporation", "54": "Konami", "55": "Hi Tech Expressions", "56": "LJN",
+	"57": "Matchbox", "58": "Mattel", "59": "Milton Bradley Company", "60": "Titus Interactive",
+	"61": "Virgin Games Ltd.", "64": "Lucasfilm Games", "67": "Ocean Software", "69": "EA (Electronic Arts)",
+	"70": "Infogrames", "71": "Interplay Entertainment", "72": "Broderbund", "73": "Sculptured Software",
+	"75": "The Sales Curve Limited", "78": "THQ", "79": "Accolade", "80": "Misawa Entertainment", "83": "lozc",
+	"86": "Tokuma Shoten", "87": "Tsukuda Original", "91": "Chunsoft Co.", "92": "Video System",
+	"93": "Ocean Software/Acclaim Entertainment", "95": "Varie", "96": "Yonezawa/s'pal", "97": "Kaneko",
+	"99": "Pack-In-Video", "9H": "Bottom Up", "A4": "Konami (Yu-Gi-Oh!)", "BL": "MTO", "DK": "Kodansha",
+}
+
+func (c *Cart) Info() CartInfo {
+	h := c.Header
+	info := CartInfo{
+		CgbFlag:       h.CgbFlag(),
+		SgbFlag:       h.SgbFlag,
+		CartridgeType: h.CartridgeType,
+		Mapper:        mapperNames[h.CartridgeType],
+		RomSize:       h.RomBytes(),
+		RamSize:       ramSizes[h.RamSize],
+		Version:       h.MaskRomVersion,
+		FileSize:      len(c.Rom),
+		LogoValid:     h.Logo == nintendoLogo,
+	}
+	if info.Mapper == "" {
+		info.Mapper = fmt.Sprintf("unknown (0x%02X)", h.CartridgeType)
+	}
+
+	//newer CGB carts give the last 4 title bytes to the manufacturer code
+	title := h.Title[:]
+	if h.IsCgb() {
+		title = title[:15]
+		if code := title[11:15]; isManufacturerCode(code) {
+			info.ManufacturerCode = string(code)
+			title = title[:11]
+		}
+	}
+	if i := bytes.IndexByte(title, 0); i >= 0 {
+		title = title[:i]
+	}
+	info.Title = strings.TrimSpace(string(title))
+
+	info.Destination = "Overseas"
+	if h.DestinationCode == 0 {
+		info.Destination = "Japan"
+	}
+
+	if h.OldLicenseeCode == 0x33 {
+		code := string([]uint8{uint8(h.NewLicenseeCode), uint8(h.NewLicenseeCode >> 8)})
+		info.Licensee = newLicensees[code]
+		if info.Licensee == "" {
+			info.Licensee = fmt.Sprintf("unknown (%q)", code)
+		}
+	} else {
+		info.Licensee = oldLicensees[h.OldLicenseeCode]
+		if info.Licensee == "" {
+			info.Licensee = fmt.Sprintf("unknown (0x%02X)", h.OldLicenseeCode)
+		}
+	}
+
+	info.HeaderChecksum = HeaderChecksum(c.Rom)
+	info.HeaderChecksumValid = info.HeaderChecksum == h.HeaderChecksum
+	info.GlobalChecksum = GlobalChecksum(c.Rom)
+	if len(c.Rom) >= 0x150 {
+		info.ExpectedGlobalChecksum = uint16(c.Rom[0x14E])<<8 | uint16(c.Rom[0x14F])
+	}
+	info.GlobalChecksumValid = info.GlobalChecksum == info.ExpectedGlobalChecksum
+
+	return info
+}
+
+// ROM size in bytes as declared in the header, 0 for unknown codes
+func (h header) RomBytes() int {
+	if h.RomSize <= 8 {
+		return 0x8000 << h.RomSize
+	}
+	return oddRomSizes[h.RomSize]
+}
+
+func isManufacturerCode(code []uint8) bool {
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Checked by the boot ROM over 0x134-0x14C, the cart does not boot when it is wrong
+func HeaderChecksum(rom []uint8) uint8 {
+	var x uint8
+	if len(rom) < 0x14D {
+		return x
+	}
+	for _, v := range rom[0x134:0x14D] {
+		x = x - v - 1
+	}
+	return x
+}
+
+// Sum of every byte but the checksum itself, nothing checks it on real hardware
+func GlobalChecksum(rom []uint8) uint16 {
+	var sum uint16
+	for i, v := range rom {
+		if i != 0x14E && i != 0x14F {
+			sum += uint16(v)
+		}
+	}
+	return sum
+}
+
+func (i CartInfo) SizeMismatch() bool { return i.RomSize != i.FileSize }
+
+// Everything that looks wrong with the header, empty for a good dump
+func (i CartInfo) Problems() []string {
+	var problems []string
+	if !i.LogoValid {
+		problems = append(problems, "Nintendo logo does not match")
+	}
+	if !i.HeaderChecksumValid {
+		problems = append(problems, fmt.Sprintf("header checksum should be 0x%02X", i.HeaderChecksum))
+	}
+	if !i.GlobalChecksumValid {
+		problems = append(problems, fmt.Sprintf("global checksum is 0x%04X, header says 0x%04X", i.GlobalChecksum, i.ExpectedGlobalChecksum))
+	}
+	if i.SizeMismatch() {
+		problems = append(problems, fmt.Sprintf("header declares %d bytes of ROM, the file has %d", i.RomSize, i.FileSize))
+	}
+	return problems
+}
+
+func (i CartInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Title:        %s\n", i.Title)
+	if i.ManufacturerCode != "" {
+		fmt.Fprintf(&b, "Manufacturer: %s\n", i.ManufacturerCode)
+	}
+	fmt.Fprintf(&b, "Type:         0x%02X %s\n", i.CartridgeType, i.Mapper)
+	fmt.Fprintf(&b, "ROM:          %d KiB\n", i.RomSize>>10)
+	fmt.Fprintf(&b, "RAM:          %d KiB\n", i.RamSize>>10)
+	fmt.Fprintf(&b, "CGB:          0x%02X %s\n", i.CgbFlag, cgbSupport(i.CgbFlag))
+	fmt.Fprintf(&b, "SGB:          0x%02X\n", i.SgbFlag)
+	fmt.Fprintf(&b, "Destination:  %s\n", i.Destination)
+	fmt.Fprintf(&b, "Licensee:     %s\n", i.Licensee)
+	fmt.Fprintf(&b, "Version:      %d\n", i.Version)
+	fmt.Fprintf(&b, "Logo:         %s\n", okOrBad(i.LogoValid))
+	fmt.Fprintf(&b, "Header sum:   %s\n", okOrBad(i.HeaderChecksumValid))
+	fmt.Fprintf(&b, "Global sum:   %s\n", okOrBad(i.GlobalChecksumValid))
+	for _, p := range i.Problems() {
+		fmt.Fprintf(&b, "warning: %s\n", p)
+	}
+	return b.String()
+}
+
+func cgbSupport(flag uint8) string {
+	switch {
+	case flag&CGB_ONLY == CGB_ONLY:
+		return "CGB only"
+	case flag&CGB_COMPATIBLE != 0:
+		return "CGB enhanced"
+	default:
+		return "DMG"
+	}
+}
+
+func okOrBad(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "bad"
+}
@@ -2,6 +2,9 @@ package lib
 
 const CLOCKSPEED = 4_194_304
 
+// M-cycles the CPU is paused after a speed switch
+const SPEED_SWITCH_CYCLES = 2050
+
 type Clock struct {
 	Divider      uint16 //Div
 	Counter      uint8  //Tima
@@ -11,7 +14,7 @@ type Clock struct {
 }
 
 func LoadClock() (*Clock, error) {
-	clock := &Clock{Divider: 0xABCC}
+	clock := &Clock{}
 	return clock, nil
 }
 
@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a ROM fared in a compatibility run, from worst to best
+type Compatibility int
+
+const (
+	CompatLoadFailed Compatibility = iota
+	CompatUnsupportedMapper
+	CompatCrashed     // unimplemented opcode or panic
+	CompatTightLoop   // the CPU never left a few bytes at the end of the run
+	CompatStuckScreen // blank, static or off screen for the whole run
+	CompatOK
+)
+
+func (c Compatibility) String() string {
+	return [...]string{"load failed", "unsupported mapper", "crashed", "tight loop", "stuck screen", "ok"}[c]
+}
+
+const TIGHT_LOOP_BYTES = 16 // PC range that counts as a tight loop
+
+type CompatResult struct {
+	Rom      string
+	Title    string
+	Mapper   string
+	Class    Compatibility
+	Detail   string
+	Frames   uint64
+	Screen   *image.RGBA // last frame, nil when the ROM never ran
+	Duration time.Duration
+}
+
+// ROMs directly in dir, archives included
+func FindRoms(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var roms []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".gb", ".gbc", ".sgb", ".zip", ".gz":
+			if !entry.IsDir() {
+				roms = append(roms, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return roms, nil
+}
+
+// Runs the ROM for the given number of frames and classifies how it ends. The PC of the last
+// quarter of the run decides on a tight loop, a screen that never changed over the whole run
+// is stuck. Every call has its own emulator, so ROMs can be checked from several goroutines
+func CheckCompatibility(rom string, frames uint64, options ...func(*Emulator)) (result CompatResult) {
+	start := time.Now()
+	result.Rom = rom
+	defer func() { result.Duration = time.Since(start) }()
+
+	var e *Emulator
+	defer func() {
+		if r := recover(); r != nil {
+			result.Class, result.Detail = CompatCrashed, fmt.Sprint("panic: ", r)
+			if e != nil {
+				result.Screen = e.FrameImage()
+			}
+		}
+	}()
+
+	if info, err := LoadCartInfo(rom); err == nil {
+		result.Title, result.Mapper = info.Title, info.Mapper
+	}
+	e, err := LoadEmulator(append([]func(*Emulator){WithCart(rom)}, options...)...)
+	if err != nil {
+		result.Class, result.Detail = CompatLoadFailed, err.Error()
+		if errors.Is(err, ErrUnsupportedMapper) {
+			result.Class = CompatUnsupportedMapper
+		}
+		return result
+	}
+
+	//the LCD can be off for a long time, so the run is measured in M-cycles
+	cycles := max(frames, 1) * FRAME_CYCLES
+	window := cycles - max(cycles/4, FRAME_CYCLES)
+	startFrame, lastFrame := e.ppu.FrameCount, e.ppu.FrameCount
+	pcMin, pcMax := uint16(0xFFFF), uint16(0)
+	firstHash, changed := "", false
+
+	for c := uint64(0); c < cycles; c++ {
+		if c >= window && e.cpuCycles <= 0 {
+			pcMin, pcMax = min(pcMin, e.Cpu.Register.pc), max(pcMax, e.Cpu.Register.pc)
+		}
+		e.Run()
+		if e.cpuErr != nil {
+			result.Class, result.Detail = CompatCrashed, e.cpuErr.Error()
+			break
+		}
+		if e.ppu.FrameCount != lastFrame {
+			lastFrame = e.ppu.FrameCount
+			if hash := e.Frame().Hash(); firstHash == "" {
+				firstHash = hash
+			} else if hash != firstHash {
+				changed = true
+			}
+		}
+	}
+	result.Frames = e.ppu.FrameCount - startFrame
+	result.Screen = e.FrameImage()
+	if result.Class == CompatCrashed {
+		return result
+	}
+
+	switch {
+	case pcMax-pcMin < TIGHT_LOOP_BYTES:
+		result.Class, result.Detail = CompatTightLoop, fmt.Sprintf("PC stays in 0x%04X-0x%04X", pcMin, pcMax)
+	case changed:
+		result.Class = CompatOK
+	case !e.ppu.GetLcdPpuEnable():
+		result.Class, result.Detail = CompatStuckScreen, "LCD off"
+	case blankFrame(e.Frame()):
+		result.Class, result.Detail = CompatStuckScreen, "blank screen"
+	default:
+		result.Class, result.Detail = CompatStuckScreen, "static screen"
+	}
+	return result
+}
+
+func blankFrame(f *FrameBuffer) bool {
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			if f.Shade(x, y) != f.Shade(0, 0) || f.RGB555(x, y) != f.RGB555(0, 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// report.md and report.csv in dir, with the last frame of every ROM in dir/thumbs
+func WriteCompatReport(dir string, results []CompatResult) error {
+	if err := os.MkdirAll(filepath.Join(dir, "thumbs"), 0755); err != nil {
+		return err
+	}
+	thumbs := make([]string, len(results))
+	for i, r := range results {
+		if r.Screen == nil {
+			continue
+		}
+		thumbs[i] = "thumbs/" + filepath.Base(r.Rom) + ".png"
+		if err := WritePng(filepath.Join(dir, thumbs[i]), r.Screen); err != nil {
+			return err
+		}
+	}
+
+	for name, write := range map[string]func(io.Writer, []CompatResult, []string) error{
+		"report.md":  writeCompatMarkdown,
+		"report.csv": writeCompatCsv,
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if err := write(f, results, thumbs); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCompatMarkdown(w io.Writer, results []CompatResult, thumbs []string) error {
+	counts := make(map[Compatibility]int)
+	for _, r := range results {
+		counts[r.Class]++
+	}
+
+	var b strings.Builder
+	b.WriteString("# Compatibility report\n\n| Result | ROMs |\n|--------|------|\n")
+	for c := CompatOK; c >= CompatLoadFailed; c-- {
+		fmt.Fprintf(&b, "| %s | %d |\n", c, counts[c])
+	}
+	b.WriteString("\n| Screen | ROM | Title | Mapper | Result | Detail |\n|--------|-----|-------|--------|--------|--------|\n")
+	escape := strings.NewReplacer("|", `\|`, "\n", " ").Replace
+	for i, r := range results {
+		screen := ""
+		if thumbs[i] != "" {
+			screen = fmt.Sprintf("![](%s)", (&url.URL{Path: thumbs[i]}).EscapedPath())
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", screen, escape(filepath.Base(r.Rom)), escape(r.Title), escape(r.Mapper), r.Class, escape(r.Detail))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeCompatCsv(w io.Writer, results []CompatResult, thumbs []string) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"rom", "title", "mapper", "result", "detail", "frames", "seconds", "thumbnail"})
+	for i, r := range results {
+		c.Write([]string{filepath.Base(r.Rom), r.Title, r.Mapper, r.Class.String(), r.Detail,
+			fmt.Sprint(r.Frames), fmt.Sprintf("%.2f", r.Duration.Seconds()), thumbs[i]})
+	}
+	c.Flush()
+	return c.Error()
+}
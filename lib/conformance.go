@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Test ROM families, each reports its result its own way
+type TestFamily int
+
+const (
+	Blargg  TestFamily = iota // serial text, or a status and text at 0xA000
+	Mooneye                   // Fibonacci numbers in the registers at LD B,B
+	Acid2                     // screen at LD B,B against a reference screenshot
+)
+
+func (f TestFamily) String() string { return [...]string{"blargg", "mooneye", "acid2"}[f] }
+
+const CONFORMANCE_CYCLES = 120_000_000 // M-cycles before a test counts as hung, cpu_instrs needs about half
+
+type ConformanceTest struct {
+	Name      string
+	Rom       string
+	Family    TestFamily
+	Reference string // screenshot for acid2 tests
+	Options   []func(*Emulator)
+}
+
+type ConformanceResult struct {
+	Test     ConformanceTest
+	Passed   bool
+	Message  string
+	Cycles   uint64
+	Duration time.Duration
+}
+
+var blarggResult = regexp.MustCompile(`Passed|Failed`)
+
+// Test ROMs under dir, grouped by family from their path. Mooneye tests live in a
+// mooneye directory, acid2 tests have acid2 in their name and a PNG reference next to them
+func DiscoverConformance(dir string) ([]ConformanceTest, error) {
+	var tests []ConformanceTest
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "golden" { //ROMs for the golden tests, they report nothing
+			return filepath.SkipDir
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if info.IsDir() || (ext != ".gb" && ext != ".gbc") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		t := ConformanceTest{Rom: p, Family: Blargg}
+		switch {
+		case strings.Contains(strings.ToLower(rel), "mooneye"):
+			t.Family = Mooneye
+		case strings.Contains(strings.ToLower(filepath.Base(p)), "acid2"):
+			t.Family = Acid2
+			t.Reference = strings.TrimSuffix(p, filepath.Ext(p)) + ".png"
+		}
+		t.Name = t.Family.String() + "/" + strings.TrimSuffix(filepath.ToSlash(rel), filepath.Ext(rel))
+		tests = append(tests, t)
+		return nil
+	})
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Name < tests[j].Name })
+	return tests, err
+}
+
+func RunConformance(t ConformanceTest) (result ConformanceResult) {
+	start := time.Now()
+	result.Test = t
+	defer func() { result.Duration = time.Since(start) }()
+
+	e, err := LoadEmulator(append([]func(*Emulator){WithCart(t.Rom)}, t.Options...)...)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	o := HeadlessOptions{Cycles: CONFORMANCE_CYCLES}
+	switch t.Family {
+	case Blargg:
+		o.SerialMatch = blarggResult
+		o.Until = func() bool { _, done := e.blarggMemoryResult(); return done }
+	case Mooneye, Acid2:
+		o.BreakOnLdBB = true
+	}
+	run := e.RunHeadless(o)
+	result.Cycles = run.Cycles
+
+	switch {
+	case run.Reason == StopError:
+		result.Message = run.Err.Error()
+	case run.Reason == StopLimit:
+		result.Message = fmt.Sprintf("no result after %d M-cycles", run.Cycles)
+	case t.Family == Blargg && run.Reason == StopCondition:
+		code, _ := e.blarggMemoryResult()
+		result.Passed = code == 0
+		result.Message = strings.TrimSpace(e.blarggMemoryText())
+	case t.Family == Blargg:
+		result.Message = strings.TrimSpace(e.SerialOutput())
+		result.Passed = strings.Contains(result.Message, "Passed")
+	case t.Family == Mooneye:
+		result.Passed, result.Message = e.mooneyeResult()
+	case t.Family == Acid2:
+		result.Passed, result.Message = e.compareScreen(t.Reference)
+	}
+	return result
+}
+
+// Tests that do not use the serial port write 0x80 at 0xA000 while running, then the
+// result code. 0xA001-0xA003 hold DE B0 61 once the RAM contents are valid
+func (e *Emulator) blarggMemoryResult() (code uint8, done bool) {
+	if e.mmu.Read(0xA001) != 0xDE || e.mmu.Read(0xA002) != 0xB0 || e.mmu.Read(0xA003) != 0x61 {
+		return 0, false
+	}
+	code = e.mmu.Read(0xA000)
+	return code, code != 0x80
+}
+
+func (e *Emulator) blarggMemoryText() string {
+	var b strings.Builder
+	for a := uint16(0xA004); a < 0xC000; a++ {
+		c := e.mmu.Read(a)
+		if c == 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Passing tests leave 3, 5, 8, 13, 21, 34 in B-L, failing ones 0x42 everywhere
+func (e *Emulator) mooneyeResult() (bool, string) {
+	r := e.Cpu.Register
+	got := fmt.Sprintf("B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X", r.b, r.c, r.d, r.e, r.h, r.l)
+	if r.b == 3 && r.c == 5 && r.d == 8 && r.e == 13 && r.h == 21 && r.l == 34 {
+		return true, got
+	}
+	return false, "registers " + got
+}
+
+// Screens are compared by shade on DMG, so the reference can use any 4 greys from
+// white to black. CGB frames have to match in color
+func (e *Emulator) compareScreen(reference string) (bool, string) {
+	ref, err := ReadPng(reference)
+	if err != nil {
+		return false, err.Error()
+	}
+	if ref.Bounds().Dx() != SCREEN_WIDTH || ref.Bounds().Dy() != SCREEN_HEIGHT {
+		return false, fmt.Sprintf("%s is not %dx%d", reference, SCREEN_WIDTH, SCREEN_HEIGHT)
+	}
+
+	frame := e.Frame()
+	diff := 0
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			want := ref.At(ref.Bounds().Min.X+x, ref.Bounds().Min.Y+y)
+			if frame.Cgb {
+				r, g, b, _ := want.RGBA()
+				got := RGB555ToRGBA(frame.RGB555(x, y))
+				if uint8(r>>8) != got.R || uint8(g>>8) != got.G || uint8(b>>8) != got.B {
+					diff++
+				}
+			} else if shadeOf(want) != frame.Shade(x, y) {
+				diff++
+			}
+		}
+	}
+	if diff > 0 {
+		return false, fmt.Sprintf("%d pixels differ from %s", diff, filepath.Base(reference))
+	}
+	return true, ""
+}
+
+// Nearest of the 4 DMG shades by luminance, 0 is white
+func shadeOf(c color.Color) uint8 {
+	r, g, b, _ := c.RGBA()
+	lum := (299*r + 587*g + 114*b) / 1000 >> 8
+	return 3 - uint8((lum+42)/85)
+}
+
+// Fixed width table with one line per test and a total
+func ConformanceSummary(results []ConformanceResult) string {
+	var b strings.Builder
+	width := len("TEST")
+	for _, r := range results {
+		width = max(width, len(r.Test.Name))
+	}
+
+	passed := 0
+	fmt.Fprintf(&b, "%-*s  %-6s  %8s  %s\n", width, "TEST", "RESULT", "TIME", "MESSAGE")
+	for _, r := range results {
+		status := "FAIL"
+		if r.Passed {
+			status = "pass"
+			passed++
+		}
+		message := strings.ReplaceAll(r.Message, "\n", " ")
+		fmt.Fprintf(&b, "%-*s  %-6s  %7.2fs  %s\n", width, r.Test.Name, status, r.Duration.Seconds(), message)
+	}
+	fmt.Fprintf(&b, "%d/%d passed\n", passed, len(results))
+	return b.String()
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func WriteJUnit(w io.Writer, suite string, results []ConformanceResult) error {
+	s := junitSuite{Name: suite, Tests: len(results)}
+	for _, r := range results {
+		c := junitCase{Name: r.Test.Name, ClassName: suite + "." + r.Test.Family.String(), Time: r.Duration.Seconds(), SystemOut: r.Message}
+		if !r.Passed {
+			s.Failures++
+			c.Failure = &junitFailure{Message: firstLine(r.Message), Text: r.Message}
+		}
+		s.Time += c.Time
+		s.Cases = append(s.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
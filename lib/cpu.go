@@ -2,7 +2,7 @@ package lib
 
 import (
 	"fmt"
-	"os"
+	"io"
 )
 
 type flagRegister = int
@@ -29,11 +29,12 @@ type registers struct {
 
 type CPU struct {
 	Register registers
-	MMU      *MMU
+	Bus      Bus
 	Debug    *Debug
 	Clock    *Clock
 
-	Halted bool
+	Halted  bool
+	Stopped bool // STOP mode, only a button press wakes the CPU up
 
 	Source                 uint16
 	SourceTarget           target
@@ -49,21 +50,10 @@ type CPU struct {
 	InstructionNumber int
 }
 
-func LoadCpu(m *MMU, d *Debug, cl *Clock) (*CPU, error) {
+func LoadCpu(b Bus, d *Debug, cl *Clock, r registers) (*CPU, error) {
 	c := &CPU{
-		Register: registers{
-			a:  0x01,
-			b:  0x00,
-			c:  0x13,
-			d:  0x00,
-			e:  0xD8,
-			h:  0x01,
-			l:  0x4D,
-			f:  0xB0,
-			pc: 0x0100,
-			sp: 0xFFFE,
-		},
-		MMU:               m,
+		Register:          r,
+		Bus:               b,
 		Debug:             d,
 		Clock:             cl,
 		InstructionNumber: 0,
@@ -72,25 +62,29 @@ func LoadCpu(m *MMU, d *Debug, cl *Clock) (*CPU, error) {
 	return c, nil
 }
 
-func (c *CPU) MMURead(a uint16) uint8         { return c.MMU.Read(a) }
-func (c *CPU) MMURead16(a uint16) uint16      { return c.MMU.Read16(a) }
-func (c *CPU) MMUWrite(a uint16, v uint8)     { c.MMU.Write(a, v) }
-func (c *CPU) MMUWrite16(a uint16, v uint16)  { c.MMU.Write16(a, v) }
+func (c *CPU) MMURead(a uint16) uint8         { return c.Bus.Read(a) }
+func (c *CPU) MMURead16(a uint16) uint16      { return c.Bus.Read16(a) }
+func (c *CPU) MMUWrite(a uint16, v uint8)     { c.Bus.Write(a, v) }
+func (c *CPU) MMUWrite16(a uint16, v uint16)  { c.Bus.Write16(a, v) }
 func (c *CPU) GetFlag(flag flagRegister) bool { return c.Register.f&(0x1<<flag) != 0 }
 func (c *CPU) UpdateClock(cycles int) {
 	changeTimer := c.Clock.Update(cycles)
 	if changeTimer {
-		c.MMU.RequestInterrupt(TIMER)
+		c.Bus.RequestInterrupt(TIMER)
 	}
 }
 
-// Main step of the CPU, divided in fetch, decode and execute
-func (c *CPU) Step(f *os.File) (int, error) {
+// Main step of the CPU, divided in fetch, decode and execute. A Gameboy Doctor line is
+// written to w for every instruction when it is not nil
+func (c *CPU) Step(w io.Writer) (int, error) {
+	if c.Stopped {
+		return 1, nil
+	}
 	cycles := 0
 	if !c.Halted {
 		c.InstructionNumber++
 
-		instruction, err := c.FetchInstruction(f)
+		instruction, err := c.FetchInstruction(w)
 		if err != nil {
 			return 0, err
 		}
@@ -100,8 +94,10 @@ func (c *CPU) Step(f *os.File) (int, error) {
 			return 0, err
 		}
 
-		//Serial print
-		c.Debug.DebugUpdate(c.MMU)
+		//Serial print, test buses run without
+		if c.Debug != nil {
+			c.Debug.DebugUpdate(c.Bus)
+		}
 
 		instructionCycles, err := c.ExecuteInstruction(instruction)
 		if err != nil {
@@ -110,7 +106,7 @@ func (c *CPU) Step(f *os.File) (int, error) {
 		cycles += instructionCycles
 	} else {
 		cycles += 1
-		if c.MMU.interruptorFlags != 0 {
+		if c.Bus.InterruptFlags() != 0 {
 			c.Halted = false
 		}
 	}
@@ -125,14 +121,16 @@ func (c *CPU) Step(f *os.File) (int, error) {
 	return cycles, nil
 }
 
-func (c *CPU) FetchInstruction(f *os.File) (Instruction, error) {
+func (c *CPU) FetchInstruction(w io.Writer) (Instruction, error) {
 	c.currentOpcode = c.MMURead(c.Register.pc)
 	instruction, ok := instructions[c.currentOpcode]
 	if !ok {
 		return instruction, fmt.Errorf("opcode %x not implemented", c.currentOpcode)
 	}
-	if f != nil {
-		DoctorLog(c, f)
+	if w != nil {
+		if err := DoctorLog(c, w); err != nil {
+			return instruction, err
+		}
 	}
 	c.Register.pc += 1
 	if IsImmediateTarget8(instruction.Source) || IsImmediateTarget8(instruction.Destination) {
@@ -201,6 +199,8 @@ func (c *CPU) ExecuteInstruction(i Instruction) (int, error) {
 		cycles += c.Ei()
 	case Halt:
 		cycles += c.Halt()
+	case Stop:
+		cycles += c.Stop()
 	case Daa:
 		cycles += c.Daa()
 	case Rlca:
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -17,10 +18,13 @@ func LoadDebug() *Debug {
 	return d
 }
 
-func (d *Debug) DebugUpdate(m *MMU) {
+func (d *Debug) DebugUpdate(m Bus) {
 	if m.Read(0xFF02) == 0x81 {
 		c := rune(m.Read(0xFF01))
 
+		if d.msgSize == len(d.debugMsg) {
+			d.debugMsg = append(d.debugMsg, make([]rune, len(d.debugMsg))...)
+		}
 		d.debugMsg[d.msgSize] = c
 		d.msgSize += 1
 
@@ -58,14 +62,14 @@ func PrintLog(c *CPU, i Instruction) {
 	fmt.Print(output)
 }
 
-func DoctorLog(c *CPU, f *os.File) {
-	doctor := fmt.Sprintf("A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X\n", c.Register.a, c.Register.f, c.Register.b, c.Register.c, c.Register.d, c.Register.e, c.Register.h, c.Register.l, c.Register.sp, c.Register.pc, c.MMURead(c.Register.pc), c.MMURead(c.Register.pc+1), c.MMURead(c.Register.pc+2), c.MMURead(c.Register.pc+3))
-
-	//fmt.Print(doctor)
+// State before an instruction runs, in the format of https://github.com/robert/gameboy-doctor
+func DoctorLine(c *CPU) string {
+	return fmt.Sprintf("A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X\n", c.Register.a, c.Register.f, c.Register.b, c.Register.c, c.Register.d, c.Register.e, c.Register.h, c.Register.l, c.Register.sp, c.Register.pc, c.MMURead(c.Register.pc), c.MMURead(c.Register.pc+1), c.MMURead(c.Register.pc+2), c.MMURead(c.Register.pc+3))
+}
 
-	if _, err := f.Write([]byte(doctor)); err != nil {
-		log.Fatal(err)
-	}
+func DoctorLog(c *CPU, w io.Writer) error {
+	_, err := io.WriteString(w, DoctorLine(c))
+	return err
 }
 
 func GetInstructionsCycles(c *CPU) {
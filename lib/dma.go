@@ -0,0 +1,93 @@
+package lib
+
+const (
+	DMA_LENGTH = 0xA0 // bytes copied into OAM, one per M-cycle
+	DMA_DELAY  = 1    // M-cycles between the 0xFF46 write and the first transfer
+)
+
+type DMA struct {
+	register uint8 // last value written to 0xFF46
+
+	active bool
+	source uint16
+	index  uint16
+
+	// A write while a transfer is running queues a new one, the old transfer keeps
+	// running (and keeps OAM locked) until the new one takes over
+	pending      bool
+	pendingDelay int
+	pendingSrc   uint16
+}
+
+func LoadDma() *DMA {
+	return &DMA{register: 0xFF}
+}
+
+func (d *DMA) Read() uint8 { return d.register }
+
+func (d *DMA) Write(v uint8) {
+	d.register = v
+	d.pending = true
+	d.pendingDelay = DMA_DELAY
+	d.pendingSrc = dmaSource(v)
+}
+
+// Sources 0xE0-0xFF do not reach echo RAM/OAM/IO, the DMA unit sees the WRAM behind them
+func dmaSource(v uint8) uint16 {
+	a := uint16(v) << 8
+	if a >= 0xE000 {
+		a -= 0x2000
+	}
+	return a
+}
+
+// True while OAM is owned by the DMA unit
+func (d *DMA) Active() bool { return d.active }
+
+// Address the DMA unit is reading this M-cycle
+func (d *DMA) currentAddress() uint16 { return d.source + d.index }
+
+// Only one device can use a bus per cycle. While a transfer is running the CPU
+// sees the byte being copied when it uses the same bus as the DMA source.
+// HRAM and IO registers sit on their own bus and are always reachable
+func (d *DMA) Conflicts(a uint16) bool {
+	if !d.active {
+		return false
+	}
+	if a >= 0xFF00 {
+		return false
+	}
+	if a >= 0xFE00 {
+		return true // OAM itself
+	}
+	return isVramBus(a) == isVramBus(d.source)
+}
+
+func isVramBus(a uint16) bool { return a >= 0x8000 && a < 0xA000 }
+
+// Advances the transfer by the given M-cycles, copying through the MMU. The first of them
+// is the one of the 0xFF46 write
+func (d *DMA) Update(cycles int, m *MMU) {
+	for i := 0; i < cycles; i++ {
+		//a new transfer takes over in the cycle it copies its first byte
+		if d.pending {
+			if d.pendingDelay == 0 {
+				d.pending = false
+				d.active = true
+				d.source = d.pendingSrc
+				d.index = 0
+			} else {
+				d.pendingDelay--
+			}
+		}
+
+		if d.active {
+			v := m.dmaRead(d.currentAddress())
+			m.ppu.oamDmaWrite(0xFE00+d.index, v)
+			d.index++
+			if d.index == DMA_LENGTH {
+				d.active = false
+			}
+		}
+	}
+}
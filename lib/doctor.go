@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const DOCTOR_HISTORY = 16 // matching lines kept to show what led to a divergence
+
+// Returned once every line of the reference log matched
+var ErrDoctorLogEnd = errors.New("reference log ended")
+
+// Checks the Gameboy Doctor lines the CPU writes against a reference log, read as the
+// emulation goes. Pass it to WithDoctorLog, the first line that differs stops the CPU
+// with a DoctorDivergence
+type DoctorCompare struct {
+	reference *bufio.Scanner
+	line      int
+	recent    []string
+	err       error // sticky, the CPU retries the same instruction after an error
+}
+
+func LoadDoctorCompare(r io.Reader) *DoctorCompare {
+	return &DoctorCompare{reference: bufio.NewScanner(r)}
+}
+
+func (d *DoctorCompare) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	got := strings.TrimSpace(string(p))
+	if !d.reference.Scan() {
+		d.err = ErrDoctorLogEnd
+		if err := d.reference.Err(); err != nil {
+			d.err = fmt.Errorf("reading reference log: %w", err)
+		}
+		return 0, d.err
+	}
+	want := strings.TrimSpace(d.reference.Text())
+	d.line++
+
+	if got != want {
+		d.err = &DoctorDivergence{Line: d.line, Got: got, Want: want, Recent: d.recent}
+		return 0, d.err
+	}
+	if len(d.recent) == DOCTOR_HISTORY {
+		d.recent = d.recent[1:]
+	}
+	d.recent = append(d.recent, got)
+	return len(p), nil
+}
+
+type DoctorDivergence struct {
+	Line      int // 1 based
+	Got, Want string
+	Recent    []string // matching lines before it, oldest first
+}
+
+func (d *DoctorDivergence) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "line %d differs from the reference log:\n", d.Line)
+	want := doctorFields(d.Want)
+	for _, f := range strings.Fields(d.Got) {
+		name, value, _ := strings.Cut(f, ":")
+		if want[name] != value {
+			fmt.Fprintf(&b, "  %-5s %s, want %s\n", name, value, want[name])
+		}
+	}
+	b.WriteString("recent instructions:\n")
+	for _, l := range d.Recent {
+		fmt.Fprintf(&b, "  %s  %s\n", l, doctorInstruction(l))
+	}
+	fmt.Fprintf(&b, "> %s  %s\n", d.Got, doctorInstruction(d.Got))
+	fmt.Fprintf(&b, "< %s", d.Want)
+	return b.String()
+}
+
+func doctorFields(line string) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(line) {
+		name, value, _ := strings.Cut(f, ":")
+		fields[name] = value
+	}
+	return fields
+}
+
+// Instruction at PC from the PCMEM bytes of a line, like "Ld8 A,n"
+func doctorInstruction(line string) string {
+	var mem []uint8
+	for _, s := range strings.Split(doctorFields(line)["PCMEM"], ",") {
+		v, err := strconv.ParseUint(s, 16, 8)
+		if err != nil {
+			return ""
+		}
+		mem = append(mem, uint8(v))
+	}
+	if len(mem) < 2 {
+		return ""
+	}
+
+	if mem[0] == 0xCB {
+		cb, ok := cbOpcodes[mem[1]]
+		if !ok {
+			return ""
+		}
+		if cb.Instruction == Bit || cb.Instruction == Res || cb.Instruction == Set {
+			return fmt.Sprintf("%s %d,%s", cb.Instruction, cb.Bit, cb.Register)
+		}
+		return fmt.Sprintf("%s %s", cb.Instruction, cb.Register)
+	}
+	i, ok := instructions[mem[0]]
+	if !ok {
+		return "unknown opcode"
+	}
+	var operands []string
+	for _, t := range []target{i.Destination, i.Source} {
+		if t != None {
+			operands = append(operands, string(t))
+		}
+	}
+	if i.ConditionType != cond_None {
+		operands = append([]string{string(i.ConditionType)}, operands...)
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s", i.InstructionType, strings.Join(operands, ",")))
+}
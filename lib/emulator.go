@@ -1,34 +1,131 @@
 package lib
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"os"
 )
 
 type Emulator struct {
 	Cpu  *CPU
 	cart *Cart
-	file *os.File
+	file io.Writer // Gameboy Doctor log, see DoctorLog
 	ppu  *PPU
 	mmu  *MMU
 
 	cpuCycles int
+	cgb       bool
+	sgb       bool
+	doctor    bool // LY stuck at 0x90 for Gameboy Doctor
+	onFrame   func(f *FrameBuffer)
+	Palette   DmgPalette
+	bootRom   string
+	model     Model
+	modelSet  bool
+	err       error // first option that failed, returned by LoadEmulator
+	cpuErr    error // last instruction that could not run
+
+	rom     []uint8 // cart contents, the cart is built once patches are applied
+	romPath string  // where to look for a patch next to the ROM
+	patch   string
 }
 
 func WithFile(f *os.File) func(e *Emulator) {
 	return func(e *Emulator) {
-		e.file = f
+		if f != nil {
+			e.file = f
+		}
+	}
+}
+
+// Writes a Gameboy Doctor line before every instruction. LY always reads 0x90 like the
+// tool expects, otherwise logs differ on timing alone. A DoctorCompare checks the lines
+// against a reference log instead
+func WithDoctorLog(w io.Writer) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.file = w
+		e.doctor = true
 	}
 }
 
+// Cart from a ROM file, .zip and .gz archives are opened too. An .ips/.ups/.bps patch
+// with the same name is applied unless WithPatch gives one
 func WithCart(p string) func(e *Emulator) {
 	return func(e *Emulator) {
-		cart, err := LoadCart(p)
+		rom, err := ReadRom(p)
+		e.setRom(rom, err)
+		e.romPath = p
+	}
+}
+
+// Cart from memory, zip and gzip archives are recognized by their content
+func WithCartBytes(rom []uint8) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.setRom(UnpackRom(bytes.Clone(rom)))
+	}
+}
+
+func WithCartReader(r io.Reader) func(e *Emulator) {
+	return func(e *Emulator) {
+		data, err := io.ReadAll(r)
 		if err != nil {
-			panic(err)
+			e.setRom(nil, err)
+			return
 		}
-		e.cart = cart
+		e.setRom(UnpackRom(data))
+	}
+}
+
+func (e *Emulator) setRom(rom []uint8, err error) {
+	if err != nil && e.err == nil {
+		e.err = fmt.Errorf("loading cart: %w", err)
+	}
+	e.rom = rom
+}
+
+// IPS, UPS or BPS patch applied to the cart before it runs
+func WithPatch(p string) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.patch = p
+	}
+}
+
+// Called at every VBlank with the frame that was just completed
+func WithFrameCallback(f func(f *FrameBuffer)) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.onFrame = f
+	}
+}
+
+// Colors used when a frame is turned into an image
+func WithPalette(p DmgPalette) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.Palette = p
+	}
+}
+
+// Runs carts that support it as on a Super Game Boy, with SGB colors and borders
+func WithSgb() func(e *Emulator) {
+	return func(e *Emulator) {
+		e.sgb = true
+	}
+}
+
+// Runs the given boot ROM before the cart instead of starting from its end state
+func WithBootRom(p string) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.bootRom = p
+	}
+}
+
+// Hardware to emulate, otherwise it is picked from the cart and the boot ROM
+func WithModel(m Model) func(e *Emulator) {
+	return func(e *Emulator) {
+		e.model = m
+		e.modelSet = true
 	}
 }
 
@@ -36,32 +133,98 @@ func WithCart(p string) func(e *Emulator) {
 // TODO: still a lot of refactor
 func LoadEmulator(options ...func(*Emulator)) (*Emulator, error) {
 	emulator := new(Emulator)
+	emulator.Palette = GreyPalette
 
 	for _, o := range options {
 		o(emulator)
 	}
+	if emulator.err != nil {
+		return nil, emulator.err
+	}
 
 	clock, err := LoadClock()
 	if err != nil {
 		return nil, errors.New("clock failed")
 	}
 
-	ppu, err := LoadPpu()
+	if emulator.rom == nil {
+		return nil, errors.New("no cartridge")
+	}
+	patch := emulator.patch
+	if patch == "" && emulator.romPath != "" {
+		patch = FindPatch(emulator.romPath)
+	}
+	if patch != "" {
+		emulator.rom, err = ApplyPatchFile(emulator.rom, patch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	emulator.cart, err = loadCart(emulator.rom)
+	if err != nil {
+		return nil, fmt.Errorf("loading cart: %w", err)
+	}
+
+	var bootRom []uint8
+	if emulator.bootRom != "" {
+		bootRom, err = LoadBootRom(emulator.bootRom)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !emulator.modelSet {
+		emulator.model = ModelDMG
+		switch {
+		case emulator.sgb:
+			emulator.model = ModelSGB
+		case len(bootRom) == CGB_BOOT_ROM_SIZE || emulator.cart.Header.IsCgb():
+			emulator.model = ModelCGB
+		}
+	}
+	model := emulator.model
+	if bootRom != nil && len(bootRom) != model.BootRomSize() {
+		return nil, fmt.Errorf("%s needs a %d byte boot rom", model, model.BootRomSize())
+	}
+	emulator.sgb = emulator.sgb || model.IsSgb()
+	//CGB hardware runs DMG carts in compatibility mode, once its boot ROM has set it up
+	emulator.cgb = model.IsCgb() && (emulator.cart.Header.IsCgb() || bootRom != nil)
+
+	ppu, err := LoadPpu(emulator.cgb)
 	if err != nil {
 		return nil, errors.New("ppu failed")
 	}
+	ppu.OnFrame = emulator.onFrame
+	ppu.doctorLy = emulator.doctor
 	emulator.ppu = ppu
 
+	var sgb *SGB
+	if emulator.sgb && emulator.cart.Header.SupportsSgb() {
+		sgb = LoadSgb()
+	}
+
 	serial := &Serial{data: 0, control: 0}
-	b, err := LoadBus(emulator.cart, serial, clock, emulator.ppu)
+	b, err := LoadBus(emulator.cart, serial, clock, emulator.ppu, emulator.cgb, sgb)
 	if err != nil {
 		return nil, errors.New("bus failed")
 	}
 	emulator.mmu = b
 
+	b.SetOamBug(model.HasOamBug())
+
+	regs := model.postBootRegisters(emulator.cart.Header, emulator.cgb)
+	if bootRom != nil {
+		b.bootRom = bootRom
+		regs = registers{}
+		ppu.powerOn()
+	} else {
+		clock.Divider = model.postBootDivider(emulator.cgb)
+		ppu.handOver(model.postBootPpu())
+		b.RequestInterrupt(VBLANK) //the boot ROM waits for VBlank with interrupts off
+	}
+
 	debug := LoadDebug()
 
-	cpu, err := LoadCpu(emulator.mmu, debug, clock)
+	cpu, err := LoadCpu(emulator.mmu, debug, clock, regs)
 	if err != nil {
 		return nil, errors.New("cpu failed")
 	}
@@ -78,13 +241,107 @@ func (e *Emulator) Run() {
 	if e.cpuCycles <= 0 {
 		cycles, err := e.Cpu.Step(e.file)
 		if err != nil {
-			fmt.Println(err)
+			if e.cpuErr == nil {
+				fmt.Println(err)
+			}
+			e.cpuErr = err
 			return
 		}
-		e.Cpu.UpdateClock(cycles)
-		e.ppu.Update(cycles)
+		e.tick(cycles)
+
+		//VRAM DMA stops the CPU while everything else keeps running,
+		//HBlanks reached in the meantime can add more transfers
+		for stall := e.mmu.TakeDmaStall(); stall > 0; stall = e.mmu.TakeDmaStall() {
+			e.tick(stall)
+			cycles += stall
+		}
+
 		e.Cpu.HandleInterrupts()
 		e.cpuCycles += cycles
 	}
 	e.cpuCycles--
 }
+
+// Runs until the PPU completes the next frame and returns the M-cycles it took. With the
+// LCD off there is none, so it stops after a frame's worth of M-cycles instead
+func (e *Emulator) RunFrame() int {
+	cycles := FRAME_CYCLES
+	if e.mmu.DoubleSpeed() {
+		cycles *= 2
+	}
+	//frames end on instruction boundaries, so one can take a few M-cycles more
+	frame := e.ppu.FrameCount
+	return e.runWhile(func(ran int) bool {
+		return e.ppu.FrameCount == frame && (ran < cycles || e.ppu.GetLcdPpuEnable())
+	})
+}
+
+// Runs n M-cycles, fewer when the CPU hits an error, and returns how many ran
+func (e *Emulator) RunCycles(n int) int {
+	return e.runWhile(func(ran int) bool { return ran < n })
+}
+
+// The M-cycle the CPU fails on does not count
+func (e *Emulator) runWhile(more func(ran int) bool) int {
+	ran := 0
+	for more(ran) {
+		if e.Run(); e.cpuErr != nil {
+			break
+		}
+		ran++
+	}
+	return ran
+}
+
+// Advances everything but the CPU by the given M-cycles
+func (e *Emulator) tick(cycles int) {
+	e.Cpu.UpdateClock(cycles)
+	e.mmu.UpdateDma(cycles)
+	e.ppu.Update(e.dots(cycles))
+}
+
+// The CPU, timer and OAM DMA follow the CPU clock. The PPU does not, so in double speed
+// an M-cycle only lasts 2 dots
+func (e *Emulator) dots(cycles int) int {
+	if e.mmu.DoubleSpeed() {
+		return cycles * 2
+	}
+	return cycles * 4
+}
+
+// Buttons held from now on, until the next call. A press on a selected line also wakes
+// the CPU from STOP
+func (e *Emulator) SetButtons(b Button) {
+	if e.mmu.joypad.SetButtons(b) {
+		e.mmu.RequestInterrupt(JOYPAD)
+		e.Cpu.Stopped = false
+	}
+}
+
+// Hardware being emulated
+func (e *Emulator) Model() Model { return e.model }
+
+// Frames the PPU completed so far
+func (e *Emulator) FrameCount() uint64 { return e.ppu.FrameCount }
+
+// Instruction the CPU could not run, nil while it runs fine. Once set Run does nothing
+func (e *Emulator) Err() error { return e.cpuErr }
+
+// Last completed frame, see PPU.Frame
+func (e *Emulator) Frame() *FrameBuffer { return e.ppu.Frame() }
+
+// Last completed frame in the emulator palette
+func (e *Emulator) FrameImage() *image.RGBA { return e.Frame().Image(&e.Palette) }
+
+// Draws VRAM tile number tile at tile position x,y of img, in the background colors
+func (e *Emulator) DebugDisplayTile(img *image.RGBA, tile int, x int, y int) {
+	e.ppu.DebugDisplayTile(img, e.Palette.Bg, tile, x, y)
+}
+
+// 256x224 Super Game Boy output with the border, nil when not running as one
+func (e *Emulator) SgbImage() *image.RGBA {
+	if e.mmu.sgb == nil {
+		return nil
+	}
+	return e.mmu.sgb.Image(e.Frame())
+}
@@ -0,0 +1,363 @@
+package lib
+
+// Pixel pipeline for mode 3. A fetcher reads tile rows from VRAM into the background FIFO,
+// sprites are fetched into their own FIFO when the output reaches them and both are mixed
+// one pixel per dot. Registers are read at the step that needs them so mid line writes
+// take effect like on hardware
+// https://gbdev.io/pandocs/pixel_fifo.html
+
+type FetcherState uint8
+
+const (
+	FetchTile FetcherState = iota
+	FetchDataLow
+	FetchDataHigh
+	FetchPush
+)
+
+const (
+	FETCH_STEP_DOTS   = 2 // every step but push takes two dots
+	SPRITE_FETCH_DOTS = 6
+)
+
+type PixelFifo struct {
+	pixels [8]PixelData
+	head   int
+	size   int
+}
+
+func (f *PixelFifo) Push(p PixelData) {
+	f.pixels[(f.head+f.size)%len(f.pixels)] = p
+	f.size++
+}
+
+func (f *PixelFifo) Pop() PixelData {
+	p := f.pixels[f.head]
+	f.head = (f.head + 1) % len(f.pixels)
+	f.size--
+	return p
+}
+
+// i-th pixel from the head, used when sprites merge over pixels already queued
+func (f *PixelFifo) at(i int) *PixelData { return &f.pixels[(f.head+i)%len(f.pixels)] }
+
+func (f *PixelFifo) Clear() {
+	f.head = 0
+	f.size = 0
+}
+
+type Fetcher struct {
+	state     FetcherState
+	dots      int
+	tileX     uint8 // tile column, relative to SCX for the background and to the window start
+	tileIndex uint8
+	attribute uint8 // CGB tile attributes from VRAM bank 1
+	lo, hi    uint8
+	window    bool
+	firstTile bool // the first fetch of a line is thrown away
+}
+
+func (f *Fetcher) Reset(window bool) {
+	*f = Fetcher{state: FetchTile, window: window, firstTile: !window}
+}
+
+func (p *PPU) startLineFifo() {
+	p.bgFifo.Clear()
+	p.objFifo.Clear()
+	p.fetcher.Reset(false)
+	p.discard = p.scx % 8
+	p.inWindow = false
+	p.spriteFetching = false
+	p.spritesFetched = [10]bool{}
+
+	if p.ly == p.wy {
+		p.windowYTriggered = true
+	}
+}
+
+// One dot of mode 3, returns true when the line is complete
+func (p *PPU) transferTick() bool {
+	if p.spriteFetching {
+		p.spriteFetchTick()
+		return false
+	}
+
+	if p.discard == 0 && p.pixels < 160 {
+		if p.windowStarts() {
+			p.startWindow()
+			return false
+		}
+		if p.GetObjEnable() {
+			if i, ok := p.spriteAt(); ok {
+				p.spriteFetching = true
+				p.spriteFetchDots = SPRITE_FETCH_DOTS
+				p.spriteFetchIndex = i
+				p.spriteFetchTick()
+				return false
+			}
+		}
+	}
+
+	p.fetcherTick()
+
+	if p.bgFifo.size == 0 {
+		return false
+	}
+
+	if p.discard > 0 {
+		p.bgFifo.Pop()
+		p.discard--
+		return false
+	}
+
+	pixel := p.mixPixel()
+	frame := &p.frames[p.back]
+	if p.cgb {
+		frame.setColor(int(p.pixels), int(p.ly), p.cgbColor(pixel))
+	} else {
+		if p.pixels == 0 {
+			frame.setRegisters(int(p.ly), p.backgroundPalette, p.obp0, p.obp1)
+		}
+		frame.set(int(p.pixels), int(p.ly), pixel.color, pixel.palette)
+	}
+	p.pixels++
+
+	return p.pixels == 160
+}
+
+func (p *PPU) windowStarts() bool {
+	if p.inWindow || !p.windowYTriggered || !p.GetWindowEnable() {
+		return false
+	}
+	return int(p.pixels)+7 >= int(p.wx)
+}
+
+// Reaching WX restarts the fetcher on the window map, whatever was queued is dropped
+func (p *PPU) startWindow() {
+	p.inWindow = true
+	p.bgFifo.Clear()
+	p.fetcher.Reset(true)
+	if p.wx < 7 {
+		p.discard = 7 - p.wx
+	}
+}
+
+// Next sprite of the line under the current pixel, sprites hanging off the left edge are
+// fetched at pixel 0. The sprite fetched first wins where they overlap, so the order is
+// lower X first and then lower OAM index
+func (p *PPU) spriteAt() (int, bool) {
+	found := -1
+	for i, sprite := range p.spritesInLine {
+		if p.spritesFetched[i] {
+			continue
+		}
+		if uint16(sprite.xPos) != p.pixels+8 && !(p.pixels == 0 && sprite.xPos < 8) {
+			continue
+		}
+		if found == -1 || spriteBefore(sprite, p.spritesInLine[found]) {
+			found = i
+		}
+	}
+	return found, found != -1
+}
+
+func spriteBefore(a, b Sprite) bool {
+	if a.xPos != b.xPos {
+		return a.xPos < b.xPos
+	}
+	return a.oamIndex < b.oamIndex
+}
+
+// The sprite fetch waits for the background fetcher to have a tile ready, then takes six dots
+// with the output stopped
+func (p *PPU) spriteFetchTick() {
+	if p.fetcher.state != FetchPush || p.bgFifo.size == 0 {
+		p.fetcherTick()
+		return
+	}
+
+	p.spriteFetchDots--
+	if p.spriteFetchDots > 0 {
+		return
+	}
+
+	p.spritesFetched[p.spriteFetchIndex] = true
+	p.spriteFetching = false
+	p.mergeSprite(p.spritesInLine[p.spriteFetchIndex])
+}
+
+func (p *PPU) spriteRow(sprite Sprite) (uint8, uint8) {
+	height := 8 + uint16(p.GetObjectAdditionalHeight())
+	row := uint16(p.ly + 16 - sprite.yPos)
+	if sprite.yFlipped {
+		row = height - 1 - row
+	}
+
+	address := uint16(sprite.tileIndex)*16 + row*2
+	if p.cgbMode() {
+		address += uint16(sprite.bank) * 0x2000
+	}
+	return p.vram[address], p.vram[address+1]
+}
+
+// Sprite pixels only take the slots of the object FIFO that are still transparent, so the
+// sprite fetched first keeps priority where they overlap. On CGB the lower OAM index wins
+// instead, whatever the X position
+func (p *PPU) mergeSprite(sprite Sprite) {
+	lo, hi := p.spriteRow(sprite)
+	palette := p.GetPaletteSprite(sprite.palette)
+
+	skip := 0
+	if sprite.xPos < 8 {
+		skip = 8 - int(sprite.xPos)
+	}
+
+	for i := skip; i < 8; i++ {
+		bit := uint8(7 - i)
+		if sprite.xFlipped {
+			bit = uint8(i)
+		}
+		pixel := PixelData{
+			color:      (GetBit(hi, bit) << 1) | GetBit(lo, bit),
+			palette:    palette,
+			priority:   sprite.priority,
+			cgbPalette: sprite.cgbPalette,
+			oamIndex:   sprite.oamIndex,
+		}
+
+		slot := i - skip
+		if slot < p.objFifo.size {
+			queued := p.objFifo.at(slot)
+			if queued.color == 0 || (p.cgbMode() && pixel.color != 0 && pixel.oamIndex < queued.oamIndex) {
+				*queued = pixel
+			}
+		} else {
+			p.objFifo.Push(pixel)
+		}
+	}
+}
+
+// The BG-over-OBJ bit compares against the background color index before the palette.
+// With LCDC bit 0 off the background is blank and never hides sprites
+func (p *PPU) mixPixel() PixelData {
+	bg := p.bgFifo.Pop()
+	if p.cgbMode() {
+		hasObj := p.objFifo.size > 0
+		var obj PixelData
+		if hasObj {
+			obj = p.objFifo.Pop()
+		}
+		return p.cgbMix(bg, obj, hasObj)
+	}
+
+	bgEnabled := p.GetBGWindowEnable()
+	if !bgEnabled {
+		bg = PixelData{color: 0, palette: Bgp}
+	}
+
+	if p.objFifo.size == 0 {
+		return bg
+	}
+	obj := p.objFifo.Pop()
+
+	if obj.color == 0 || !p.GetObjEnable() {
+		return bg
+	}
+	if obj.priority && bgEnabled && bg.color != 0 {
+		return bg
+	}
+	return obj
+}
+
+func (p *PPU) fetcherTick() {
+	f := &p.fetcher
+
+	if f.state == FetchPush {
+		if p.bgFifo.size > 0 {
+			return
+		}
+		if f.firstTile {
+			f.firstTile = false
+			f.state = FetchTile
+			return
+		}
+		xFlipped := p.cgb && f.attribute&bgAttrXFlipBit != 0
+		for i := 7; i >= 0; i-- {
+			bit := uint8(i)
+			if xFlipped {
+				bit = uint8(7 - i)
+			}
+			color := (GetBit(f.hi, bit) << 1) | GetBit(f.lo, bit)
+			p.bgFifo.Push(PixelData{
+				color:      color,
+				palette:    Bgp,
+				priority:   f.attribute&bgAttrPriorityBit != 0,
+				cgbPalette: f.attribute & cbgPaletteBit,
+			})
+		}
+		f.tileX++
+		f.state = FetchTile
+		return
+	}
+
+	f.dots++
+	if f.dots < FETCH_STEP_DOTS {
+		return
+	}
+	f.dots = 0
+
+	switch f.state {
+	case FetchTile:
+		mapAddress := p.fetcherMapAddress()
+		f.tileIndex = p.vram[mapAddress]
+		if p.cgbMode() {
+			f.attribute = p.vram[0x2000+mapAddress]
+		}
+		f.state = FetchDataLow
+	case FetchDataLow:
+		f.lo = p.vram[p.fetcherDataAddress()]
+		f.state = FetchDataHigh
+	case FetchDataHigh:
+		f.hi = p.vram[p.fetcherDataAddress()+1]
+		f.state = FetchPush
+	}
+}
+
+func (p *PPU) fetcherY() uint8 {
+	if p.fetcher.window {
+		return p.windowLine
+	}
+	return p.ly + p.scy
+}
+
+func (p *PPU) fetcherMapAddress() uint16 {
+	f := &p.fetcher
+	if f.window {
+		return p.GetWindowMapArea() + uint16(p.windowLine/8)*32 + uint16(f.tileX&31)
+	}
+
+	x := (p.scx/8 + f.tileX) & 31
+	return p.GetBGTileMapArea() + uint16(p.fetcherY()/8)*32 + uint16(x)
+}
+
+func (p *PPU) fetcherDataAddress() uint16 {
+	tileIndex := p.fetcher.tileIndex
+	attribute := p.fetcher.attribute
+	tileRow := p.fetcherY() % 8
+	if p.cgb && attribute&bgAttrYFlipBit != 0 {
+		tileRow = 7 - tileRow
+	}
+	row := uint16(tileRow) * 2
+
+	var address uint16
+	if p.GetBGWindowTileArea() {
+		address = uint16(tileIndex)*16 + row
+	} else {
+		address = uint16(0x1000+int16(int8(tileIndex))*16) + row
+	}
+
+	if p.cgb && attribute&bgAttrBankBit != 0 {
+		address += 0x2000
+	}
+	return address
+}
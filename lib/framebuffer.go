@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+const (
+	SCREEN_WIDTH  = 160
+	SCREEN_HEIGHT = 144
+)
+
+// Finished screen as 2 bit color indices, with the palette register each pixel went
+// through in bits 2-3. BGP, OBP0 and OBP1 are kept for every line, Shade applies the
+// values the line was drawn with, turning shades into colors is left to the frontend.
+// In CGB mode the palettes hold real colors and the frame keeps RGB555 values instead
+type FrameBuffer struct {
+	Cgb       bool
+	pixels    [SCREEN_WIDTH * SCREEN_HEIGHT]uint8
+	registers [SCREEN_HEIGHT][3]uint8 // BGP, OBP0 and OBP1 at the start of the line, by Palette
+	colors    [SCREEN_WIDTH * SCREEN_HEIGHT]uint16
+}
+
+func (f *FrameBuffer) At(x, y int) uint8       { return f.pixels[y*SCREEN_WIDTH+x] & 0b11 }
+func (f *FrameBuffer) Source(x, y int) Palette { return Palette(f.pixels[y*SCREEN_WIDTH+x] >> 2) }
+func (f *FrameBuffer) RGB555(x, y int) uint16  { return f.colors[y*SCREEN_WIDTH+x] }
+
+// Shade the LCD showed, 0 is the lightest and 3 the darkest
+func (f *FrameBuffer) Shade(x, y int) uint8 {
+	return f.registers[y][f.Source(x, y)] >> (2 * f.At(x, y)) & 0b11
+}
+
+func (f *FrameBuffer) set(x, y int, index uint8, source Palette) {
+	f.pixels[y*SCREEN_WIDTH+x] = index | uint8(source)<<2
+}
+
+func (f *FrameBuffer) setRegisters(y int, bgp, obp0, obp1 uint8) {
+	f.registers[y] = [3]uint8{bgp, obp0, obp1}
+}
+
+func (f *FrameBuffer) setColor(x, y int, rgb uint16) { f.colors[y*SCREEN_WIDTH+x] = rgb }
+
+// Blank screen, white in both modes
+func (f *FrameBuffer) clear() {
+	f.pixels = [SCREEN_WIDTH * SCREEN_HEIGHT]uint8{}
+	f.registers = [SCREEN_HEIGHT][3]uint8{}
+	for i := range f.colors {
+		f.colors[i] = 0x7FFF
+	}
+}
+
+// SHA-256 of the frame in hex. DMG frames hash the color indices and their palette
+// register, so neither the register values nor the colors used to show it change it
+func (f *FrameBuffer) Hash() string {
+	h := sha256.New()
+	if f.Cgb {
+		binary.Write(h, binary.LittleEndian, f.colors)
+	} else {
+		h.Write(f.pixels[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The DMG palette is not used for CGB frames
+func (f *FrameBuffer) Image(palette *DmgPalette) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT))
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			if f.Cgb {
+				img.SetRGBA(x, y, RGB555ToRGBA(f.RGB555(x, y)))
+			} else {
+				img.SetRGBA(x, y, palette.For(f.Source(x, y))[f.Shade(x, y)])
+			}
+		}
+	}
+	return img
+}
+
+// Scales each 5 bit channel to 8 bits
+func RGB555ToRGBA(c uint16) color.RGBA {
+	scale := func(v uint16) uint8 { return uint8(v<<3 | v>>2) }
+	return color.RGBA{scale(c & 0x1F), scale((c >> 5) & 0x1F), scale((c >> 10) & 0x1F), 0xFF}
+}
+
+func ReadPng(p string) (image.Image, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return img, nil
+}
+
+// Screenshots, references and the like
+func WritePng(p string, img image.Image) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+)
+
+// A ROM run for a fixed number of frames, its last frame checked against a recorded hash.
+// Golden tests are kept in a JSON manifest next to a PNG of each frame, see LoadGoldenTests
+type GoldenTest struct {
+	Name   string      `json:"name"`
+	Rom    string      `json:"rom"` // relative to the manifest
+	Frames uint64      `json:"frames"`
+	Hash   string      `json:"hash"` // FrameBuffer.Hash of the last frame
+	Input  []InputStep `json:"input,omitempty"`
+}
+
+// Buttons held from a frame on, until the next step
+type InputStep struct {
+	Frame   uint64 `json:"frame"`
+	Buttons string `json:"buttons"` // see ParseButtons, empty releases everything
+}
+
+func LoadGoldenTests(p string) ([]GoldenTest, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var tests []GoldenTest
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return tests, nil
+}
+
+func SaveGoldenTests(p string, tests []GoldenTest) error {
+	data, err := json.MarshalIndent(tests, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, append(data, '\n'), 0644)
+}
+
+// Runs the test with its input script, dir is where the manifest is. The emulator is
+// returned stopped at the last frame
+func RunGolden(g GoldenTest, dir string) (*Emulator, error) {
+	e, err := LoadEmulator(WithCart(filepath.Join(dir, g.Rom)))
+	if err != nil {
+		return nil, err
+	}
+
+	frame := uint64(0)
+	runTo := func(target uint64) error {
+		if target <= frame {
+			return nil
+		}
+		r := e.RunHeadless(HeadlessOptions{Frames: target - frame})
+		frame = target
+		return r.Err
+	}
+	for _, step := range g.Input {
+		buttons, err := ParseButtons(step.Buttons)
+		if err != nil {
+			return nil, fmt.Errorf("%s frame %d: %w", g.Name, step.Frame, err)
+		}
+		if err := runTo(min(step.Frame, g.Frames)); err != nil {
+			return e, err
+		}
+		e.SetButtons(buttons)
+	}
+	return e, runTo(g.Frames)
+}
+
+// Changed pixels in red over a faded copy of got, and how many there are. Pixels of got
+// that want does not have count as changed
+func DiffImage(got, want image.Image) (*image.RGBA, int) {
+	bounds := got.Bounds()
+	diff := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	changed := 0
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := got.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			wr, wg, wb, _ := want.At(want.Bounds().Min.X+x, want.Bounds().Min.Y+y).RGBA()
+			if r != wr || g != wg || b != wb {
+				diff.SetRGBA(x, y, color.RGBA{0xFF, 0x00, 0x00, 0xFF})
+				changed++
+				continue
+			}
+			fade := func(v uint32) uint8 { return uint8(0xC0 + v>>8/4) }
+			diff.SetRGBA(x, y, color.RGBA{fade(r), fade(g), fade(b), 0xFF})
+		}
+	}
+	return diff, changed
+}
+
+// Writes the diff of got against the reference PNG to p, see DiffImage
+func WriteGoldenDiff(p string, got image.Image, reference string) (int, error) {
+	want, err := ReadPng(reference)
+	if err != nil {
+		return 0, err
+	}
+	diff, changed := DiffImage(got, want)
+	return changed, WritePng(p, diff)
+}
@@ -0,0 +1,105 @@
+package lib
+
+// CGB VRAM DMA (HDMA1-5). General purpose transfers copy everything at once with the CPU
+// stopped, HBlank transfers copy 16 bytes at the start of every HBlank
+// https://gbdev.io/pandocs/CGB_Registers.html#lcd-vram-dma-transfers
+
+const (
+	HDMA_BLOCK_SIZE   = 0x10
+	HDMA_BLOCK_CYCLES = 8 // M-cycles the CPU is stopped for every block, in normal speed
+)
+
+type HDMA struct {
+	source      uint16
+	destination uint16 // offset into VRAM
+	remaining   uint8  // blocks left minus one, HDMA5 bits 0-6
+	hblank      bool   // HBlank transfer in progress
+	stall       int    // M-cycles the CPU still owes to transfers
+}
+
+func LoadHdma() *HDMA {
+	return &HDMA{remaining: 0x7F}
+}
+
+func (m *MMU) HdmaRead(a uint16) uint8 {
+	if !m.cgb || a != 0xFF55 {
+		return 0xFF //HDMA1-4 are write only
+	}
+	return BoolToUint(!m.hdma.hblank)<<7 | m.hdma.remaining
+}
+
+func (m *MMU) HdmaWrite(a uint16, v uint8) {
+	if !m.cgb {
+		return
+	}
+
+	h := m.hdma
+	switch a {
+	case 0xFF51:
+		h.source = uint16(v)<<8 | h.source&0x00F0
+	case 0xFF52:
+		h.source = h.source&0xFF00 | uint16(v&0xF0)
+	case 0xFF53:
+		h.destination = uint16(v&0x1F)<<8 | h.destination&0x00F0
+	case 0xFF54:
+		h.destination = h.destination&0x1F00 | uint16(v&0xF0)
+	case 0xFF55:
+		if h.hblank && v&0x80 == 0 { //cancels the HBlank transfer, the length is kept
+			h.hblank = false
+			return
+		}
+
+		h.remaining = v & 0x7F
+		if v&0x80 == 0 {
+			for m.hdmaBlock() {
+			}
+			return
+		}
+
+		h.hblank = true
+		//with the LCD off there is no HBlank to wait for, started in HBlank the first block goes at once
+		if !m.ppu.GetLcdPpuEnable() || m.ppu.GetMode() == HBlank {
+			m.hdmaBlock()
+		}
+	}
+}
+
+// Called by the PPU when it enters HBlank
+func (m *MMU) HBlankDma() {
+	if m.hdma.hblank {
+		m.hdmaBlock()
+	}
+}
+
+// Copies 16 bytes, returns false once the transfer is over. The transfer also ends when
+// the destination goes past 0x9FFF
+func (m *MMU) hdmaBlock() bool {
+	h := m.hdma
+	for i := 0; i < HDMA_BLOCK_SIZE; i++ {
+		v := m.dmaRead(h.source)
+		m.ppu.vram[m.ppu.vramOffset(0x8000+(h.destination&0x1FFF))] = v
+		h.source++
+		h.destination++
+	}
+
+	h.stall += HDMA_BLOCK_CYCLES
+	if m.doubleSpeed {
+		h.stall += HDMA_BLOCK_CYCLES
+	}
+
+	h.remaining--
+	if h.remaining == 0xFF || h.destination > 0x1FFF {
+		h.destination &= 0x1FFF
+		h.remaining = 0x7F //0xFF once the bit 7 is added back
+		h.hblank = false
+		return false
+	}
+	return true
+}
+
+// M-cycles the CPU has to stay stopped for the transfers made since the last call
+func (m *MMU) TakeDmaStall() int {
+	stall := m.hdma.stall
+	m.hdma.stall = 0
+	return stall
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header changes for homebrew builds, in the spirit of rgbfix. Nil fields are left as they
+// are, the checksums are always recomputed
+type HeaderFix struct {
+	Logo          bool // write the Nintendo logo, the boot ROM locks up without it
+	Pad           bool // pad with 0xFF to a size the header can declare, and declare it
+	Title         *string
+	CartridgeType *uint8
+	RamSize       *uint8 // header code, see ramSizes
+	CgbFlag       *uint8
+	Sgb           *bool // also sets the old licensee to 0x33, the SGB ignores the flag otherwise
+}
+
+// Returns the fixed ROM and a line for every change
+func FixHeader(rom []uint8, fix HeaderFix) ([]uint8, []string, error) {
+	if len(rom) < 0x150 {
+		return nil, nil, errors.New("rom too small for a header")
+	}
+	out := bytes.Clone(rom)
+	cart, err := parseCart(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	before := cart.Info()
+	h := cart.Header
+	var changes []string
+
+	if fix.Pad {
+		size := 0x8000
+		for size < len(out) {
+			size <<= 1
+		}
+		if size != len(out) {
+			changes = append(changes, fmt.Sprintf("padded from %d to %d bytes", len(out), size))
+			out = append(out, bytes.Repeat([]uint8{0xFF}, size-len(out))...)
+		}
+		for h.RomSize = 0; 0x8000<<h.RomSize < size; h.RomSize++ {
+		}
+	}
+	if fix.Logo {
+		h.Logo = nintendoLogo
+	}
+	if fix.CartridgeType != nil {
+		h.CartridgeType = *fix.CartridgeType
+	}
+	if fix.RamSize != nil {
+		if _, ok := ramSizes[*fix.RamSize]; !ok {
+			return nil, nil, fmt.Errorf("unknown RAM size code 0x%02X", *fix.RamSize)
+		}
+		h.RamSize = *fix.RamSize
+	}
+	if fix.CgbFlag != nil {
+		h.Title[15] = *fix.CgbFlag
+	}
+	if fix.Sgb != nil {
+		h.SgbFlag = 0x00
+		if *fix.Sgb {
+			h.SgbFlag = 0x03
+			h.OldLicenseeCode = 0x33
+			if h.NewLicenseeCode == 0 {
+				h.NewLicenseeCode = '0' | '0'<<8 //"00", no licensee
+			}
+		}
+	}
+	if fix.Title != nil {
+		//the last byte belongs to the CGB flag once it is set
+		length := len(h.Title)
+		if h.IsCgb() {
+			length--
+		}
+		if len(*fix.Title) > length {
+			return nil, nil, fmt.Errorf("title %q is longer than %d bytes", *fix.Title, length)
+		}
+		for i := 0; i < length; i++ {
+			h.Title[i] = 0
+		}
+		copy(h.Title[:length], *fix.Title)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	copy(out[0x100:0x150], buf.Bytes())
+
+	out[0x14D] = HeaderChecksum(out)
+	global := GlobalChecksum(out)
+	out[0x14E] = uint8(global >> 8)
+	out[0x14F] = uint8(global)
+
+	after, err := parseCart(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, describeChanges(before, after.Info())...)
+	if rom[0x14D] != out[0x14D] {
+		changes = append(changes, fmt.Sprintf("header checksum: 0x%02X -> 0x%02X", rom[0x14D], out[0x14D]))
+	}
+	if before.ExpectedGlobalChecksum != global {
+		changes = append(changes, fmt.Sprintf("global checksum: 0x%04X -> 0x%04X", before.ExpectedGlobalChecksum, global))
+	}
+	return out, changes, nil
+}
+
+// Fixes the ROM file in and writes it to out, over in when out is empty. Nothing is
+// written on a dry run or when nothing changes
+func FixHeaderFile(in, out string, fix HeaderFix, dryRun bool) ([]string, error) {
+	rom, err := os.ReadFile(in)
+	if err != nil {
+		return nil, err
+	}
+	fixed, changes, err := FixHeader(rom, fix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", in, err)
+	}
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	if out == "" {
+		out = in
+	}
+	return changes, os.WriteFile(out, fixed, 0644)
+}
+
+func describeChanges(before, after CartInfo) []string {
+	var changes []string
+	changed := func(name string, from, to any) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, from, to))
+		}
+	}
+
+	changed("logo", okOrBad(before.LogoValid), okOrBad(after.LogoValid))
+	changed("title", fmt.Sprintf("%q", before.Title), fmt.Sprintf("%q", after.Title))
+	changed("cartridge type", before.Mapper, after.Mapper)
+	changed("ROM size", before.RomSize, after.RomSize)
+	changed("RAM size", before.RamSize, after.RamSize)
+	changed("CGB flag", fmt.Sprintf("0x%02X", before.CgbFlag), fmt.Sprintf("0x%02X", after.CgbFlag))
+	changed("SGB flag", fmt.Sprintf("0x%02X", before.SgbFlag), fmt.Sprintf("0x%02X", after.SgbFlag))
+	changed("licensee", before.Licensee, after.Licensee)
+	return changes
+}
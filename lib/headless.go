@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"errors"
+	"image"
+	"regexp"
+	"strings"
+)
+
+// Running without a window, for CI and test ROMs. Limits are checked between M-cycles,
+// breakpoints before the instruction at that address runs
+type HeadlessOptions struct {
+	Frames      uint64 // stop after this many frames, 0 for no limit
+	Cycles      uint64 // stop after this many M-cycles, 0 for no limit
+	SerialMatch *regexp.Regexp
+	Breakpoints []uint16
+	BreakOnLdBB bool        // LD B,B is the software breakpoint mooneye and acid2 tests end on
+	Until       func() bool // checked after every frame, stops the run once it returns true
+
+	FrameEvery uint64                                 // call OnFrame every this many frames, 0 never
+	OnFrame    func(frame uint64, screen *image.RGBA) // gets ScreenImage
+}
+
+const LD_B_B = 0x40
+
+type StopReason int
+
+const (
+	StopLimit StopReason = iota
+	StopSerialMatch
+	StopBreakpoint
+	StopError
+	StopCondition
+)
+
+func (r StopReason) String() string {
+	return [...]string{"limit reached", "serial matched", "breakpoint", "error", "condition met"}[r]
+}
+
+type HeadlessResult struct {
+	Reason StopReason
+	Frames uint64
+	Cycles uint64
+	PC     uint16
+	Err    error // set when stopped by StopError
+}
+
+// Exit codes of the headless runner
+const (
+	EXIT_OK         = 0 // serial matched, or the limit was reached with no -serial
+	EXIT_NO_MATCH   = 1 // limit reached before the serial output matched
+	EXIT_USAGE      = 2 // bad arguments or the ROM did not load
+	EXIT_BREAKPOINT = 3
+	EXIT_CPU_ERROR  = 4
+)
+
+// Exit code for a run with the given options. The end of a Gameboy Doctor log is a
+// success, the run matched all of it
+func (r HeadlessResult) ExitCode(o HeadlessOptions) int {
+	switch r.Reason {
+	case StopBreakpoint:
+		return EXIT_BREAKPOINT
+	case StopError:
+		if errors.Is(r.Err, ErrDoctorLogEnd) {
+			return EXIT_OK
+		}
+		return EXIT_CPU_ERROR
+	case StopLimit:
+		if o.SerialMatch != nil {
+			return EXIT_NO_MATCH
+		}
+	}
+	return EXIT_OK
+}
+
+func (e *Emulator) RunHeadless(o HeadlessOptions) HeadlessResult {
+	breakpoints := make(map[uint16]bool, len(o.Breakpoints))
+	for _, b := range o.Breakpoints {
+		breakpoints[b] = true
+	}
+
+	startFrame := e.ppu.FrameCount
+	serialSize := e.Cpu.Debug.msgSize
+	result := HeadlessResult{Reason: StopLimit}
+
+	for {
+		result.Frames = e.ppu.FrameCount - startFrame
+		result.PC = e.Cpu.Register.pc
+		if o.Frames != 0 && result.Frames >= o.Frames {
+			break
+		}
+		if o.Cycles != 0 && result.Cycles >= o.Cycles {
+			break
+		}
+		if e.cpuCycles <= 0 && !e.Cpu.Halted && !e.Cpu.Stopped {
+			pc := e.Cpu.Register.pc
+			if breakpoints[pc] || (o.BreakOnLdBB && e.mmu.Read(pc) == LD_B_B) {
+				result.Reason = StopBreakpoint
+				break
+			}
+		}
+
+		e.Run()
+		result.Cycles++
+		if e.cpuErr != nil {
+			result.Reason, result.Err = StopError, e.cpuErr
+			break
+		}
+
+		if o.SerialMatch != nil && e.Cpu.Debug.msgSize != serialSize {
+			serialSize = e.Cpu.Debug.msgSize
+			if o.SerialMatch.MatchString(e.SerialOutput()) {
+				result.Reason = StopSerialMatch
+				break
+			}
+		}
+		if e.ppu.FrameCount != startFrame+result.Frames {
+			frame := e.ppu.FrameCount - startFrame
+			if o.OnFrame != nil && o.FrameEvery != 0 && frame%o.FrameEvery == 0 {
+				o.OnFrame(frame, e.ScreenImage())
+			}
+			if o.Until != nil && o.Until() {
+				result.Reason = StopCondition
+				break
+			}
+		}
+	}
+
+	result.Frames = e.ppu.FrameCount - startFrame
+	return result
+}
+
+// Everything the game sent over the link port so far
+func (e *Emulator) SerialOutput() string {
+	return strings.TrimRight(e.Cpu.Debug.GetMsg(), "\x00")
+}
+
+// What a window would show, the SGB border included when there is one
+func (e *Emulator) ScreenImage() *image.RGBA {
+	if img := e.SgbImage(); img != nil {
+		return img
+	}
+	return e.FrameImage()
+}
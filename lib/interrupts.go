@@ -17,7 +17,7 @@ type Interruptor struct {
 
 func (c *CPU) ProcessInterrupt(b InterruptorBit, address uint16) {
 	c.Halted = false
-	c.MMU.interruptorFlags = UnsetBit(c.MMU.interruptorFlags, int(b))
+	c.Bus.ClearInterrupt(b)
 	c.MasterInterruptEnabled = true
 
 	c.Register.sp -= 1
@@ -29,7 +29,7 @@ func (c *CPU) ProcessInterrupt(b InterruptorBit, address uint16) {
 }
 
 func (c *CPU) HandleInterrupts() {
-	if !c.MasterInterruptEnabled {
+	if !c.MasterInterruptEnabled || c.Stopped {
 		return
 	}
 
@@ -43,7 +43,7 @@ func (c *CPU) HandleInterrupts() {
 
 	for _, interruptor := range interruptors {
 		var flag uint8 = 1 << interruptor.Bit
-		if (c.MMU.ieRegister&flag != 0) && (c.MMU.interruptorFlags&flag != 0) {
+		if c.Bus.GetIeRegister()&c.Bus.InterruptFlags()&flag != 0 {
 			c.ProcessInterrupt(interruptor.Bit, interruptor.Address)
 			return
 		}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Buttons as laid out in Joypad.buttons
+type Button uint8
+
+const (
+	ButtonRight Button = 1 << iota
+	ButtonLeft
+	ButtonUp
+	ButtonDown
+	ButtonA
+	ButtonB
+	ButtonSelect
+	ButtonStart
+)
+
+var buttonNames = []string{"right", "left", "up", "down", "a", "b", "select", "start"}
+
+// Comma separated button names like "a,start", empty for none
+func ParseButtons(s string) (Button, error) {
+	var buttons Button
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, n := range buttonNames {
+			if n == name {
+				buttons |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown button %q", name)
+		}
+	}
+	return buttons, nil
+}
+
+type Joypad struct {
+	selection uint8 // P1 bits 4-5, a 0 selects the row
+	buttons   uint8 // pressed buttons, bits 0-3 are the d-pad and bits 4-7 the actions
+	sgb       *SGB  // P1 doubles as the SGB command port
+}
+
+func LoadJoypad(sgb *SGB) *Joypad {
+	return &Joypad{selection: 0x30, sgb: sgb}
+}
+
+func (j *Joypad) Read() uint8 {
+	result := uint8(0xC0) | j.selection | 0x0F
+
+	//with no row selected the SGB answers with the current controller in multiplayer mode
+	if j.sgb != nil && j.selection == 0x30 {
+		return result &^ j.sgb.ControllerId()
+	}
+
+	if j.selection&0x10 == 0 {
+		result &^= j.buttons & 0x0F
+	}
+	if j.selection&0x20 == 0 {
+		result &^= j.buttons >> 4
+	}
+	return result
+}
+
+func (j *Joypad) Write(v uint8) {
+	j.selection = v & 0x30
+	if j.sgb != nil {
+		j.sgb.P1Write(j.selection)
+	}
+}
+
+// Replaces the held buttons, returns true when one of the selected lines went low, which
+// requests the joypad interrupt
+func (j *Joypad) SetButtons(b Button) bool {
+	before := j.Read()
+	j.buttons = uint8(b)
+	return before&^j.Read()&0x0F != 0
+}
@@ -1,17 +1,17 @@
 package lib
 
-import "fmt"
-
 type MBC1 struct {
 	rom []uint8
+	ram []uint8 // empty when the cart has none
 
 	ramEnabled bool
 	romBank    uint8
 }
 
-func loadMBC1(rom []uint8) *MBC1 {
+func loadMBC1(rom []uint8, ramSize int) *MBC1 {
 	mbc1 := &MBC1{
 		rom:        rom,
+		ram:        make([]uint8, ramSize),
 		romBank:    1,
 		ramEnabled: false,
 	}
@@ -23,21 +23,24 @@ func (m *MBC1) read(a uint16) uint8 {
 	case a < 0x4000: //ROM bank 00
 		return m.rom[a]
 	case a < 0x8000: //ROM bank 01-7F
-		offset := (a - 0x4000) + (uint16(m.romBank) * 0x4000)
-		return m.rom[offset]
+		offset := int(a-0x4000) + int(m.romBank)*0x4000
+		return m.rom[offset%len(m.rom)]
 	case a >= 0xA000 && a < 0xC000: //RAM bank 00-03
-		//TODO
-		return m.rom[a]
+		//TODO: RAM banking, only bank 0 is reachable
+		offset := int(a - 0xA000)
+		if !m.ramEnabled || offset >= len(m.ram) {
+			return 0xFF
+		}
+		return m.ram[offset]
 	default:
 		return m.rom[a]
 	}
 }
 
 func (m *MBC1) write(a uint16, v uint8) {
-	fmt.Printf("rom write -> a: %x, v: %x\n", a, v)
 	switch {
 	case a < 0x2000: //switch ram, value "intercepted"
-		if v == 0x0A {
+		if v&0x0F == 0x0A {
 			m.ramEnabled = true
 		} else {
 			m.ramEnabled = false
@@ -51,5 +54,8 @@ func (m *MBC1) write(a uint16, v uint8) {
 	case a < 0x6000: //upper bits bank number
 	case a < 0x8000: //rom/ram mode
 	case a >= 0xA000 && a < 0xC000: //ram banks
+		if offset := int(a - 0xA000); m.ramEnabled && offset < len(m.ram) {
+			m.ram[offset] = v
+		}
 	}
 }
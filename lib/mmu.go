@@ -4,23 +4,44 @@ import "fmt"
 
 type MMU struct {
 	cart             *Cart
-	wram             [0x2000]uint8
+	wram             [0x8000]uint8 // 8 banks of 4KiB, only 2 are reachable on DMG
+	wramBank         uint8         // bank mapped at 0xD000, SVBK
 	hram             [0x80]uint8
 	serial           *Serial
 	ieRegister       uint8
 	interruptorFlags uint8
 	clock            *Clock
 	ppu              *PPU
+	dma              *DMA
+	hdma             *HDMA
+	joypad           *Joypad
+	sgb              *SGB    // nil unless running as a Super Game Boy
+	bootRom          []uint8 // nil once 0xFF50 is written
+	oamBug           bool    // the model corrupts OAM on 16 bit increments, see OamBug
+
+	cgb          bool
+	doubleSpeed  bool // KEY1 bit 7
+	speedPrepare bool // KEY1 bit 0, the next STOP switches speed
 }
 
-func LoadBus(rb *Cart, s *Serial, c *Clock, p *PPU) (*MMU, error) {
-	b := &MMU{cart: rb, serial: s, clock: c, ppu: p}
+func LoadBus(rb *Cart, s *Serial, c *Clock, p *PPU, cgb bool, sgb *SGB) (*MMU, error) {
+	b := &MMU{cart: rb, serial: s, clock: c, ppu: p, dma: LoadDma(), hdma: LoadHdma(), cgb: cgb, wramBank: 1, sgb: sgb}
+	b.joypad = LoadJoypad(sgb)
 
 	return b, nil
 }
 
 func (m *MMU) Read(a uint16) uint8 {
+	if m.dma.Conflicts(a) {
+		if a >= 0xFE00 {
+			return 0xFF
+		}
+		return m.dmaRead(m.dma.currentAddress())
+	}
+
 	switch {
+	case m.bootRomMapped(a):
+		return m.bootRom[a]
 	case a < 0x8000: // ROM data
 		return m.cart.CartRead(a)
 	case a < 0xA000: // Video RAM
@@ -32,19 +53,34 @@ func (m *MMU) Read(a uint16) uint8 {
 	case a < 0xFE00: // Echo RAM (prohibited)
 		return 0
 	case a < 0xFEA0: // Object attribute memory
+		m.OamBug(a, OamBugRead)
 		return m.ppu.oamRead(a)
 	case a < 0xFF00: // Reserved (prohibited)
+		m.OamBug(a, OamBugRead)
 		return 0
+	case a == 0xFF00:
+		return m.joypad.Read()
 	case a < 0xFF03: // IO registers
 		return m.serial.SerialRead(a)
 	case a >= 0xFF04 && a <= 0xFF07:
 		return m.clock.Read(a)
 	case a == 0xFF0F:
-		return m.interruptorFlags
+		return m.interruptorFlags | 0xE0 //only 5 interrupts, the rest reads high
+	case a == 0xFF46:
+		return m.dma.Read()
 	case a >= 0xFF40 && a <= 0xFF4B:
 		return m.ppu.LcdRead(a)
 	case a == 0xFF4D:
-		return 0xFF
+		return m.Key1Read()
+	case a == 0xFF4F || (a >= 0xFF68 && a <= 0xFF6B):
+		return m.ppu.CgbRead(a)
+	case a >= 0xFF51 && a <= 0xFF55:
+		return m.HdmaRead(a)
+	case a == 0xFF70:
+		if !m.cgb {
+			return 0xFF
+		}
+		return m.wramBank | 0xF8
 	case a < 0xFF80:
 		return 0
 	case a < 0xFFFF: // High RAM
@@ -57,6 +93,10 @@ func (m *MMU) Read(a uint16) uint8 {
 }
 
 func (m *MMU) Write(a uint16, v uint8) {
+	if m.dma.Conflicts(a) {
+		return
+	}
+
 	switch {
 	case a < 0x8000:
 		m.cart.CartWrite(a, v)
@@ -69,20 +109,37 @@ func (m *MMU) Write(a uint16, v uint8) {
 	case a < 0xFE00: // Echo RAM (prohibited)
 		return
 	case a < 0xFEA0: // Object attribute memory
+		m.OamBug(a, OamBugWrite)
 		m.ppu.oamwrite(a, v)
 	case a < 0xFF00: // Reserved (prohibited)
-		return
+		m.OamBug(a, OamBugWrite)
+	case a == 0xFF00:
+		m.joypad.Write(v)
 	case a < 0xFF03: // IO registers
 		m.serial.SerialWrite(a, v)
 	case a >= 0xFF04 && a <= 0xFF07:
 		m.clock.Write(a, v)
 	case a == 0xFF0F:
-		m.interruptorFlags = v
+		m.interruptorFlags = v & 0x1F
+	case a == 0xFF46:
+		m.dma.Write(v)
 	case a >= 0xFF40 && a <= 0xFF4B:
-		if a == 0xFF46 {
-			m.DmaTransfer(v)
-		}
 		m.ppu.LcdWrite(a, v)
+	case a == 0xFF4D:
+		m.Key1Write(v)
+	case a == 0xFF4F || (a >= 0xFF68 && a <= 0xFF6B):
+		m.ppu.CgbWrite(a, v)
+	case a == 0xFF50:
+		m.UnmapBootRom(v)
+	case a >= 0xFF51 && a <= 0xFF55:
+		m.HdmaWrite(a, v)
+	case a == 0xFF70:
+		if m.cgb {
+			m.wramBank = v & 0b111
+			if m.wramBank == 0 {
+				m.wramBank = 1
+			}
+		}
 	case a < 0xFF80:
 	case a >= 0xFF80 && a < 0xFFFF: // High RAM
 		m.HramWrite(a, v)
@@ -93,11 +150,27 @@ func (m *MMU) Write(a uint16, v uint8) {
 	}
 }
 
-func (m *MMU) DmaTransfer(a uint8) {
-	realAddress := uint16(a) << 8
-	for i := uint16(0); i < 0xA0; i++ {
-		v := m.Read(realAddress + i)
-		m.ppu.oamwrite(0xFE00+i, v)
+// Called by the instructions that put an address on the bus with the 16 bit increment
+// unit, with the address they had. Reads and writes of 0xFE00-0xFEFF call it themselves
+func (m *MMU) OamBug(a uint16, kind OamBugKind) {
+	if m.oamBug && a >= 0xFE00 && a < 0xFF00 {
+		m.ppu.corruptOam(kind)
+	}
+}
+
+func (m *MMU) UpdateDma(cycles int) { m.dma.Update(cycles, m) }
+
+// Reads as seen by the DMA unit, which is not blocked by itself
+func (m *MMU) dmaRead(a uint16) uint8 {
+	switch {
+	case a < 0x8000:
+		return m.cart.CartRead(a)
+	case a < 0xA000:
+		return m.ppu.vramDmaRead(a)
+	case a < 0xC000:
+		return m.cart.CartRead(a)
+	default:
+		return m.WramRead(a)
 	}
 }
 
@@ -107,18 +180,59 @@ func (m *MMU) Read16(a uint16) uint16 {
 	return (hi << 8) | lo
 }
 
+// Low byte first, like LD (a16),SP
 func (m *MMU) Write16(a uint16, v uint16) {
-	m.Write(a+1, uint8((v>>8)&0xFF))
 	m.Write(a, uint8(v&0xFF))
+	m.Write(a+1, uint8((v>>8)&0xFF))
 }
 
-func (m *MMU) WramRead(a uint16) uint8     { return m.wram[a-0xC000] }
-func (m *MMU) WramWrite(a uint16, v uint8) { m.wram[a-0xC000] = v }
+func (m *MMU) WramRead(a uint16) uint8     { return m.wram[m.wramOffset(a)] }
+func (m *MMU) WramWrite(a uint16, v uint8) { m.wram[m.wramOffset(a)] = v }
 func (m *MMU) HramRead(a uint16) uint8     { return m.hram[a-0xFF80] }
 func (m *MMU) HramWrite(a uint16, v uint8) { m.hram[a-0xFF80] = v }
 func (m *MMU) GetIeRegister() uint8        { return m.ieRegister }
 func (m *MMU) SetIeRegister(ir uint8)      { m.ieRegister = ir }
+func (m *MMU) SetOamBug(on bool)           { m.oamBug = on }
+
+// 0xC000-0xCFFF is always bank 0, 0xD000-0xDFFF is the bank selected by SVBK
+func (m *MMU) wramOffset(a uint16) int {
+	if a < 0xD000 {
+		return int(a - 0xC000)
+	}
+	return int(m.wramBank)*0x1000 + int(a-0xD000)
+}
+
+func (m *MMU) Key1Read() uint8 {
+	if !m.cgb {
+		return 0xFF
+	}
+	return BoolToUint(m.doubleSpeed)<<7 | 0x7E | BoolToUint(m.speedPrepare)
+}
+
+func (m *MMU) Key1Write(v uint8) {
+	if m.cgb {
+		m.speedPrepare = v&1 != 0
+	}
+}
+
+func (m *MMU) DoubleSpeed() bool { return m.doubleSpeed }
+
+// Called by STOP, returns false when no switch was armed through KEY1
+func (m *MMU) SwitchSpeed() bool {
+	if !m.cgb || !m.speedPrepare {
+		return false
+	}
+	m.doubleSpeed = !m.doubleSpeed
+	m.speedPrepare = false
+	return true
+}
 
 func (m *MMU) RequestInterrupt(i InterruptorBit) {
 	m.interruptorFlags = SetBit(m.interruptorFlags, int(i))
 }
+
+func (m *MMU) ClearInterrupt(i InterruptorBit) {
+	m.interruptorFlags = UnsetBit(m.interruptorFlags, int(i))
+}
+
+func (m *MMU) InterruptFlags() uint8 { return m.interruptorFlags }
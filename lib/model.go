@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hardware revision being emulated. Software tells them apart by the registers the boot
+// ROM leaves behind
+type Model int
+
+const (
+	ModelDMG0 Model = iota // early DMG with a different boot ROM
+	ModelDMG
+	ModelMGB // Game Boy Pocket/Light
+	ModelSGB
+	ModelSGB2
+	ModelCGB
+	ModelAGB // Game Boy Advance running Game Boy carts
+)
+
+var modelNames = [...]string{"DMG0", "DMG", "MGB", "SGB", "SGB2", "CGB", "AGB"}
+
+func (m Model) String() string { return modelNames[m] }
+
+func ParseModel(name string) (Model, error) {
+	for i, n := range modelNames {
+		if strings.EqualFold(name, n) {
+			return Model(i), nil
+		}
+	}
+	return ModelDMG, fmt.Errorf("unknown model %q, expected one of %s", name, strings.Join(modelNames[:], ", "))
+}
+
+// CGB hardware, it still runs DMG carts in compatibility mode
+func (m Model) IsCgb() bool { return m == ModelCGB || m == ModelAGB }
+func (m Model) IsSgb() bool { return m == ModelSGB || m == ModelSGB2 }
+
+// The CGB boot ROM is the only one that does not fit in 256 bytes
+func (m Model) BootRomSize() int {
+	if m.IsCgb() {
+		return CGB_BOOT_ROM_SIZE
+	}
+	return DMG_BOOT_ROM_SIZE
+}
+
+// 16 bit increments of a pointer into OAM during mode 2 corrupt it, fixed on CGB
+func (m Model) HasOamBug() bool { return !m.IsCgb() }
+
+// Registers as the boot ROM leaves them
+// https://gbdev.io/pandocs/Power_Up_Sequence.html#cpu-registers
+func (m Model) postBootRegisters(h header, cgbMode bool) registers {
+	r := registers{pc: 0x0100, sp: 0xFFFE}
+
+	switch m {
+	case ModelDMG0:
+		r.a, r.b, r.c, r.d, r.e, r.h, r.l = 0x01, 0xFF, 0x13, 0x00, 0xC1, 0x84, 0x03
+	case ModelDMG, ModelMGB:
+		r.a, r.b, r.c, r.d, r.e, r.h, r.l = 0x01, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D
+		if m == ModelMGB {
+			r.a = 0xFF
+		}
+		//the boot ROM ends on a compare that leaves H and C set unless the header checksum is 0
+		r.f = 0x80
+		if h.HeaderChecksum != 0 {
+			r.f = 0xB0
+		}
+	case ModelSGB, ModelSGB2:
+		r.a, r.b, r.c, r.d, r.e, r.h, r.l = 0x01, 0x00, 0x14, 0x00, 0x00, 0xC0, 0x60
+		if m == ModelSGB2 {
+			r.a = 0xFF
+		}
+	case ModelCGB, ModelAGB:
+		r.a, r.f = 0x11, 0x80
+		if cgbMode {
+			r.b, r.c, r.d, r.e, r.h, r.l = 0x00, 0x00, 0xFF, 0x56, 0x00, 0x0D
+		} else {
+			//the compatibility palette lookup leaves the title checksum of Nintendo carts in B
+			r.b, r.c, r.d, r.e, r.h, r.l = 0x00, 0x00, 0x00, 0x08, 0x00, 0x7C
+			if h.OldLicenseeCode == 0x01 || (h.OldLicenseeCode == 0x33 && h.NewLicenseeCode == 0x3130) {
+				for _, c := range h.Title {
+					r.b += c
+				}
+			}
+			if r.b == 0x43 || r.b == 0x58 {
+				r.h, r.l = 0x99, 0x1A
+			}
+		}
+		//the AGB boot ROM has an extra INC B before handing over
+		if m == ModelAGB {
+			r.b++
+			r.f = BoolToUint(r.b == 0)<<flagZ | BoolToUint(r.b&0x0F == 0)<<flagH
+		}
+	}
+	return r
+}
+
+// Internal divider when the boot ROM hands over. The CGB one takes longer on DMG carts
+// while it picks a compatibility palette
+func (m Model) postBootDivider(cgbMode bool) uint16 {
+	switch m {
+	case ModelDMG0:
+		return 0x1830
+	case ModelDMG, ModelMGB:
+		return 0xABCC
+	case ModelSGB, ModelSGB2:
+		return 0xD85C //the SGB boot ROM also sends the header to the SNES
+	default:
+		if cgbMode {
+			return 0x1EA0
+		}
+		return 0x267C
+	}
+}
+
+// Where the PPU is when the boot ROM hands over, it always finishes waiting for VBlank
+func (m Model) postBootPpu() (line uint8, dots uint16) {
+	if m.IsCgb() {
+		return 144, 0
+	}
+	return LINES_PER_FRAME - 1, 400
+}
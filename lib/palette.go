@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Output colors for the four shades, lightest first
+type Shades [4]color.RGBA
+
+// Colors used to display a DMG frame. Every palette register gets its own shades,
+// like the colorization the CGB applies to DMG games
+type DmgPalette struct {
+	Bg, Obj0, Obj1 Shades
+}
+
+func singlePalette(s Shades) DmgPalette { return DmgPalette{s, s, s} }
+
+func rgb(v uint32) color.RGBA {
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xFF}
+}
+
+var (
+	GreyPalette     = singlePalette(Shades{rgb(0xFFFFFF), rgb(0xC0C0C0), rgb(0x555555), rgb(0x000000)})
+	DmgGreenPalette = singlePalette(Shades{rgb(0x9BBC0F), rgb(0x8BAC0F), rgb(0x306230), rgb(0x0F380F)})
+	PocketPalette   = singlePalette(Shades{rgb(0xC4CFA1), rgb(0x8B956D), rgb(0x4D533C), rgb(0x1F1F1F)})
+	LightPalette    = singlePalette(Shades{rgb(0x00B581), rgb(0x009A71), rgb(0x00694A), rgb(0x004F3B)})
+	// Blue/orange steps stay apart for the common kinds of color blindness
+	ContrastPalette = DmgPalette{
+		Bg:   Shades{rgb(0xFFFFFF), rgb(0x9CC3E6), rgb(0x2E6DB4), rgb(0x000000)},
+		Obj0: Shades{rgb(0xFFFFFF), rgb(0xFFC07A), rgb(0xE66100), rgb(0x000000)},
+		Obj1: Shades{rgb(0xFFFFFF), rgb(0xFFC07A), rgb(0xE66100), rgb(0x000000)},
+	}
+)
+
+var DmgPalettes = map[string]DmgPalette{
+	"grey":     GreyPalette,
+	"dmg":      DmgGreenPalette,
+	"pocket":   PocketPalette,
+	"light":    LightPalette,
+	"contrast": ContrastPalette,
+}
+
+func (d *DmgPalette) For(p Palette) Shades {
+	switch p {
+	case Obp0:
+		return d.Obj0
+	case Obp1:
+		return d.Obj1
+	default:
+		return d.Bg
+	}
+}
+
+// Preset name or path to a palette file
+func FindPalette(name string) (DmgPalette, error) {
+	if p, ok := DmgPalettes[name]; ok {
+		return p, nil
+	}
+	p, err := LoadPaletteFile(name)
+	if err != nil {
+		return DmgPalette{}, fmt.Errorf("palette %s is not a preset or a readable file: %w", name, err)
+	}
+	return p, nil
+}
+
+// Palette files have one line per register with four RGB hex colors, lightest first.
+// Registers that are not listed use the bg colors
+//
+//	// comment
+//	bg   E0F8D0 88C070 346856 081820
+//	obj0 #FFFFFF #FF8484 #943A3A #000000
+func LoadPaletteFile(path string) (DmgPalette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return DmgPalette{}, err
+	}
+	defer file.Close()
+
+	found := map[string]Shades{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return DmgPalette{}, fmt.Errorf("palette line %d: expected a register and 4 colors", lineNumber)
+		}
+
+		register := strings.ToLower(fields[0])
+		if register != "bg" && register != "obj0" && register != "obj1" {
+			return DmgPalette{}, fmt.Errorf("palette line %d: unknown register %s", lineNumber, fields[0])
+		}
+
+		var shades Shades
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(strings.TrimPrefix(field, "#"), 16, 32)
+			if err != nil || len(strings.TrimPrefix(field, "#")) != 6 {
+				return DmgPalette{}, fmt.Errorf("palette line %d: invalid color %s", lineNumber, field)
+			}
+			shades[i] = rgb(uint32(v))
+		}
+		found[register] = shades
+	}
+	if err := scanner.Err(); err != nil {
+		return DmgPalette{}, err
+	}
+
+	bg, ok := found["bg"]
+	if !ok {
+		return DmgPalette{}, fmt.Errorf("palette %s has no bg line", path)
+	}
+	palette := singlePalette(bg)
+	if s, ok := found["obj0"]; ok {
+		palette.Obj0 = s
+	}
+	if s, ok := found["obj1"]; ok {
+		palette.Obj1 = s
+	}
+	return palette, nil
+}
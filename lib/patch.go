@@ -0,0 +1,349 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Soft patching for ROM hacks and translations, the format is picked from the patch header
+// IPS: https://zerosoft.zophar.net/ips.php
+// UPS: https://www.romhacking.net/documents/392/
+// BPS: https://www.romhacking.net/documents/746/
+
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+var errPatchTruncated = errors.New("patch is truncated")
+
+const MAX_PATCHED_ROM = 8 << 20 // bytes, the largest cart ROM
+
+// A patch with the same name as the ROM, game.gb and game.zip both pick up game.ips.
+// Empty when there is none
+func FindPatch(rom string) string {
+	base := rom
+	for {
+		ext := strings.ToLower(filepath.Ext(base))
+		if ext != ".gz" && ext != ".zip" && ext != ".gb" && ext != ".gbc" {
+			break
+		}
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	for _, ext := range patchExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+func ApplyPatchFile(rom []uint8, p string) ([]uint8, error) {
+	patch, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := ApplyPatch(rom, patch)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return patched, nil
+}
+
+// Returns the patched ROM, the original is left untouched
+func ApplyPatch(rom []uint8, patch []uint8) ([]uint8, error) {
+	switch {
+	case bytes.HasPrefix(patch, []uint8("PATCH")):
+		return applyIps(rom, patch)
+	case bytes.HasPrefix(patch, []uint8("UPS1")):
+		return applyUps(rom, patch)
+	case bytes.HasPrefix(patch, []uint8("BPS1")):
+		return applyBps(rom, patch)
+	default:
+		return nil, errors.New("unknown patch format")
+	}
+}
+
+// Records of a 24 bit offset and 16 bit length followed by the data, a 0 length is a run
+// of the same byte. Can be followed by a size to truncate the ROM to
+func applyIps(rom []uint8, patch []uint8) ([]uint8, error) {
+	out := bytes.Clone(rom)
+	p := 5
+
+	for {
+		if p+3 > len(patch) {
+			return nil, errPatchTruncated
+		}
+		if string(patch[p:p+3]) == "EOF" {
+			p += 3
+			break
+		}
+		if p+5 > len(patch) {
+			return nil, errPatchTruncated
+		}
+		offset := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		size := int(binary.BigEndian.Uint16(patch[p+3:]))
+		p += 5
+
+		var data []uint8
+		if size == 0 {
+			if p+3 > len(patch) {
+				return nil, errPatchTruncated
+			}
+			size = int(binary.BigEndian.Uint16(patch[p:]))
+			data = bytes.Repeat([]uint8{patch[p+2]}, size)
+			p += 3
+		} else {
+			if p+size > len(patch) {
+				return nil, errPatchTruncated
+			}
+			data = patch[p : p+size]
+			p += size
+		}
+
+		if offset+size > len(out) {
+			out = append(out, make([]uint8, offset+size-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+
+	if p+3 <= len(patch) {
+		size := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		if size < len(out) {
+			out = out[:size]
+		}
+	}
+	return out, nil
+}
+
+// UPS and BPS both end with the CRC32 of the source, the target and the patch itself
+type patchFooter struct {
+	source, target, patch uint32
+}
+
+func readPatchFooter(patch []uint8) (patchFooter, error) {
+	if len(patch) < 12 {
+		return patchFooter{}, errPatchTruncated
+	}
+	f := patch[len(patch)-12:]
+	footer := patchFooter{
+		source: binary.LittleEndian.Uint32(f),
+		target: binary.LittleEndian.Uint32(f[4:]),
+		patch:  binary.LittleEndian.Uint32(f[8:]),
+	}
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != footer.patch {
+		return footer, errors.New("patch checksum does not match, the file is damaged")
+	}
+	return footer, nil
+}
+
+func (f patchFooter) checkSource(rom []uint8) error {
+	if crc32.ChecksumIEEE(rom) != f.source {
+		return fmt.Errorf("patch is for a different ROM (CRC32 %08X, expected %08X)", crc32.ChecksumIEEE(rom), f.source)
+	}
+	return nil
+}
+
+func (f patchFooter) checkTarget(out []uint8) error {
+	if crc32.ChecksumIEEE(out) != f.target {
+		return errors.New("patched ROM checksum does not match")
+	}
+	return nil
+}
+
+// Reads the variable length numbers shared by UPS and BPS
+type patchReader struct {
+	data []uint8
+	pos  int
+	end  int // start of the footer
+}
+
+func (r *patchReader) byte() (uint8, error) {
+	if r.pos >= r.end {
+		return 0, errPatchTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// The largest number is a BPS action with the length of a whole ROM, anything past it is an
+// error so a crafted patch cannot overflow an int
+func (r *patchReader) number() (int, error) {
+	var value, shift uint64 = 0, 1
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		value += uint64(b&0x7F) * shift
+		if value > MAX_PATCHED_ROM<<2|0b11 {
+			return 0, errors.New("patch holds a number too large for a ROM")
+		}
+		if b&0x80 != 0 {
+			return int(value), nil
+		}
+		shift <<= 7
+		value += shift
+	}
+}
+
+// Size of the patched ROM, the second number of UPS and BPS
+func (r *patchReader) targetSize() (int, error) {
+	if _, err := r.number(); err != nil { //source size, covered by its checksum
+		return 0, err
+	}
+	size, err := r.number()
+	if err == nil && size > MAX_PATCHED_ROM {
+		return 0, fmt.Errorf("patched ROM would have %d bytes, more than the largest cart", size)
+	}
+	return size, err
+}
+
+// Hunks of bytes XORed with the source, each after a number of unchanged bytes
+func applyUps(rom []uint8, patch []uint8) ([]uint8, error) {
+	footer, err := readPatchFooter(patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := footer.checkSource(rom); err != nil {
+		return nil, err
+	}
+
+	r := &patchReader{data: patch, pos: 4, end: len(patch) - 12}
+	targetSize, err := r.targetSize()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]uint8, targetSize)
+	copy(out, rom)
+	offset := 0
+	for r.pos < r.end {
+		skip, err := r.number()
+		if err != nil {
+			return nil, err
+		}
+		offset += skip
+		if offset > len(out) {
+			return nil, errors.New("patch writes past the end of the ROM")
+		}
+		for {
+			x, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			if offset < len(out) {
+				out[offset] ^= x
+			}
+			offset++
+			if x == 0 {
+				break
+			}
+		}
+	}
+
+	if err := footer.checkTarget(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// The target is built from commands copying from the source, the patch or itself
+func applyBps(rom []uint8, patch []uint8) ([]uint8, error) {
+	footer, err := readPatchFooter(patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := footer.checkSource(rom); err != nil {
+		return nil, err
+	}
+
+	r := &patchReader{data: patch, pos: 4, end: len(patch) - 12}
+	targetSize, err := r.targetSize()
+	if err != nil {
+		return nil, err
+	}
+	metadataSize, err := r.number()
+	if err != nil {
+		return nil, err
+	}
+	if r.pos+metadataSize > r.end {
+		return nil, errPatchTruncated
+	}
+	r.pos += metadataSize
+
+	out := make([]uint8, 0, targetSize)
+	sourceOffset, targetOffset := 0, 0
+	for r.pos < r.end {
+		data, err := r.number()
+		if err != nil {
+			return nil, err
+		}
+		length := data>>2 + 1
+		if len(out)+length > targetSize {
+			return nil, errors.New("patch writes past the end of the ROM")
+		}
+
+		switch data & 0b11 {
+		case bpsSourceRead:
+			if len(out)+length > len(rom) {
+				return nil, errors.New("patch copies from outside the ROM")
+			}
+			out = append(out, rom[len(out):len(out)+length]...)
+		case bpsTargetRead:
+			if r.pos+length > r.end {
+				return nil, errPatchTruncated
+			}
+			out = append(out, patch[r.pos:r.pos+length]...)
+			r.pos += length
+		case bpsSourceCopy, bpsTargetCopy:
+			d, err := r.number()
+			if err != nil {
+				return nil, err
+			}
+			delta := d >> 1
+			if d&1 != 0 {
+				delta = -delta
+			}
+
+			if data&0b11 == bpsSourceCopy {
+				sourceOffset += delta
+				if sourceOffset < 0 || sourceOffset+length > len(rom) {
+					return nil, errors.New("patch copies from outside the ROM")
+				}
+				out = append(out, rom[sourceOffset:sourceOffset+length]...)
+				sourceOffset += length
+			} else {
+				targetOffset += delta
+				if targetOffset < 0 || targetOffset >= len(out) {
+					return nil, errors.New("patch copies from outside the ROM")
+				}
+				//byte by byte, the copy can overlap what it writes
+				for i := 0; i < length; i++ {
+					out = append(out, out[targetOffset])
+					targetOffset++
+				}
+			}
+		}
+	}
+
+	if len(out) != targetSize {
+		return nil, errPatchTruncated
+	}
+	if err := footer.checkTarget(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -3,14 +3,20 @@ package lib
 import (
 	"fmt"
 	"image"
-	"image/color"
-	"sort"
 )
 
 type PPUMode uint8
 type Palette uint8
 
-const DOTS_PER_LINE = 456
+const (
+	DOTS_PER_LINE    = 456
+	OAM_SEARCH_DOTS  = 80
+	LINES_PER_FRAME  = 154
+	LY_153_WRAP_DOTS = 4 // LY reads 0 after this many dots into line 153
+	LCD_ON_SKIP_DOTS = 4 // the first line after turning the LCD on is this much shorter
+)
+
+const FRAME_CYCLES = DOTS_PER_LINE * LINES_PER_FRAME / 4 // M-cycles per frame at single speed
 
 const (
 	priorityMaskBit = 1 << 7
@@ -29,13 +35,16 @@ const (
 )
 
 type Sprite struct {
-	yPos      uint8
-	xPos      uint8
-	tileIndex uint8
-	palette   bool
-	xFlipped  bool
-	yFlipped  bool
-	priority  bool
+	yPos       uint8
+	xPos       uint8
+	tileIndex  uint8
+	palette    bool
+	xFlipped   bool
+	yFlipped   bool
+	priority   bool
+	oamIndex   uint8
+	cgbPalette uint8
+	bank       uint8
 }
 
 const (
@@ -45,39 +54,70 @@ const (
 )
 
 type PixelData struct {
-	color   uint8
-	palette Palette
+	color      uint8
+	palette    Palette
+	priority   bool  // background colors 1-3 are drawn over the sprite, set by the sprite or the tile attribute on CGB
+	cgbPalette uint8 // BGP0-7 or OBP0-7
+	oamIndex   uint8
 }
 
 type PPU struct {
 	dots               uint16
+	line               uint8  // internal scanline, LY can differ from it on line 153
 	pixels             uint16 // x pos in screen
-	Image              *image.RGBA
+	statLine           bool   // shared STAT interrupt signal, interrupts fire on its rising edge
+	lcdStarting        bool   // first line after LCD on, there is no OAM search
 	MMU                *MMU
 	spritesInLine      []Sprite
 	spritesInLineCount int
 
+	//output, the PPU draws into the back buffer and swaps at VBlank
+	frames     [2]FrameBuffer
+	back       int
+	FrameCount uint64
+	OnFrame    func(f *FrameBuffer) // called with each completed frame
+
 	//memory
-	oam  [0xA0]uint8 // 160 = 40 * 4
-	vram [0x2000]uint8
+	oam      [0xA0]uint8   // 160 = 40 * 4
+	vram     [0x4000]uint8 // bank 1 only exists on CGB
+	vramBank uint8
+	//cgb
+	cgb                         bool
+	compat                      bool // DMG cart on CGB, see dmgCompatibility
+	bgPaletteRam, objPaletteRam ColorPaletteRam
 	//lcd
 	lcdControl, stat              uint8
 	scy, scx                      uint8
 	ly                            uint8 //scan line
+	doctorLy                      bool  // LY reads 0x90, see WithDoctorLog
 	lyc                           uint8
 	wy, wx                        uint8
 	backgroundPalette, obp0, obp1 uint8
 
-	buffer [8]PixelData
+	//pixel pipeline
+	fetcher          Fetcher
+	bgFifo, objFifo  PixelFifo
+	discard          uint8 // pixels dropped at the start of the line for the fine scroll
+	spriteFetching   bool
+	spriteFetchDots  int
+	spriteFetchIndex int
+	spritesFetched   [10]bool
+	inWindow         bool
+	windowYTriggered bool  // WY matched LY at some point of this frame
+	windowLine       uint8 // internal window line, only advances on lines where it was drawn
 }
 
-func LoadPpu() (*PPU, error) {
+func LoadPpu(cgb bool) (*PPU, error) {
 	p := &PPU{
-		Image:             image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{160 + 128 + 22, 192}}),
 		lcdControl:        0x91,
 		backgroundPalette: 0xFC,
 		obp0:              0xFF,
 		obp1:              0xFF,
+		cgb:               cgb,
+	}
+	for i := range p.frames {
+		p.frames[i].Cgb = cgb
+		p.frames[i].clear()
 	}
 	p.SetMode(OamSearch)
 
@@ -89,18 +129,18 @@ func (p *PPU) LcdRead(a uint16) uint8 {
 	case a == 0xFF40:
 		return p.lcdControl
 	case a == 0xFF41:
-		return p.stat
+		return p.stat | 0x80 //bit 7 is unused
 	case a == 0xFF42:
 		return p.scy
 	case a == 0xFF43:
 		return p.scx
 	case a == 0xFF44:
-		// return 0x90 if cpu_instrs testing
+		if p.doctorLy {
+			return 0x90
+		}
 		return p.ly
 	case a == 0xFF45:
 		return p.lyc
-	case a == 0xFF46:
-		panic(0) //dma has no read
 	case a == 0xFF47:
 		return p.backgroundPalette
 	case a == 0xFF48:
@@ -119,19 +159,26 @@ func (p *PPU) LcdRead(a uint16) uint8 {
 func (p *PPU) LcdWrite(a uint16, v uint8) {
 	switch {
 	case a == 0xFF40:
+		wasEnabled := p.GetLcdPpuEnable()
 		p.lcdControl = v
+		if wasEnabled && !p.GetLcdPpuEnable() {
+			p.turnOff()
+		} else if !wasEnabled && p.GetLcdPpuEnable() {
+			p.turnOn()
+		}
 	case a == 0xFF41:
-		p.stat = v
+		//mode and coincidence bits are read only
+		p.stat = (p.stat & 0b111) | (v & 0b01111000)
+		p.updateStat()
 	case a == 0xFF42:
 		p.scy = v
 	case a == 0xFF43:
 		p.scx = v
 	case a == 0xFF44:
-		p.ly = v
+		return //LY is read only
 	case a == 0xFF45:
 		p.lyc = v
-	case a == 0xFF46:
-		panic(0) //dma write is processed elsewhere
+		p.updateStat()
 	case a == 0xFF47:
 		p.backgroundPalette = v
 	case a == 0xFF48:
@@ -149,13 +196,34 @@ func (p *PPU) LcdWrite(a uint16, v uint8) {
 
 func (p *PPU) GetLcdPpuEnable() bool { return BitIsSet(p.lcdControl, 7) }
 
-// If
+// With the LCD off the PPU stops in mode 0 at line 0 and the screen goes blank
+func (p *PPU) turnOff() {
+	p.dots = 0
+	p.line = 0
+	p.ly = 0
+	p.pixels = 0
+	p.statLine = false
+	p.lcdStarting = false
+	p.windowYTriggered = false
+	p.windowLine = 0
+	p.SetMode(HBlank)
+
+	p.frames[p.back].clear()
+	p.swapFrames()
+}
+
+// Line 0 restarts in mode 0 instead of OAM search and is a few dots shorter
+func (p *PPU) turnOn() {
+	p.dots = LCD_ON_SKIP_DOTS
+	p.lcdStarting = true
+	p.updateStat()
+}
+
 func (p *PPU) GetWindowMapArea() uint16 {
-	//if BitIsSet(p.lcdControl, 6) {
-	//	return 0x1C00
-	//} else {
+	if BitIsSet(p.lcdControl, 6) {
+		return 0x1C00
+	}
 	return 0x1800
-	//}
 }
 func (p *PPU) GetWindowEnable() bool { return BitIsSet(p.lcdControl, 5) }
 func (p *PPU) GetBGWindowTileArea() bool {
@@ -193,8 +261,8 @@ func (p *PPU) SetMode(m PPUMode) {
 	p.stat |= uint8(m)
 }
 
-func (p *PPU) GetColor(colorPixel uint8, palettePixel Palette) color.RGBA {
-	colors := []color.RGBA{{0xFF, 0xFF, 0xFF, 1}, {0xC0, 0xC0, 0xC0, 1}, {0x55, 0x55, 0x55, 1}, {0, 0, 0, 1}}
+// Shade a color index gets through its palette register
+func (p *PPU) GetShade(colorPixel uint8, palettePixel Palette) uint8 {
 	var paletteData uint8
 
 	switch palettePixel {
@@ -206,8 +274,22 @@ func (p *PPU) GetColor(colorPixel uint8, palettePixel Palette) color.RGBA {
 		paletteData = p.obp1
 	}
 
-	id := (paletteData & (0b11 << (2 * colorPixel))) >> (2 * colorPixel)
-	return colors[id]
+	return (paletteData & (0b11 << (2 * colorPixel))) >> (2 * colorPixel)
+}
+
+// Last completed frame. It stays untouched until the next VBlank, callers that need it
+// longer have to copy it
+func (p *PPU) Frame() *FrameBuffer { return &p.frames[1-p.back] }
+
+func (p *PPU) swapFrames() {
+	p.back = 1 - p.back
+	p.FrameCount++
+	if p.MMU.sgb != nil {
+		p.MMU.sgb.FrameDone(p.Frame())
+	}
+	if p.OnFrame != nil {
+		p.OnFrame(p.Frame())
+	}
 }
 
 func (p *PPU) GetPaletteSprite(dmgP bool) Palette {
@@ -217,236 +299,236 @@ func (p *PPU) GetPaletteSprite(dmgP bool) Palette {
 	return Obp0
 }
 
+// OAM search keeps the first 10 sprites in OAM order that cover the line, sprites outside
+// of the screen horizontally still take a slot
 func (p *PPU) GetSpritesInLine(lineY uint8) []Sprite {
 	spritesInLine := []Sprite{}
-	spriteAdditionalHeight := p.GetObjectAdditionalHeight()
+	height := 8 + int(p.GetObjectAdditionalHeight())
 
-	for i := 0; i < 40; i++ {
+	for i := 0; i < 40 && len(spritesInLine) < 10; i++ {
 		spriteY, spriteX, spriteIndex, spriteFlags := p.oam[i*4], p.oam[i*4+1], p.oam[i*4+2], p.oam[i*4+3]
 		if p.IsObjectSizeModified() {
 			spriteIndex = spriteIndex & 0xFE //ignores bit 0
 		}
-		//sprite is touching y
-		lowerBound := p.ly + 8
-		upperBound := p.ly + 16
 
-		if lowerBound < spriteY+spriteAdditionalHeight && upperBound >= spriteY {
+		//sprite is touching y
+		top := int(spriteY) - 16
+		if int(lineY) >= top && int(lineY) < top+height {
 			palette := (spriteFlags & dmgPaletteBit) != 0
 			priority := (spriteFlags & priorityMaskBit) != 0
 			yFlipped := (spriteFlags & yFlipBit) != 0
 			xFlipped := (spriteFlags & xFlipBit) != 0
 
-			spritesInLine = append(spritesInLine, Sprite{spriteY, spriteX, spriteIndex, palette, xFlipped, yFlipped, priority})
-		}
-	}
-
-	sort.SliceStable(spritesInLine, func(i, j int) bool {
-		return spritesInLine[i].xPos < spritesInLine[j].xPos
-	})
+			cgbPalette := spriteFlags & cbgPaletteBit
+			bank := (spriteFlags & bankBit) >> 3
 
-	if len(spritesInLine) > 10 {
-		spritesInLine = spritesInLine[:10]
+			spritesInLine = append(spritesInLine, Sprite{spriteY, spriteX, spriteIndex, palette, xFlipped, yFlipped, priority, uint8(i), cgbPalette, bank})
+		}
 	}
 
 	return spritesInLine
 }
 
 func (p *PPU) UpdateLy() {
-	p.ly++
-
-	if p.ly == p.lyc {
-		p.SetLycLcEqual(true)
-		if p.LycSourceSelected() {
-			p.MMU.RequestInterrupt(LCDSATUS)
-		}
-	} else {
-		p.SetLycLcEqual(false)
+	p.dots = 0
+	p.line++
+	if p.line == LINES_PER_FRAME {
+		p.line = 0
 	}
+	p.ly = p.line
 }
 
-func (p *PPU) getSpritePixelData(x uint16, bit int, spritesInTile []Sprite) (uint8, Palette, bool) {
-	spriteAdditionalHeight := uint16(p.GetObjectAdditionalHeight())
-	pixelColor := uint8(0x00)
-	var pixelPalette Palette
-	priority := false
-
-	for i := 0; i < len(spritesInTile); i++ {
-		sprite := spritesInTile[i]
-		// checks if sprite is in this pixel
-		spriteX := int(sprite.xPos) - 8
-		offset := int(x) + bit
-		if offset < 0 || offset < spriteX || offset > spriteX+7 {
-			continue
-		}
-
-		pixelLine := uint16(p.ly + 16 - sprite.yPos)
-		if sprite.yFlipped {
-			pixelLine = (7 + spriteAdditionalHeight) - pixelLine
-		}
-
-		finalTile := uint16(sprite.tileIndex)
-		spritePixelsLo := p.vram[(finalTile*16)+pixelLine*2]
-		spritePixelsHi := p.vram[(finalTile*16)+pixelLine*2+1]
-
-		if sprite.xFlipped {
-			bit = 7 - (bit % 8)
-		}
+// All STAT sources are ORed into one line, an interrupt is only requested when it goes
+// from low to high. A source becoming true while another one holds the line is "blocked"
+func (p *PPU) updateStat() {
+	if !p.GetLcdPpuEnable() {
+		return
+	}
 
-		lo := GetBit(spritePixelsLo, uint8(bit))
-		hi := GetBit(spritePixelsHi, uint8(bit))
+	coincidence := p.ly == p.lyc
+	p.SetLycLcEqual(coincidence)
 
-		spritePixelColor := (hi << 1) | lo
-		if spritePixelColor != 0x00 {
-			pixelColor = spritePixelColor
-			pixelPalette = p.GetPaletteSprite(sprite.palette)
-			priority = sprite.priority
-			break
-		}
+	mode := p.GetMode()
+	line := (coincidence && p.LycSourceSelected()) ||
+		(mode == HBlank && p.HBlankSourceSelected()) ||
+		(mode == VBlank && p.VBlankSourceSelected()) ||
+		(mode == OamSearch && p.OamSearchSourceSelected())
 
+	if line && !p.statLine {
+		p.MMU.RequestInterrupt(LCDSATUS)
 	}
-	return pixelColor, pixelPalette, priority
+	p.statLine = line
 }
 
-func (p *PPU) fillBuffer() {
-	//Clear buffer
-	p.buffer = [8]PixelData{}
-
-	x := (p.pixels + uint16(p.scx)) & 0xFF
-	y := (p.ly + p.scy) & 0xFF
-
-	// Background Data
-	mapX := x / 8
-	mapY := y / 8
-
-	tileIndex := uint16(p.vram[p.GetBGTileMapArea()+uint16(mapX)+(uint16(mapY)*32)])
+func (p *PPU) startPixelTransfer() {
+	p.pixels = 0
+	p.SetMode(PixelTransfer)
+	p.spritesInLine = p.GetSpritesInLine(p.ly)
+	p.startLineFifo()
+}
 
-	tileAddress := uint16(0)
-	if p.GetBGWindowTileArea() {
-		tileAddress = tileIndex * 16
-	} else {
-		signedIndex := int8(tileIndex)
-		tileAddress = uint16(int16(signedIndex)*16) + 0x1000
+// Advances the PPU by the given dots
+func (p *PPU) Update(dots int) {
+	if !p.GetLcdPpuEnable() {
+		return
 	}
 
-	var tileData [2]uint8
-	tileData[0] = p.vram[tileAddress+((uint16(y)%8)*2)]
-	tileData[1] = p.vram[tileAddress+((uint16(y)%8)*2)+1]
-
-	// Sprite Data
-	spritesInTile := []Sprite{}
-	for i := 0; i < len(p.spritesInLine) && len(spritesInTile) < 3; i++ {
-		spriteX := uint16(p.spritesInLine[i].xPos) - 8
-		//check if sprite is inside this tile
-		if (spriteX >= p.pixels && spriteX < p.pixels+8) || (spriteX+8 >= p.pixels && spriteX+8 < p.pixels+8) {
-			spritesInTile = append(spritesInTile, p.spritesInLine[i])
-		}
+	for i := 0; i < dots; i++ {
+		p.tick()
 	}
-
-	//render
-	for bit := 7; bit >= 0; bit-- {
-		pixel := PixelData{color: uint8(0x00), palette: Bgp}
-
-		if p.GetBGWindowEnable() {
-			bgx := bit
-			lo := (tileData[0] & (1 << bgx)) >> (bgx)
-			hi := (tileData[1] & (1 << bgx)) >> (bgx)
-			pixel.color = (hi << 1) | lo
-		}
-
-		if p.GetObjEnable() {
-			color, palette, priority := p.getSpritePixelData(x, bit, spritesInTile)
-			if color != 0x00 && (!priority || pixel.color == 0x00) {
-				pixel.color = color
-				pixel.palette = palette
-			}
-		}
-
-		p.buffer[7-bit] = pixel
-	}
-}
-
-func (p *PPU) getPixelInfo() PixelData {
-	horizontalPosition := p.pixels % 8
-	return p.buffer[horizontalPosition]
 }
 
-func (p *PPU) Update(cycles int) {
+func (p *PPU) tick() {
 	switch p.GetMode() {
 	case HBlank: //51 clocks
 		p.dots++
-		if p.dots == DOTS_PER_LINE {
+		if p.lcdStarting && p.dots == OAM_SEARCH_DOTS {
+			p.lcdStarting = false
+			p.startPixelTransfer()
+		} else if p.dots == DOTS_PER_LINE {
 			p.UpdateLy()
-			p.dots = 0
-			if p.ly < 144 { //rendered line
+			if p.line < 144 { //rendered line
 				p.SetMode(OamSearch)
-				if p.OamSearchSourceSelected() {
-					p.MMU.RequestInterrupt(LCDSATUS)
-				}
 			} else { //not rendered line
 				p.SetMode(VBlank)
 				p.MMU.RequestInterrupt(VBLANK)
-				if p.VBlankSourceSelected() {
-					p.MMU.RequestInterrupt(LCDSATUS)
-				}
+				p.swapFrames()
+				p.windowYTriggered = false
+				p.windowLine = 0
 			}
 		}
 	case VBlank: //10 lines
 		p.dots++
+		if p.line == LINES_PER_FRAME-1 && p.dots == LY_153_WRAP_DOTS {
+			p.ly = 0
+		}
 		if p.dots == DOTS_PER_LINE {
 			p.UpdateLy()
-			if p.ly > 153 { //ppu has visited last line (153)
-				p.ly = 0
+			if p.line == 0 { //ppu has visited last line (153)
 				p.SetMode(OamSearch)
 			}
-			p.dots = 0
 		}
 	case OamSearch: //20 clocks
 		p.dots++
-		if p.dots == 80 {
-			p.pixels = 0
-			p.SetMode(PixelTransfer)
-			p.spritesInLine = p.GetSpritesInLine(p.ly)
-			//fmt.Println(p.ly, p.spritesInLine)
-		}
-	case PixelTransfer: // 43 clocks
-		if p.pixels%8 == 0 {
-			p.fillBuffer()
+		if p.dots == OAM_SEARCH_DOTS {
+			p.startPixelTransfer()
 		}
-
-		currentPixel := p.getPixelInfo()
-
-		p.Image.SetRGBA(int(p.pixels), int(p.ly), p.GetColor(currentPixel.color, currentPixel.palette))
-		p.pixels++
+	case PixelTransfer: // 43+ clocks, the fifo decides when the line is done
 		p.dots++
-
-		if p.pixels == 160 {
+		if p.transferTick() {
+			if p.inWindow {
+				p.windowLine++
+			}
 			p.pixels = 0
 			p.SetMode(HBlank)
-
-			if p.HBlankSourceSelected() {
-				p.MMU.RequestInterrupt(LCDSATUS)
-			}
+			p.MMU.HBlankDma()
 		}
 
 	default:
 		panic(fmt.Sprintf("unexpected ppu mode %d", p.GetMode()))
 	}
+
+	p.updateStat()
+}
+
+func (p *PPU) vramBlocked() bool {
+	return p.GetLcdPpuEnable() && p.GetMode() == PixelTransfer
+}
+
+// OAM is also in use while the PPU searches for sprites
+func (p *PPU) oamBlocked() bool {
+	if !p.GetLcdPpuEnable() {
+		return false
+	}
+	mode := p.GetMode()
+	return mode == OamSearch || mode == PixelTransfer
+}
+
+func (p *PPU) VramRead(a uint16) uint8 {
+	if p.vramBlocked() {
+		return 0xFF
+	}
+	return p.vram[p.vramOffset(a)]
 }
 
-func (p *PPU) VramRead(a uint16) uint8     { return p.vram[a-0x8000] }
-func (p *PPU) VramWrite(a uint16, v uint8) { p.vram[a-0x8000] = v }
+func (p *PPU) VramWrite(a uint16, v uint8) {
+	if p.vramBlocked() {
+		return
+	}
+	p.vram[p.vramOffset(a)] = v
+}
+
+// OAM DMA reads VRAM whatever the PPU is doing
+func (p *PPU) vramDmaRead(a uint16) uint8 { return p.vram[p.vramOffset(a)] }
+
+func (p *PPU) vramOffset(a uint16) int { return int(p.vramBank)*0x2000 + int(a-0x8000) }
 
 func (p *PPU) oamRead(a uint16) uint8 {
+	if p.oamBlocked() {
+		return 0xFF
+	}
 	return p.oam[a-0xFE00]
 }
 
 func (p *PPU) oamwrite(a uint16, v uint8) {
+	if p.oamBlocked() {
+		return
+	}
 	p.oam[a-0xFE00] = v
 }
 
-func (p *PPU) DebugDisplayTile(tile int, x int, y int) {
-	colors := []color.RGBA{{0xFF, 0xFF, 0xFF, 1}, {0xC0, 0xC0, 0xC0, 1}, {40, 40, 40, 1}, {0, 0, 0, 1}, {255, 0, 0, 1}}
+// DMA writes land in OAM whatever the PPU is doing
+func (p *PPU) oamDmaWrite(a uint16, v uint8) {
+	p.oam[a-0xFE00] = v
+}
+
+// How the CPU touched OAM when it triggered the OAM bug
+type OamBugKind int
+
+const (
+	OamBugWrite        OamBugKind = iota // 16 bit increments and decrements, writes
+	OamBugRead                           // reads
+	OamBugReadIncrease                   // increments and decrements in the cycle of a read, the read adds its own
+)
+
+// OAM bug corruption: the row the OAM search is on gets mixed with the previous one.
+// The first row is never hit
+// https://gbdev.io/pandocs/OAM_Corruption_Bug.html
+func (p *PPU) corruptOam(kind OamBugKind) {
+	if !p.GetLcdPpuEnable() || p.GetMode() != OamSearch {
+		return
+	}
+	row := int(p.dots/4) * 8
+	if row == 0 || row >= len(p.oam) {
+		return
+	}
+
+	word := func(i int) uint16 { return uint16(p.oam[i]) | uint16(p.oam[i+1])<<8 }
+	setWord := func(i int, v uint16) {
+		p.oam[i] = uint8(v)
+		p.oam[i+1] = uint8(v >> 8)
+	}
+	if kind == OamBugReadIncrease {
+		//the previous row is corrupted and copied over the current one and the one before it
+		if row >= 4*8 && row < len(p.oam)-8 {
+			a, b, c, d := word(row-16), word(row-8), word(row), word(row-12)
+			setWord(row-8, (b&(a|c|d))|(a&c&d))
+			copy(p.oam[row:row+8], p.oam[row-8:row])
+			copy(p.oam[row-16:row-8], p.oam[row-8:row])
+		}
+		return
+	}
+
+	a, b, c := word(row), word(row-8), word(row-4)
+	if kind == OamBugWrite {
+		setWord(row, ((a^c)&(b^c))^c)
+	} else {
+		setWord(row, b|(a&c))
+	}
+	copy(p.oam[row+2:row+8], p.oam[row-6:row])
+}
 
+func (p *PPU) DebugDisplayTile(img *image.RGBA, colors Shades, tile int, x int, y int) {
 	for yy := 0; yy < 16; yy += 2 {
 		byte1 := p.vram[(tile*16)+yy]
 		byte2 := p.vram[(tile*16)+yy+1]
@@ -458,7 +540,7 @@ func (p *PPU) DebugDisplayTile(tile int, x int, y int) {
 			color := colors[(bit2<<1)|bit1]
 			finalX := int(7 - xx + (x * 8))
 			finalY := int((yy / 2)) + (y * 8)
-			p.Image.SetRGBA(finalX, finalY, color)
+			img.SetRGBA(finalX, finalY, color)
 		}
 	}
 
@@ -0,0 +1,125 @@
+package lib
+
+// CGB only PPU registers: VRAM bank select and the background/object color palette RAM.
+// Every palette holds 4 little endian RGB555 colors, 8 palettes for each layer
+
+const (
+	bgAttrPriorityBit = 1 << 7
+	bgAttrYFlipBit    = 1 << 6
+	bgAttrXFlipBit    = 1 << 5
+	bgAttrBankBit     = 1 << 3
+)
+
+type ColorPaletteRam struct {
+	data          [64]uint8
+	index         uint8 // BCPS/OCPS bits 0-5
+	autoIncrement bool  // BCPS/OCPS bit 7
+}
+
+func (c *ColorPaletteRam) ReadSpec() uint8 {
+	return BoolToUint(c.autoIncrement)<<7 | 0x40 | c.index
+}
+
+func (c *ColorPaletteRam) WriteSpec(v uint8) {
+	c.autoIncrement = v&0x80 != 0
+	c.index = v & 0x3F
+}
+
+func (c *ColorPaletteRam) ReadData() uint8 { return c.data[c.index] }
+
+// Writes move the index when auto increment is on, reads never do. Writes blocked by
+// the PPU are lost but still move it
+func (c *ColorPaletteRam) WriteData(v uint8, blocked bool) {
+	if !blocked {
+		c.data[c.index] = v
+	}
+	if c.autoIncrement {
+		c.index = (c.index + 1) & 0x3F
+	}
+}
+
+func (c *ColorPaletteRam) Color(palette uint8, color uint8) uint16 {
+	i := (palette&0b111)*8 + color*2
+	return uint16(c.data[i+1])<<8 | uint16(c.data[i])
+}
+
+func (p *PPU) CgbRead(a uint16) uint8 {
+	if !p.cgbMode() {
+		return 0xFF
+	}
+
+	switch a {
+	case 0xFF4F:
+		return p.vramBank | 0xFE
+	case 0xFF68:
+		return p.bgPaletteRam.ReadSpec()
+	case 0xFF69:
+		if p.paletteRamBlocked() {
+			return 0xFF
+		}
+		return p.bgPaletteRam.ReadData()
+	case 0xFF6A:
+		return p.objPaletteRam.ReadSpec()
+	case 0xFF6B:
+		if p.paletteRamBlocked() {
+			return 0xFF
+		}
+		return p.objPaletteRam.ReadData()
+	default:
+		return 0xFF
+	}
+}
+
+func (p *PPU) CgbWrite(a uint16, v uint8) {
+	if !p.cgbMode() {
+		return
+	}
+
+	switch a {
+	case 0xFF4F:
+		p.vramBank = v & 1
+	case 0xFF68:
+		p.bgPaletteRam.WriteSpec(v)
+	case 0xFF69:
+		p.bgPaletteRam.WriteData(v, p.paletteRamBlocked())
+	case 0xFF6A:
+		p.objPaletteRam.WriteSpec(v)
+	case 0xFF6B:
+		p.objPaletteRam.WriteData(v, p.paletteRamBlocked())
+	}
+}
+
+// Tile attributes, VRAM bank 1 and CGB object priority are in use
+func (p *PPU) cgbMode() bool { return p.cgb && !p.compat }
+
+// Palette RAM is read by the PPU while drawing, same as VRAM
+func (p *PPU) paletteRamBlocked() bool { return p.vramBlocked() }
+
+// In compatibility mode BGP, OBP0 and OBP1 pick one of the colors of background palette 0
+// and object palettes 0 and 1
+func (p *PPU) cgbColor(pixel PixelData) uint16 {
+	if p.compat {
+		shade := p.GetShade(pixel.color, pixel.palette)
+		if pixel.palette == Bgp {
+			return p.bgPaletteRam.Color(0, shade)
+		}
+		return p.objPaletteRam.Color(BoolToUint(pixel.palette == Obp1), shade)
+	}
+	if pixel.palette == Bgp {
+		return p.bgPaletteRam.Color(pixel.cgbPalette, pixel.color)
+	}
+	return p.objPaletteRam.Color(pixel.cgbPalette, pixel.color)
+}
+
+// In CGB mode LCDC bit 0 no longer hides the background, it removes its priority over
+// sprites instead. Otherwise either the tile attribute or the sprite can put colors 1-3
+// of the background on top
+func (p *PPU) cgbMix(bg, obj PixelData, hasObj bool) PixelData {
+	if !hasObj || obj.color == 0 || !p.GetObjEnable() {
+		return bg
+	}
+	if p.GetBGWindowEnable() && bg.color != 0 && (bg.priority || obj.priority) {
+		return bg
+	}
+	return obj
+}
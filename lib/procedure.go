@@ -32,11 +32,15 @@ func (c *CPU) Ld8() int {
 	var input uint8
 
 	if IsPointer(c.SourceTarget) {
+		if c.SourceTarget == HLP_M || c.SourceTarget == HLM_M {
+			c.Bus.OamBug(c.Source, OamBugReadIncrease)
+		}
 		input = c.MMURead(c.Source)
 	} else {
 		input = uint8(c.Source)
 	}
 
+	//a write in the cycle of an increment only corrupts once, through the write
 	c.SetTarget(c.DestinationTarget, uint16(input))
 
 	if IsPointer(c.SourceTarget) || IsPointer(c.DestinationTarget) {
@@ -59,7 +63,7 @@ func (c *CPU) Ld16() int {
 	if c.SourceTarget == nn {
 		cycles += 2
 	}
-	if c.DestinationTarget == SP {
+	if c.DestinationTarget == SP && c.SourceTarget == HL { //the copy takes its own M-cycle
 		cycles += 1
 	}
 	if c.DestinationTarget == nn_M16 {
@@ -102,6 +106,8 @@ func (c *CPU) Ldh() int {
 }
 
 func (c *CPU) Push() int {
+	//the decrement before the writes goes through the OAM bug, the writes do on their own
+	c.Bus.OamBug(c.Register.sp, OamBugWrite)
 	c.Register.sp -= 1
 	c.MMUWrite(c.Register.sp, uint8((c.Source&0xFF00)>>8))
 
@@ -112,7 +118,9 @@ func (c *CPU) Push() int {
 }
 
 func (c *CPU) Pop() int {
+	c.Bus.OamBug(c.Register.sp, OamBugReadIncrease)
 	lo := uint16(c.MMURead(c.Register.sp))
+	c.Bus.OamBug(c.Register.sp+1, OamBugReadIncrease)
 	hi := uint16(c.MMURead(c.Register.sp + 1))
 	c.Register.sp += 2
 	result := (hi << 8) | lo
@@ -214,7 +222,22 @@ func (c *CPU) Ei() int {
 
 func (c *CPU) Halt() int {
 	c.Halted = true
-	return 0
+	return 1
+}
+
+// STOP is followed by a padding byte. On CGB it performs the speed switch armed through
+// KEY1, which resets DIV and pauses the CPU. Otherwise the CPU stops until a button on a
+// selected line is pressed, whatever IE says, see Emulator.SetButtons
+func (c *CPU) Stop() int {
+	c.Register.pc += 1
+
+	if c.Bus.SwitchSpeed() {
+		c.Clock.Divider = 0
+		return SPEED_SWITCH_CYCLES
+	}
+
+	c.Stopped = true
+	return 1
 }
 
 // Decimal Adjust Accumulator
@@ -349,6 +372,8 @@ func (c *CPU) Inc() int {
 		c.SetFlag(flagZ, 0xFF&result == 0)
 		c.SetFlag(flagN, false)
 		c.SetFlag(flagH, (input&0x0F)+0x01 == 0x10)
+	} else {
+		c.Bus.OamBug(input, OamBugWrite)
 	}
 
 	if Isr8(c.SourceTarget) {
@@ -371,6 +396,8 @@ func (c *CPU) Dec() int {
 		c.SetFlag(flagZ, 0xFF&result == 0)
 		c.SetFlag(flagN, true)
 		c.SetFlag(flagH, (input&0x0F) == 0x00) //4 trailing zeroes
+	} else {
+		c.Bus.OamBug(input, OamBugWrite)
 	}
 
 	if Isr8(c.SourceTarget) {
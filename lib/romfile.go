@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reads a ROM from disk, see UnpackRom
+func ReadRom(p string) ([]uint8, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	rom, err := UnpackRom(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return rom, nil
+}
+
+// Zip and gzip archives are told apart by their magic and uncompressed, anything else
+// is taken as the ROM itself
+func UnpackRom(data []uint8) ([]uint8, error) {
+	switch {
+	case bytes.HasPrefix(data, []uint8("PK\x03\x04")):
+		return unzipRom(data)
+	case bytes.HasPrefix(data, []uint8{0x1F, 0x8B}):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return data, nil
+	}
+}
+
+// First .gb/.gbc entry of the archive, in archive order
+func unzipRom(data []uint8) ([]uint8, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range z.File {
+		ext := strings.ToLower(filepath.Ext(f.Name))
+		if f.FileInfo().IsDir() || (ext != ".gb" && ext != ".gbc") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, errors.New("no .gb or .gbc file in the archive")
+}
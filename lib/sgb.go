@@ -0,0 +1,447 @@
+package lib
+
+import (
+	"image"
+	"image/color"
+)
+
+// Super Game Boy. Games talk to it through 16 byte packets pulsed on P1 bits 4-5 and
+// send bigger data (border tiles, maps, palettes) by displaying it for a frame.
+// The SNES side colors the game screen by 8x8 cell and draws a 256x224 border around it
+// https://gbdev.io/pandocs/SGB_Functions.html
+
+const (
+	SGB_WIDTH         = 256
+	SGB_HEIGHT        = 224
+	SGB_SCREEN_X      = 48 // game screen position inside the border
+	SGB_SCREEN_Y      = 40
+	SGB_PACKET_SIZE   = 16
+	SGB_TRANSFER_SIZE = 0x1000
+	SGB_CELLS_X       = SCREEN_WIDTH / 8
+	SGB_CELLS_Y       = SCREEN_HEIGHT / 8
+)
+
+type SgbCommand uint8
+
+const (
+	SgbPal01   SgbCommand = 0x00
+	SgbPal23   SgbCommand = 0x01
+	SgbPal03   SgbCommand = 0x02
+	SgbPal12   SgbCommand = 0x03
+	SgbAttrBlk SgbCommand = 0x04
+	SgbAttrLin SgbCommand = 0x05
+	SgbAttrDiv SgbCommand = 0x06
+	SgbAttrChr SgbCommand = 0x07
+	SgbPalSet  SgbCommand = 0x0A
+	SgbPalTrn  SgbCommand = 0x0B
+	SgbMltReq  SgbCommand = 0x11
+	SgbChrTrn  SgbCommand = 0x13
+	SgbPctTrn  SgbCommand = 0x14
+	SgbMaskEn  SgbCommand = 0x17
+)
+
+type SgbMask uint8
+
+const (
+	MaskNone SgbMask = iota
+	MaskFreeze
+	MaskBlack
+	MaskColor0
+)
+
+type SGB struct {
+	//packet reception
+	receiving  bool
+	waitHigh   bool // both lines have to go high between bits
+	bit        int
+	packet     [SGB_PACKET_SIZE]uint8
+	data       []uint8 // packets of the current command
+	lastSelect uint8
+
+	//multiplayer
+	players      uint8
+	controllerId uint8
+
+	palettes       [4][4]uint16 // game screen, color 0 is shared
+	systemPalettes [512][4]uint16
+	attributes     [SGB_CELLS_Y][SGB_CELLS_X]uint8
+	mask           SgbMask
+	frozen         FrameBuffer
+
+	//border
+	borderTiles    [256][32]uint8 // SNES 4bpp tiles
+	borderMap      [32 * 28]uint16
+	borderPalettes [4][16]uint16 // SNES palettes 4-7
+
+	pendingTransfer SgbCommand
+	transferTrn     uint8 // CHR_TRN tile bank
+	hasTransfer     bool
+}
+
+func LoadSgb() *SGB {
+	s := &SGB{players: 1, lastSelect: 0x30}
+	//1-A, the palette the SGB boots with
+	defaultPalette := [4]uint16{rgb555(0xF8E8C8), rgb555(0xD89048), rgb555(0xA82820), rgb555(0x301850)}
+	for i := range s.palettes {
+		s.palettes[i] = defaultPalette
+	}
+	return s
+}
+
+func rgb555(v uint32) uint16 {
+	r, g, b := uint16(v>>19)&0x1F, uint16(v>>11)&0x1F, uint16(v>>3)&0x1F
+	return b<<10 | g<<5 | r
+}
+
+// SGB support is only turned on by carts that ask for it
+func (h header) SupportsSgb() bool { return h.SgbFlag == 0x03 && h.OldLicenseeCode == 0x33 }
+
+func (s *SGB) ControllerId() uint8 { return s.controllerId }
+
+// A reset pulses both lines low, then every bit is a pulse on P14 (0) or P15 (1) and
+// 128 bits later a 0 stop bit ends the packet
+func (s *SGB) P1Write(selection uint8) {
+	previous := s.lastSelect
+	s.lastSelect = selection
+
+	//in multiplayer mode releasing P15 moves to the next controller
+	if s.players > 1 && previous&0x20 == 0 && selection == 0x30 {
+		s.controllerId = (s.controllerId + 1) % s.players
+	}
+
+	switch selection {
+	case 0x00:
+		s.receiving = true
+		s.waitHigh = true
+		s.bit = 0
+		s.packet = [SGB_PACKET_SIZE]uint8{}
+		return
+	case 0x30:
+		s.waitHigh = false
+		return
+	}
+
+	if !s.receiving || s.waitHigh {
+		return
+	}
+	s.waitHigh = true
+
+	value := BoolToUint(selection == 0x10)
+	if s.bit == SGB_PACKET_SIZE*8 {
+		s.receiving = false
+		if value == 0 {
+			s.packetReceived()
+		}
+		return
+	}
+
+	s.packet[s.bit/8] |= value << (s.bit % 8)
+	s.bit++
+}
+
+func (s *SGB) packetReceived() {
+	if len(s.data) == 0 && s.packet[0]&0b111 == 0 {
+		return //a command needs at least one packet
+	}
+
+	s.data = append(s.data, s.packet[:]...)
+	length := int(s.data[0] & 0b111)
+	if len(s.data) < length*SGB_PACKET_SIZE {
+		return
+	}
+
+	data := s.data
+	s.data = nil
+	s.execute(SgbCommand(data[0]>>3), data)
+}
+
+func (s *SGB) execute(command SgbCommand, data []uint8) {
+	switch command {
+	case SgbPal01:
+		s.setPalettes(0, 1, data)
+	case SgbPal23:
+		s.setPalettes(2, 3, data)
+	case SgbPal03:
+		s.setPalettes(0, 3, data)
+	case SgbPal12:
+		s.setPalettes(1, 2, data)
+	case SgbAttrBlk:
+		s.attrBlock(data)
+	case SgbAttrLin:
+		s.attrLine(data)
+	case SgbAttrDiv:
+		s.attrDivide(data)
+	case SgbAttrChr:
+		s.attrCharacter(data)
+	case SgbPalSet:
+		s.palSet(data)
+	case SgbMltReq:
+		s.players = [4]uint8{1, 2, 1, 4}[data[1]&0b11]
+		s.controllerId = 0
+	case SgbMaskEn:
+		s.mask = SgbMask(data[1] & 0b11)
+	case SgbPalTrn, SgbChrTrn, SgbPctTrn:
+		//the data is read from the next frame shown
+		s.pendingTransfer = command
+		s.transferTrn = data[1] & 1
+		s.hasTransfer = true
+	}
+}
+
+func word(data []uint8, i int) uint16 { return uint16(data[i+1])<<8 | uint16(data[i]) }
+
+// Color 0 is shared by all the palettes, the packet sets it and 3 colors for each
+func (s *SGB) setPalettes(a, b int, data []uint8) {
+	color0 := word(data, 1)
+	for i := range s.palettes {
+		s.palettes[i][0] = color0
+	}
+	for i := 0; i < 3; i++ {
+		s.palettes[a][i+1] = word(data, 3+i*2)
+		s.palettes[b][i+1] = word(data, 9+i*2)
+	}
+}
+
+func (s *SGB) palSet(data []uint8) {
+	for i := 0; i < 4; i++ {
+		s.palettes[i] = s.systemPalettes[word(data, 1+i*2)&0x1FF]
+	}
+	color0 := s.palettes[0][0]
+	for i := range s.palettes {
+		s.palettes[i][0] = color0
+	}
+	if data[9]&0x40 != 0 {
+		s.mask = MaskNone
+	}
+}
+
+func (s *SGB) setCell(x, y int, palette uint8) {
+	if x >= 0 && x < SGB_CELLS_X && y >= 0 && y < SGB_CELLS_Y {
+		s.attributes[y][x] = palette & 0b11
+	}
+}
+
+// Rectangles with a palette for the inside, the border and the outside. When only one of
+// inside or outside is set the border takes its palette too
+func (s *SGB) attrBlock(data []uint8) {
+	sets := int(data[1] & 0x1F)
+	for set := 0; set < sets && 2+set*6+5 < len(data); set++ {
+		block := data[2+set*6 : 2+set*6+6]
+		control := block[0] & 0b111
+		inside, border, outside := block[1]&0b11, (block[1]>>2)&0b11, (block[1]>>4)&0b11
+		x1, y1, x2, y2 := int(block[2]&0x1F), int(block[3]&0x1F), int(block[4]&0x1F), int(block[5]&0x1F)
+
+		switch control {
+		case 0b001:
+			border = inside
+			control |= 0b010
+		case 0b100:
+			border = outside
+			control |= 0b010
+		}
+
+		for y := 0; y < SGB_CELLS_Y; y++ {
+			for x := 0; x < SGB_CELLS_X; x++ {
+				in := x > x1 && x < x2 && y > y1 && y < y2
+				onBorder := x >= x1 && x <= x2 && y >= y1 && y <= y2 && !in
+				switch {
+				case in && control&0b001 != 0:
+					s.setCell(x, y, inside)
+				case onBorder && control&0b010 != 0:
+					s.setCell(x, y, border)
+				case !in && !onBorder && control&0b100 != 0:
+					s.setCell(x, y, outside)
+				}
+			}
+		}
+	}
+}
+
+func (s *SGB) attrLine(data []uint8) {
+	lines := int(data[1])
+	for i := 0; i < lines && 2+i < len(data); i++ {
+		v := data[2+i]
+		number, palette := int(v&0x1F), (v>>5)&0b11
+		if v&0x80 != 0 { //horizontal line
+			for x := 0; x < SGB_CELLS_X; x++ {
+				s.setCell(x, number, palette)
+			}
+		} else {
+			for y := 0; y < SGB_CELLS_Y; y++ {
+				s.setCell(number, y, palette)
+			}
+		}
+	}
+}
+
+func (s *SGB) attrDivide(data []uint8) {
+	after, before, line := data[1]&0b11, (data[1]>>2)&0b11, (data[1]>>4)&0b11
+	horizontal := data[1]&0x40 != 0
+	division := int(data[2] & 0x1F)
+
+	for y := 0; y < SGB_CELLS_Y; y++ {
+		for x := 0; x < SGB_CELLS_X; x++ {
+			position := x
+			if horizontal {
+				position = y
+			}
+			switch {
+			case position < division:
+				s.setCell(x, y, before)
+			case position == division:
+				s.setCell(x, y, line)
+			default:
+				s.setCell(x, y, after)
+			}
+		}
+	}
+}
+
+// Palettes for single cells, 4 per byte starting from the high bits
+func (s *SGB) attrCharacter(data []uint8) {
+	x, y := int(data[1]&0x1F), int(data[2]&0x1F)
+	count := int(word(data, 3))
+	vertical := data[5] == 1
+
+	for i := 0; i < count && 6+i/4 < len(data); i++ {
+		palette := (data[6+i/4] >> (6 - 2*(i%4))) & 0b11
+		s.setCell(x, y, palette)
+
+		if vertical {
+			y++
+			if y == SGB_CELLS_Y {
+				y = 0
+				x++
+			}
+		} else {
+			x++
+			if x == SGB_CELLS_X {
+				x = 0
+				y++
+			}
+		}
+	}
+}
+
+// Called with every completed frame, freezes the mask and takes VRAM transfers
+func (s *SGB) FrameDone(frame *FrameBuffer) {
+	if s.mask != MaskFreeze {
+		s.frozen = *frame
+	}
+
+	if !s.hasTransfer {
+		return
+	}
+	s.hasTransfer = false
+
+	data := transferData(frame)
+	switch s.pendingTransfer {
+	case SgbChrTrn:
+		for i := 0; i < 128; i++ {
+			copy(s.borderTiles[int(s.transferTrn)*128+i][:], data[i*32:])
+		}
+	case SgbPctTrn:
+		for i := range s.borderMap {
+			s.borderMap[i] = word(data, i*2)
+		}
+		for p := range s.borderPalettes {
+			for c := range s.borderPalettes[p] {
+				s.borderPalettes[p][c] = word(data, 0x800+p*32+c*2)
+			}
+		}
+	case SgbPalTrn:
+		for p := range s.systemPalettes {
+			for c := range s.systemPalettes[p] {
+				s.systemPalettes[p][c] = word(data, p*8+c*2)
+			}
+		}
+	}
+}
+
+// The SGB reads transfers from the screen output, 20 tiles per row with the shades
+// turned back into 2bpp tile data
+func transferData(frame *FrameBuffer) []uint8 {
+	data := make([]uint8, SGB_TRANSFER_SIZE)
+	for tile := 0; tile < SGB_TRANSFER_SIZE/16; tile++ {
+		tileX, tileY := (tile%SGB_CELLS_X)*8, (tile/SGB_CELLS_X)*8
+		for row := 0; row < 8; row++ {
+			var lo, hi uint8
+			for x := 0; x < 8; x++ {
+				shade := frame.Shade(tileX+x, tileY+row)
+				lo |= (shade & 1) << (7 - x)
+				hi |= (shade >> 1) << (7 - x)
+			}
+			data[tile*16+row*2] = lo
+			data[tile*16+row*2+1] = hi
+		}
+	}
+	return data
+}
+
+// Full SGB output, the colored game screen inside the border
+func (s *SGB) Image(frame *FrameBuffer) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, SGB_WIDTH, SGB_HEIGHT))
+	backdrop := RGB555ToRGBA(s.palettes[0][0])
+	for y := 0; y < SGB_HEIGHT; y++ {
+		for x := 0; x < SGB_WIDTH; x++ {
+			img.SetRGBA(x, y, backdrop)
+		}
+	}
+
+	screen := frame
+	if s.mask == MaskFreeze {
+		screen = &s.frozen
+	}
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			var c color.RGBA
+			switch s.mask {
+			case MaskBlack:
+				c = color.RGBA{0, 0, 0, 0xFF}
+			case MaskColor0:
+				c = backdrop
+			default:
+				palette := s.attributes[y/8][x/8]
+				c = RGB555ToRGBA(s.palettes[palette][screen.Shade(x, y)])
+			}
+			img.SetRGBA(SGB_SCREEN_X+x, SGB_SCREEN_Y+y, c)
+		}
+	}
+
+	s.drawBorder(img)
+	return img
+}
+
+// Border map entries: bits 0-7 tile, 10-12 palette (4-7), 14 x flip, 15 y flip.
+// Color 0 is transparent so the game screen shows through
+func (s *SGB) drawBorder(img *image.RGBA) {
+	for i, entry := range s.borderMap {
+		tile := &s.borderTiles[entry&0xFF]
+		palette := (entry >> 10) & 0b111
+		if palette < 4 {
+			continue
+		}
+		shades := &s.borderPalettes[palette-4]
+		xFlipped, yFlipped := entry&0x4000 != 0, entry&0x8000 != 0
+
+		for row := 0; row < 8; row++ {
+			tileRow := row
+			if yFlipped {
+				tileRow = 7 - row
+			}
+			planes := [4]uint8{tile[tileRow*2], tile[tileRow*2+1], tile[16+tileRow*2], tile[16+tileRow*2+1]}
+
+			for col := 0; col < 8; col++ {
+				bit := uint8(7 - col)
+				if xFlipped {
+					bit = uint8(col)
+				}
+				index := GetBit(planes[0], bit) | GetBit(planes[1], bit)<<1 | GetBit(planes[2], bit)<<2 | GetBit(planes[3], bit)<<3
+				if index == 0 {
+					continue
+				}
+				img.SetRGBA((i%32)*8+col, (i/32)*8+row, RGB555ToRGBA(shades[index]))
+			}
+		}
+	}
+}
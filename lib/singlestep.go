@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// One case of the SingleStepTests sm83 suite (https://github.com/SingleStepTests/sm83),
+// a file per opcode with a thousand random starting states each
+type SingleStepTest struct {
+	Name    string            `json:"name"`
+	Initial SingleStepState   `json:"initial"`
+	Final   SingleStepState   `json:"final"`
+	Cycles  []SingleStepCycle `json:"cycles"` // one per M-cycle
+}
+
+// What the bus does in one M-cycle, [address, value, pins] in the files with pins "r-m"
+// for a read, "-wm" for a write and "---" or a null cycle when the CPU is busy inside
+type SingleStepCycle struct {
+	Access *BusAccess
+}
+
+func (c *SingleStepCycle) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return nil
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("cycle %s is not [address, value, pins]", data)
+	}
+	var pins string
+	if err := json.Unmarshal(fields[2], &pins); err != nil {
+		return err
+	}
+	if len(pins) != 3 || (pins[0] != 'r') == (pins[1] != 'w') {
+		return nil
+	}
+	access := &BusAccess{Write: pins[1] == 'w'}
+	if err := json.Unmarshal(fields[0], &access.Address); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[1], &access.Value); err != nil {
+		return err
+	}
+	c.Access = access
+	return nil
+}
+
+func (a BusAccess) String() string {
+	if a.Write {
+		return fmt.Sprintf("write %02X to %04X", a.Value, a.Address)
+	}
+	return fmt.Sprintf("read %02X from %04X", a.Value, a.Address)
+}
+
+type SingleStepState struct {
+	PC  uint16      `json:"pc"`
+	SP  uint16      `json:"sp"`
+	A   uint8       `json:"a"`
+	B   uint8       `json:"b"`
+	C   uint8       `json:"c"`
+	D   uint8       `json:"d"`
+	E   uint8       `json:"e"`
+	F   uint8       `json:"f"`
+	H   uint8       `json:"h"`
+	L   uint8       `json:"l"`
+	IME *uint8      `json:"ime"`
+	EI  *uint8      `json:"ei"` // EI ran, IME is set after the next instruction
+	IE  *uint8      `json:"ie"`
+	Ram [][2]uint16 `json:"ram"`
+}
+
+func (s SingleStepState) registers() registers {
+	return registers{a: s.A, b: s.B, c: s.C, d: s.D, e: s.E, f: s.F, h: s.H, l: s.L, sp: s.SP, pc: s.PC}
+}
+
+func LoadSingleStepTests(p string) ([]SingleStepTest, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var tests []SingleStepTest
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return tests, nil
+}
+
+// Vector file names without extension, "00" to "ff" and "cb 00" to "cb ff", for every
+// opcode the CPU implements
+func SingleStepOpcodes() []string {
+	var names []string
+	for op := range instructions {
+		if op != 0xCB {
+			names = append(names, fmt.Sprintf("%02x", op))
+		}
+	}
+	for op := range cbOpcodes {
+		names = append(names, fmt.Sprintf("cb %02x", op))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Runs the instruction on a TestBus, nil when registers, memory, M-cycles and the bus
+// accesses in them all match. The CPU does not model the busy M-cycles, only their number
+func RunSingleStep(t SingleStepTest) error {
+	bus := &TestBus{}
+	for _, r := range t.Initial.Ram {
+		bus.Memory[r[0]] = uint8(r[1])
+	}
+	if t.Initial.IE != nil {
+		bus.Memory[0xFFFF] = *t.Initial.IE
+	}
+	clock, _ := LoadClock()
+	c, _ := LoadCpu(bus, nil, clock, t.Initial.registers())
+	c.MasterInterruptEnabled = t.Initial.IME != nil && *t.Initial.IME != 0
+
+	cycles, err := c.Step(nil)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	diff := func(name string, got, want uint16) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s %02X, want %02X", name, got, want))
+		}
+	}
+	got, want := c.Register, t.Final.registers()
+	diff("A", uint16(got.a), uint16(want.a))
+	diff("F", uint16(got.f), uint16(want.f))
+	diff("B", uint16(got.b), uint16(want.b))
+	diff("C", uint16(got.c), uint16(want.c))
+	diff("D", uint16(got.d), uint16(want.d))
+	diff("E", uint16(got.e), uint16(want.e))
+	diff("H", uint16(got.h), uint16(want.h))
+	diff("L", uint16(got.l), uint16(want.l))
+	diff("SP", got.sp, want.sp)
+	diff("PC", got.pc, want.pc)
+	for _, r := range t.Final.Ram {
+		diff(fmt.Sprintf("[%04X]", r[0]), uint16(bus.Memory[r[0]]), r[1])
+	}
+
+	//without a separate EI flag a pending EI counts as IME set
+	pending := c.EnableMasterInterruptAfter > 0
+	if t.Final.EI != nil {
+		diff("EI", uint16(BoolToUint(pending)), uint16(*t.Final.EI))
+		pending = false
+	}
+	if t.Final.IME != nil {
+		diff("IME", uint16(BoolToUint(c.MasterInterruptEnabled || pending)), uint16(*t.Final.IME))
+	}
+	if cycles != len(t.Cycles) {
+		diffs = append(diffs, fmt.Sprintf("%d M-cycles, want %d", cycles, len(t.Cycles)))
+	}
+	var accesses []BusAccess
+	for _, c := range t.Cycles {
+		if c.Access != nil {
+			accesses = append(accesses, *c.Access)
+		}
+	}
+	//the first access that differs, the rest usually only follows from it
+	for i := 0; i < max(len(accesses), len(bus.Accesses)); i++ {
+		got, want := "none", "none"
+		if i < len(bus.Accesses) {
+			got = bus.Accesses[i].String()
+		}
+		if i < len(accesses) {
+			want = accesses[i].String()
+		}
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("access %d is %s, want %s", i, got, want))
+			break
+		}
+	}
+
+	if len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"fmt"
+	"gbemulator/lib"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 32 KiB ROM only cart with a valid header, the logo is taken from a test ROM
+func headerRom(t *testing.T, title string) []uint8 {
+	t.Helper()
+	special, err := os.ReadFile("../../roms/01-special.gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := make([]uint8, 0x8000)
+	copy(rom[0x100:0x134], special[0x100:0x134]) //entry point and logo
+	copy(rom[0x134:0x144], title)
+	rom[0x14B] = 0x01 //Nintendo
+	fixChecksums(rom)
+	return rom
+}
+
+func fixChecksums(rom []uint8) {
+	rom[0x14D] = lib.HeaderChecksum(rom)
+	fixGlobalChecksum(rom)
+}
+
+func fixGlobalChecksum(rom []uint8) {
+	sum := lib.GlobalChecksum(rom)
+	rom[0x14E], rom[0x14F] = uint8(sum>>8), uint8(sum)
+}
+
+func writeRom(t *testing.T, name string, rom []uint8) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// A good header with one field changed at a time
+func TestCartInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(rom []uint8) []uint8
+		licensee string
+		problems func(rom []uint8) []string
+	}{
+		{"valid", nil, "Nintendo", nil},
+		{"old licensee", func(rom []uint8) []uint8 {
+			rom[0x14B] = 0xA4
+			fixChecksums(rom)
+			return rom
+		}, "Konami", nil},
+		{"unknown old licensee", func(rom []uint8) []uint8 {
+			rom[0x14B] = 0x02
+			fixChecksums(rom)
+			return rom
+		}, "unknown (0x02)", nil},
+		{"new licensee", func(rom []uint8) []uint8 {
+			rom[0x14B] = 0x33
+			copy(rom[0x144:0x146], "A4")
+			fixChecksums(rom)
+			return rom
+		}, "Konami (Yu-Gi-Oh!)", nil},
+		{"unknown new licensee", func(rom []uint8) []uint8 {
+			rom[0x14B] = 0x33
+			copy(rom[0x144:0x146], "ZZ")
+			fixChecksums(rom)
+			return rom
+		}, `unknown ("ZZ")`, nil},
+		{"bad logo", func(rom []uint8) []uint8 {
+			rom[0x104] ^= 0xFF
+			fixGlobalChecksum(rom)
+			return rom
+		}, "Nintendo", func([]uint8) []string {
+			return []string{"Nintendo logo does not match"}
+		}},
+		{"bad header checksum", func(rom []uint8) []uint8 {
+			rom[0x14D]++
+			fixGlobalChecksum(rom)
+			return rom
+		}, "Nintendo", func(rom []uint8) []string {
+			return []string{fmt.Sprintf("header checksum should be 0x%02X", lib.HeaderChecksum(rom))}
+		}},
+		{"bad global checksum", func(rom []uint8) []uint8 {
+			rom[0x14F]++
+			return rom
+		}, "Nintendo", func(rom []uint8) []string {
+			want := uint16(rom[0x14E])<<8 | uint16(rom[0x14F])
+			return []string{fmt.Sprintf("global checksum is 0x%04X, header says 0x%04X", lib.GlobalChecksum(rom), want)}
+		}},
+		{"rom bigger than the header", func(rom []uint8) []uint8 {
+			rom = append(rom, make([]uint8, 0x8000)...)
+			fixGlobalChecksum(rom)
+			return rom
+		}, "Nintendo", func([]uint8) []string {
+			return []string{"header declares 32768 bytes of ROM, the file has 65536"}
+		}},
+		{"rom smaller than the header", func(rom []uint8) []uint8 {
+			rom[0x148] = 0x02
+			fixChecksums(rom)
+			return rom
+		}, "Nintendo", func([]uint8) []string {
+			return []string{"header declares 131072 bytes of ROM, the file has 32768"}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rom := headerRom(t, "TEST")
+			if test.edit != nil {
+				rom = test.edit(rom)
+			}
+			info, err := lib.LoadCartInfo(writeRom(t, "test.gb", rom))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Title != "TEST" {
+				t.Errorf("title %q, want %q", info.Title, "TEST")
+			}
+			if info.Licensee != test.licensee {
+				t.Errorf("licensee %q, want %q", info.Licensee, test.licensee)
+			}
+			var want []string
+			if test.problems != nil {
+				want = test.problems(rom)
+			}
+			if got := info.Problems(); !reflect.DeepEqual(got, want) {
+				t.Errorf("problems %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCartInfoCgbTitle(t *testing.T) {
+	rom := headerRom(t, "GAMEWITHCODE")
+	copy(rom[0x13F:0x143], "ABCD")
+	rom[0x143] = lib.CGB_COMPATIBLE
+	fixChecksums(rom)
+
+	info, err := lib.LoadCartInfo(writeRom(t, "test.gbc", rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "GAMEWITHCOD" || info.ManufacturerCode != "ABCD" {
+		t.Errorf("title %q and manufacturer %q, want %q and %q", info.Title, info.ManufacturerCode, "GAMEWITHCOD", "ABCD")
+	}
+}
+
+func TestCartInfoString(t *testing.T) {
+	rom := headerRom(t, "TEST")
+	rom[0x104] ^= 0xFF
+	rom[0x149] = 0x03
+	fixGlobalChecksum(rom)
+
+	info, err := lib.LoadCartInfo(writeRom(t, "test.gb", rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := info.String()
+	for _, line := range []string{
+		"Title:        TEST\n",
+		"Type:         0x00 ROM ONLY\n",
+		"ROM:          32 KiB\n",
+		"RAM:          32 KiB\n",
+		"CGB:          0x00 DMG\n",
+		"Destination:  Japan\n",
+		"Licensee:     Nintendo\n",
+		"Logo:         bad\n",
+		"Header sum:   bad\n",
+		"Global sum:   ok\n",
+		"warning: Nintendo logo does not match\n",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("no %q in\n%s", line, s)
+		}
+	}
+	if strings.Contains(s, "Manufacturer:") {
+		t.Errorf("manufacturer line without a code in\n%s", s)
+	}
+}
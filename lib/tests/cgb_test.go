@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"testing"
+)
+
+// CGB MMU and PPU with no cart and the LCD off
+func cgbBus(t *testing.T) (*lib.MMU, *lib.PPU) {
+	t.Helper()
+	ppu, err := lib.LoadPpu(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := lib.LoadBus(nil, nil, nil, ppu, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu.MMU = m
+	m.Write(0xFF40, 0x00)
+	return m, ppu
+}
+
+// Distinct RGB555 color for each palette and color index
+func cgbTestColor(palette, index int) uint16 {
+	return uint16(palette+1)<<10 | uint16(index+1)<<5 | uint16(palette*4+index)
+}
+
+// Fills the 8 palettes behind BCPS/BCPD or OCPS/OCPD with cgbTestColor
+func cgbTestPalettes(m *lib.MMU, spec uint16) {
+	m.Write(spec, 0x80)
+	for p := 0; p < 8; p++ {
+		for i := 0; i < 4; i++ {
+			c := cgbTestColor(p, i)
+			m.Write(spec+1, uint8(c))
+			m.Write(spec+1, uint8(c>>8))
+		}
+	}
+}
+
+func TestVramBank(t *testing.T) {
+	m, _ := cgbBus(t)
+	m.Write(0x8000, 0x11)
+	m.Write(0xFF4F, 0x01)
+	if v := m.Read(0xFF4F); v != 0xFF {
+		t.Errorf("VBK reads 0x%02X in bank 1", v)
+	}
+	if v := m.Read(0x8000); v != 0x00 {
+		t.Errorf("bank 1 reads 0x%02X before any write", v)
+	}
+	m.Write(0x9FFF, 0x22)
+
+	m.Write(0xFF4F, 0xFE) //only bit 0 counts
+	if v := m.Read(0xFF4F); v != 0xFE {
+		t.Errorf("VBK reads 0x%02X in bank 0", v)
+	}
+	if v, w := m.Read(0x8000), m.Read(0x9FFF); v != 0x11 || w != 0x00 {
+		t.Errorf("bank 0 reads 0x%02X and 0x%02X, want 0x11 and 0x00", v, w)
+	}
+	m.Write(0xFF4F, 0x01)
+	if v := m.Read(0x9FFF); v != 0x22 {
+		t.Errorf("bank 1 reads 0x%02X, want 0x22", v)
+	}
+}
+
+func TestColorPaletteRam(t *testing.T) {
+	for _, spec := range []uint16{0xFF68, 0xFF6A} {
+		m, ppu := cgbBus(t)
+		m.Write(spec, 0xBE) //auto increment from 0x3E
+		m.Write(spec+1, 0x12)
+		m.Write(spec+1, 0x34)
+		m.Write(spec+1, 0x56) //wraps to 0
+		if v := m.Read(spec); v != 0xC1 {
+			t.Errorf("0x%04X reads 0x%02X after 3 writes, want 0xC1", spec, v)
+		}
+
+		m.Write(spec, 0x3E) //no auto increment, bit 6 reads 1
+		if v := m.Read(spec); v != 0x7E {
+			t.Errorf("0x%04X reads 0x%02X, want 0x7E", spec, v)
+		}
+		for i := 0; i < 2; i++ {
+			if v := m.Read(spec + 1); v != 0x12 {
+				t.Errorf("0x%04X reads 0x%02X at 0x3E, want 0x12", spec+1, v)
+			}
+		}
+		m.Write(spec+1, 0x9A)
+		m.Write(spec, 0x00)
+		if v := m.Read(spec + 1); v != 0x56 {
+			t.Errorf("0x%04X reads 0x%02X at 0, want 0x56", spec+1, v)
+		}
+		m.Write(spec, 0x3E)
+		if v := m.Read(spec + 1); v != 0x9A {
+			t.Errorf("0x%04X reads 0x%02X at 0x3E after a write, want 0x9A", spec+1, v)
+		}
+
+		//the PPU owns palette RAM in mode 3, writes are lost but still move the index
+		m.Write(spec, 0x81)
+		m.Write(0xFF40, 0x91)
+		waitMode(m, ppu, lib.PixelTransfer)
+		if v := m.Read(spec + 1); v != 0xFF {
+			t.Errorf("0x%04X reads 0x%02X in mode 3", spec+1, v)
+		}
+		m.Write(spec+1, 0x77)
+		waitMode(m, ppu, lib.HBlank)
+		if v := m.Read(spec); v != 0xC2 {
+			t.Errorf("0x%04X reads 0x%02X after a blocked write, want 0xC2", spec, v)
+		}
+		m.Write(spec, 0x01)
+		if v := m.Read(spec + 1); v != 0x00 {
+			t.Errorf("blocked write landed, 0x%04X reads 0x%02X", spec+1, v)
+		}
+	}
+}
+
+// Background tiles take their palette, bank and flips from the attribute map in bank 1
+func TestCgbBackgroundAttributes(t *testing.T) {
+	m, ppu := cgbBus(t)
+	cgbTestPalettes(m, 0xFF68)
+	fifoTiles(m) //bank 0: tile 0 has colors 0-3 across, tile 1 keeps color 3 on its last row only
+	for row := uint16(0); row < 7; row++ {
+		m.Write(0x8010+row*2, 0x00)
+		m.Write(0x8011+row*2, 0x00)
+	}
+	fillMap(m, 0x9800, func(x int) uint8 { return lib.BoolToUint(x == 4) })
+
+	m.Write(0xFF4F, 0x01)
+	for row := uint16(0); row < 8; row++ { //bank 1: tile 0 is color 3 all over
+		m.Write(0x8000+row*2, 0xFF)
+		m.Write(0x8001+row*2, 0xFF)
+	}
+	attributes := []uint8{0x00, 0x02, 0x08, 0x20, 0x40}
+	fillMap(m, 0x9800, func(x int) uint8 {
+		if x < len(attributes) {
+			return attributes[x]
+		}
+		return 0
+	})
+	m.Write(0xFF4F, 0x00)
+	frame := renderFrame(m, ppu, 0x11)
+
+	for x := 0; x < 8; x++ {
+		tests := []struct {
+			name string
+			x, y int
+			want uint16
+		}{
+			{"palette 0", x, 0, cgbTestColor(0, x%4)},
+			{"palette 2", 8 + x, 0, cgbTestColor(2, x%4)},
+			{"bank 1", 16 + x, 0, cgbTestColor(0, 3)},
+			{"x flip", 24 + x, 0, cgbTestColor(0, 3-x%4)},
+			{"y flip, top row", 32 + x, 0, cgbTestColor(0, 3)},
+			{"y flip, bottom row", 32 + x, 7, cgbTestColor(0, 0)},
+		}
+		for _, test := range tests {
+			if c := frame.RGB555(test.x, test.y); c != test.want {
+				t.Errorf("%s: pixel %d,%d is 0x%04X, want 0x%04X", test.name, test.x, test.y, c, test.want)
+			}
+		}
+	}
+}
+
+// On CGB the lower OAM index wins wherever sprites overlap, LCDC bit 0 takes away the
+// priority of the background instead of hiding it
+func TestCgbSpritePriority(t *testing.T) {
+	for _, lcdc := range []uint8{0x13, 0x12} {
+		m, ppu := cgbBus(t)
+		cgbTestPalettes(m, 0xFF68)
+		cgbTestPalettes(m, 0xFF6A)
+		fifoTiles(m)
+		fillMap(m, 0x9800, func(int) uint8 { return 0 })
+		m.Write(0xFF4F, 0x01)
+		fillMap(m, 0x9800, func(x int) uint8 { return lib.BoolToUint(x == 8) << 7 })
+		for row := uint16(0); row < 8; row++ { //bank 1 tile 2: color 1 all over
+			m.Write(0x8020+row*2, 0xFF)
+		}
+		m.Write(0xFF4F, 0x00)
+		for row := uint16(0); row < 8; row++ { //bank 0 tile 3: color 2 all over
+			m.Write(0x8031+row*2, 0xFF)
+		}
+		sprites := [][4]uint8{
+			{16, 8 + 16, 2, 0x08 | 5}, //bank 1, palette 5
+			{16, 8 + 44, 3, 1},
+			{16, 8 + 40, 3, 2}, //lower X but higher OAM index
+			{16, 8 + 64, 3, 3}, //over a tile with the priority attribute
+		}
+		for i, s := range sprites {
+			for j, v := range s {
+				m.Write(0xFE00+uint16(i*4+j), v)
+			}
+		}
+		frame := renderFrame(m, ppu, lcdc)
+
+		bgPriority := lcdc&1 != 0
+		for x := 0; x < 8; x++ {
+			want := map[int]uint16{
+				x:      cgbTestColor(0, x%4), //the background is drawn with LCDC bit 0 off
+				16 + x: cgbTestColor(5, 1),
+				40 + x: cgbTestColor(2, 2), //becomes sprite 1 from pixel 44
+				48 + x: cgbTestColor(1, 2),
+				64 + x: cgbTestColor(3, 2),
+			}
+			if x >= 4 {
+				want[40+x] = cgbTestColor(1, 2)
+				want[48+x] = cgbTestColor(0, x%4)
+			}
+			if bgPriority && x%4 != 0 {
+				want[64+x] = cgbTestColor(0, x%4)
+			}
+			for px, c := range want {
+				if got := frame.RGB555(px, 0); got != c {
+					t.Errorf("LCDC 0x%02X: pixel %d is 0x%04X, want 0x%04X", lcdc, px, got, c)
+				}
+			}
+		}
+	}
+}
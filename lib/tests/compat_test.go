@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"bytes"
+	"gbemulator/lib"
+	"testing"
+)
+
+// Loop over 20 NOPs, too wide for a tight loop
+var nopLoop = append(bytes.Repeat([]uint8{0x00}, 20), 0x18, 0xEA) //jr back to the first NOP
+
+// Turns the LCD off in VBlank, then loops
+var lcdOff = append([]uint8{
+	0xF0, 0x44, 0xFE, 144, 0x38, 0xFA, //ldh a,[LY] / cp 144 / jr c,-6
+	0xAF, 0xE0, 0x40, //xor a / ldh [LCDC],a
+}, nopLoop...)
+
+func TestCheckCompatibility(t *testing.T) {
+	unsupported := headerRom(t, "MBC5")
+	unsupported[0x147] = 0x19
+	fixChecksums(unsupported)
+
+	//a black line at the bottom, drawn before the first frame gets there
+	static := append([]uint8{
+		0xF0, 0x44, 0xFE, 10, 0x20, 0xFA, //ldh a,[LY] / cp 10 / jr nz,-6
+		0xF0, 0x41, 0xE6, 0x03, 0x20, 0xFA, //ldh a,[STAT] / and 3 / jr nz,-6, HBlank
+		0x3E, 0xFF, 0x21, 0x10, 0x80, 0x22, 0x22, //ld a,$FF / ld hl,$8010 / ld [hl+],a twice, top row of tile 1
+		0x3E, 0x01, 0xEA, 0x20, 0x9A, //ld a,1 / ld [$9A20],a, row 17 of the map
+	}, nopLoop...)
+	blank := append([]uint8{0xAF, 0xE0, 0x47}, nopLoop...) //xor a / ldh [BGP],a, all white
+
+	tests := []struct {
+		name   string
+		rom    string
+		frames uint64
+		want   lib.Compatibility
+		detail string
+	}{
+		{"garbage", writeRom(t, "garbage.gb", []uint8("not a rom")), 60, lib.CompatLoadFailed, ""},
+		{"mbc5", writeRom(t, "mbc5.gb", unsupported), 60, lib.CompatUnsupportedMapper, ""},
+		{"illegal opcode", writeRom(t, "illegal.gb", codeRom(t, 0xD3)), 60, lib.CompatCrashed, ""},
+		{"jr -2", writeRom(t, "loop.gb", codeRom(t, 0x18, 0xFE)), 60, lib.CompatTightLoop, "PC stays in 0x0150-0x0150"},
+		{"lcd off", writeRom(t, "off.gb", codeRom(t, lcdOff...)), 60, lib.CompatStuckScreen, "LCD off"},
+		{"blank", writeRom(t, "blank.gb", codeRom(t, blank...)), 60, lib.CompatStuckScreen, "blank screen"},
+		{"static", writeRom(t, "static.gb", codeRom(t, static...)), 60, lib.CompatStuckScreen, "static screen"},
+		{"dmg-acid2", "../../roms/dmg-acid2.gb", 120, lib.CompatOK, ""},
+		{"menu", "../../roms/golden/menu.gb", 60, lib.CompatOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := lib.CheckCompatibility(test.rom, test.frames)
+			if r.Class != test.want {
+				t.Fatalf("got %s (%s), want %s", r.Class, r.Detail, test.want)
+			}
+			if test.detail != "" && r.Detail != test.detail {
+				t.Errorf("detail %q, want %q", r.Detail, test.detail)
+			}
+			if (r.Screen == nil) != (test.want <= lib.CompatUnsupportedMapper) {
+				t.Errorf("screen %v for %s", r.Screen != nil, r.Class)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Reported in the summary but not failing the run, until the emulator gets there
+var knownFailures = map[string]bool{
+	"blargg/mem_timing": true, //memory accesses all happen at the end of the instruction
+}
+
+// Every test ROM under roms/, see lib.DiscoverConformance. Set CONFORMANCE_JUNIT to a
+// path to also get a JUnit report
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("test ROMs take a while")
+	}
+
+	tests, err := lib.DiscoverConformance("../../roms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var results []lib.ConformanceResult
+	t.Run("roms", func(t *testing.T) {
+		for _, test := range tests {
+			test := test
+			t.Run(test.Name, func(t *testing.T) {
+				t.Parallel()
+				r := lib.RunConformance(test)
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+
+				switch {
+				case !r.Passed && knownFailures[test.Name]:
+					t.Skip("known failure:", r.Message)
+				case !r.Passed:
+					t.Error(r.Message)
+				case knownFailures[test.Name]:
+					t.Log("passes now, it can leave knownFailures")
+				}
+			})
+		}
+	})
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Test.Name < results[j].Test.Name })
+	t.Log("\n" + lib.ConformanceSummary(results))
+
+	if p := os.Getenv("CONFORMANCE_JUNIT"); p != "" {
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := lib.WriteJUnit(f, "conformance", results); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Mooneye ROMs end with LD B,B, passing with Fibonacci numbers in B-L and failing with 0x42
+func TestMooneyeResult(t *testing.T) {
+	result := func(b, c, d, e, h, l uint8) []uint8 {
+		return []uint8{0x06, b, 0x0E, c, 0x16, d, 0x1E, e, 0x26, h, 0x2E, l, 0x40, 0x18, 0xFE} //ld b-l / ld b,b / jr -2
+	}
+	dir := filepath.Join(t.TempDir(), "mooneye")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	roms := map[string][]uint8{
+		"pass.gb": codeRom(t, result(3, 5, 8, 13, 21, 34)...),
+		"fail.gb": codeRom(t, result(0x42, 0x42, 0x42, 0x42, 0x42, 0x42)...),
+	}
+	for name, rom := range roms {
+		if err := os.WriteFile(filepath.Join(dir, name), rom, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests, err := lib.DiscoverConformance(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 2 {
+		t.Fatalf("found %d tests, want 2", len(tests))
+	}
+	want := map[string]bool{"mooneye/mooneye/pass": true, "mooneye/mooneye/fail": false}
+	for _, test := range tests {
+		passed, ok := want[test.Name]
+		if !ok || test.Family != lib.Mooneye {
+			t.Errorf("%s: unexpected %s test", test.Name, test.Family)
+			continue
+		}
+		r := lib.RunConformance(test)
+		if r.Passed != passed {
+			t.Errorf("%s: passed %v, %s", test.Name, r.Passed, r.Message)
+		}
+	}
+}
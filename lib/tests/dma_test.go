@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"testing"
+)
+
+// MMU with the LCD off and no cart, WRAM 0xC000-0xC09F holds its offset and 0xD000-0xD09F
+// the offset plus 0x80
+func dmaBus(t *testing.T) (*lib.MMU, *lib.PPU) {
+	t.Helper()
+	ppu, err := lib.LoadPpu(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := lib.LoadBus(nil, nil, nil, ppu, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu.MMU = m
+	m.Write(0xFF40, 0x00)
+	for i := uint16(0); i < lib.DMA_LENGTH; i++ {
+		m.Write(0xC000+i, uint8(i))
+		m.Write(0xD000+i, uint8(i)+0x80)
+	}
+	return m, ppu
+}
+
+func checkOam(t *testing.T, m *lib.MMU, want func(i uint16) uint8) {
+	t.Helper()
+	for i := uint16(0); i < lib.DMA_LENGTH; i++ {
+		if v := m.Read(0xFE00 + i); v != want(i) {
+			t.Fatalf("OAM 0x%04X is 0x%02X, want 0x%02X", 0xFE00+i, v, want(i))
+		}
+	}
+}
+
+// The first byte is copied in the M-cycle after the write, then one byte per M-cycle
+func TestDmaStart(t *testing.T) {
+	m, _ := dmaBus(t)
+	m.Write(0xFF46, 0xC0)
+
+	//the cycle of the write, OAM and the source bus are still free
+	m.UpdateDma(1)
+	if v := m.Read(0xC050); v != 0x50 {
+		t.Errorf("WRAM reads 0x%02X during the start delay, want 0x50", v)
+	}
+	if v := m.Read(0xFE00); v != 0x00 {
+		t.Errorf("OAM reads 0x%02X during the start delay, want 0x00", v)
+	}
+
+	//byte 0 copied, the CPU now sees the byte the DMA reads next
+	m.UpdateDma(1)
+	if v := m.Read(0xC050); v != 0x01 {
+		t.Errorf("WRAM reads 0x%02X after the first byte, want 0x01", v)
+	}
+
+	m.UpdateDma(lib.DMA_LENGTH - 2)
+	if v := m.Read(0xFE00); v != 0xFF {
+		t.Errorf("OAM reads 0x%02X before the last byte, want 0xFF", v)
+	}
+	m.UpdateDma(1)
+	checkOam(t, m, func(i uint16) uint8 { return uint8(i) })
+	if v := m.Read(0xFF46); v != 0xC0 {
+		t.Errorf("DMA register reads 0x%02X, want 0xC0", v)
+	}
+}
+
+// While a transfer runs the CPU only reaches the other bus, HRAM and the IO registers
+func TestDmaBusConflicts(t *testing.T) {
+	m, _ := dmaBus(t)
+	m.Write(0x8000, 0x42)
+	m.Write(0xFF80, 0x24)
+	m.Write(0xFF46, 0xC0)
+	m.UpdateDma(11) //10 bytes copied
+
+	tests := []struct {
+		name string
+		a    uint16
+		want uint8
+	}{
+		{"WRAM gets the DMA byte", 0xC090, 0x0A},
+		{"all of WRAM is on the same bus", 0xD123, 0x0A},
+		{"VRAM is on its own bus", 0x8000, 0x42},
+		{"OAM is locked", 0xFE10, 0xFF},
+		{"HRAM", 0xFF80, 0x24},
+		{"IO registers", 0xFF46, 0xC0},
+	}
+	for _, test := range tests {
+		if v := m.Read(test.a); v != test.want {
+			t.Errorf("%s: 0x%04X reads 0x%02X, want 0x%02X", test.name, test.a, v, test.want)
+		}
+	}
+
+	//writes to the DMA bus are lost
+	m.Write(0xC090, 0x99)
+	m.Write(0xFF81, 0x99)
+	m.UpdateDma(lib.DMA_LENGTH)
+	if v := m.Read(0xC090); v != 0x90 {
+		t.Errorf("WRAM write during DMA went through, reads 0x%02X", v)
+	}
+	if v := m.Read(0xFF81); v != 0x99 {
+		t.Errorf("HRAM write during DMA was lost, reads 0x%02X", v)
+	}
+
+	//a VRAM source leaves WRAM free
+	m.Write(0xFF46, 0x80)
+	m.UpdateDma(3)
+	if v := m.Read(0xC090); v != 0x90 {
+		t.Errorf("WRAM reads 0x%02X during a VRAM DMA, want 0x90", v)
+	}
+}
+
+// A write during a transfer restarts it, the old one keeps OAM until the new one starts
+func TestDmaRestart(t *testing.T) {
+	m, _ := dmaBus(t)
+	m.Write(0xFF46, 0xC0)
+	m.UpdateDma(11) //10 bytes copied
+
+	m.Write(0xFF46, 0xD0)
+	m.UpdateDma(1)
+	if v := m.Read(0xC050); v != 0x0B {
+		t.Errorf("old transfer reads 0x%02X in the restart delay, want 0x0B", v)
+	}
+	if v := m.Read(0xFE00); v != 0xFF {
+		t.Errorf("OAM reads 0x%02X in the restart delay, want 0xFF", v)
+	}
+
+	m.UpdateDma(1)
+	if v := m.Read(0xC050); v != 0x81 {
+		t.Errorf("new transfer reads 0x%02X, want 0x81", v)
+	}
+	m.UpdateDma(lib.DMA_LENGTH - 1)
+	checkOam(t, m, func(i uint16) uint8 { return uint8(i) + 0x80 })
+}
+
+// OAM DMA from VRAM gets the data even in mode 3, where the CPU is locked out
+func TestDmaFromVramInMode3(t *testing.T) {
+	m, ppu := dmaBus(t)
+	for i := uint16(0); i < lib.DMA_LENGTH; i++ {
+		m.Write(0x8000+i, uint8(i)^0x5A)
+	}
+	m.Write(0xFF40, 0x91)
+	for m.Read(0xFF41)&0b11 != 3 {
+		ppu.Update(4)
+	}
+	if v := m.Read(0x8000); v != 0xFF {
+		t.Fatalf("VRAM reads 0x%02X in mode 3, want 0xFF", v)
+	}
+
+	m.Write(0xFF46, 0x80)
+	mode3 := 0
+	for i := 0; i <= lib.DMA_LENGTH; i++ {
+		if m.Read(0xFF41)&0b11 == 3 {
+			mode3++
+		}
+		m.UpdateDma(1)
+		ppu.Update(4)
+	}
+	if mode3 == 0 {
+		t.Fatal("the transfer never overlapped mode 3")
+	}
+
+	m.Write(0xFF40, 0x00)
+	checkOam(t, m, func(i uint16) uint8 { return uint8(i) ^ 0x5A })
+}
+
+// CGB bus with WRAM 0xC000-0xC0FF holding its offset plus 0x40 and a VRAM DMA set up from
+// 0xC000 to the destination
+func hdmaBus(t *testing.T, destination uint16) (*lib.MMU, *lib.PPU) {
+	t.Helper()
+	m, ppu := cgbBus(t)
+	for i := uint16(0); i < 0x100; i++ {
+		m.Write(0xC000+i, uint8(i)+0x40)
+	}
+	m.Write(0xFF51, 0xC0)
+	m.Write(0xFF52, 0x0F) //the low 4 bits are ignored
+	m.Write(0xFF53, uint8(destination>>8))
+	m.Write(0xFF54, uint8(destination))
+	return m, ppu
+}
+
+// Number of bytes copied to VRAM from 0x8100, VRAM has to be free
+func hdmaCopied(m *lib.MMU) int {
+	copied := 0
+	for ; copied < 0x100; copied++ {
+		if m.Read(0x8100+uint16(copied)) != uint8(copied)+0x40 {
+			break
+		}
+	}
+	return copied
+}
+
+// A general purpose transfer copies everything at once and stops the CPU for it
+func TestHdmaGeneralPurpose(t *testing.T) {
+	m, _ := hdmaBus(t, 0x8100)
+	m.Write(0xFF55, 0x02)
+	if n := hdmaCopied(m); n != 3*lib.HDMA_BLOCK_SIZE {
+		t.Errorf("copied %d bytes, want %d", n, 3*lib.HDMA_BLOCK_SIZE)
+	}
+	if v := m.Read(0xFF55); v != 0xFF {
+		t.Errorf("HDMA5 reads 0x%02X after the transfer", v)
+	}
+	if stall := m.TakeDmaStall(); stall != 3*lib.HDMA_BLOCK_CYCLES {
+		t.Errorf("the CPU stops for %d M-cycles, want %d", stall, 3*lib.HDMA_BLOCK_CYCLES)
+	}
+	if stall := m.TakeDmaStall(); stall != 0 {
+		t.Errorf("the stall was taken twice, %d M-cycles left", stall)
+	}
+}
+
+// HBlank transfers copy one block per HBlank and count down in HDMA5
+func TestHdmaHBlank(t *testing.T) {
+	m, ppu := hdmaBus(t, 0x8100)
+	m.Write(0xFF40, 0x91)
+	waitMode(m, ppu, lib.PixelTransfer)
+	m.Write(0xFF55, 0x82)
+	if v := m.Read(0xFF55); v != 0x02 {
+		t.Fatalf("HDMA5 reads 0x%02X before HBlank, want 0x02", v)
+	}
+
+	for block := 1; block <= 3; block++ {
+		waitMode(m, ppu, lib.HBlank)
+		if n := hdmaCopied(m); n != block*lib.HDMA_BLOCK_SIZE {
+			t.Errorf("copied %d bytes after %d HBlanks", n, block)
+		}
+		want := uint8(2 - block)
+		if block == 3 {
+			want = 0xFF
+		}
+		if v := m.Read(0xFF55); v != want {
+			t.Errorf("HDMA5 reads 0x%02X after %d HBlanks, want 0x%02X", v, block, want)
+		}
+		waitMode(m, ppu, lib.PixelTransfer)
+	}
+	waitMode(m, ppu, lib.HBlank)
+	if n := hdmaCopied(m); n != 3*lib.HDMA_BLOCK_SIZE {
+		t.Errorf("copied %d bytes after the transfer ended", n)
+	}
+}
+
+func TestHdmaCancel(t *testing.T) {
+	m, ppu := hdmaBus(t, 0x8100)
+	m.Write(0xFF40, 0x91)
+	waitMode(m, ppu, lib.PixelTransfer)
+	m.Write(0xFF55, 0x83)
+	waitMode(m, ppu, lib.HBlank)
+	m.Write(0xFF55, 0x00)
+	if v := m.Read(0xFF55); v != 0x82 {
+		t.Errorf("HDMA5 reads 0x%02X after the cancel, want 0x82", v)
+	}
+
+	waitMode(m, ppu, lib.PixelTransfer)
+	waitMode(m, ppu, lib.HBlank)
+	if n := hdmaCopied(m); n != lib.HDMA_BLOCK_SIZE {
+		t.Errorf("copied %d bytes, want the block before the cancel", n)
+	}
+}
+
+func TestHdmaHBlankStart(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *lib.MMU, ppu *lib.PPU)
+	}{
+		{"LCD off", func(*lib.MMU, *lib.PPU) {}},
+		{"in HBlank", func(m *lib.MMU, ppu *lib.PPU) {
+			m.Write(0xFF40, 0x91)
+			waitMode(m, ppu, lib.PixelTransfer)
+			waitMode(m, ppu, lib.HBlank)
+		}},
+	}
+	for _, test := range tests {
+		m, ppu := hdmaBus(t, 0x8100)
+		test.setup(m, ppu)
+		m.Write(0xFF55, 0x81)
+		if n := hdmaCopied(m); n != lib.HDMA_BLOCK_SIZE {
+			t.Errorf("%s: copied %d bytes at the start, want the first block", test.name, n)
+		}
+		if v := m.Read(0xFF55); v != 0x00 {
+			t.Errorf("%s: HDMA5 reads 0x%02X, want 0x00", test.name, v)
+		}
+	}
+}
+
+// The destination stays in VRAM, the transfer ends once it goes past 0x9FFF
+func TestHdmaVramEnd(t *testing.T) {
+	m, _ := hdmaBus(t, 0x9FF0)
+	m.Write(0x8000, 0x99)
+	m.Write(0xFF55, 0x03)
+	if v := m.Read(0x9FFF); v != 0x4F {
+		t.Errorf("0x9FFF holds 0x%02X, want 0x4F", v)
+	}
+	if v := m.Read(0x8000); v != 0x99 {
+		t.Errorf("the transfer wrapped to 0x8000, it holds 0x%02X", v)
+	}
+	if v := m.Read(0xFF55); v != 0xFF {
+		t.Errorf("HDMA5 reads 0x%02X", v)
+	}
+	if stall := m.TakeDmaStall(); stall != lib.HDMA_BLOCK_CYCLES {
+		t.Errorf("the CPU stops for %d M-cycles, want one block", stall)
+	}
+}
+
+// Emulator.Run keeps the CPU stopped while the clock and the PPU run through the transfer
+func TestHdmaCpuStall(t *testing.T) {
+	cycles := func(hdma5 uint8) uint64 {
+		e := loadCode(t, cgbRom(codeRom(t,
+			0x3E, 0xC0, 0xE0, 0x51, //ld a,$C0 / ldh [HDMA1],a
+			0xAF, 0xE0, 0x52, 0xE0, 0x54, //xor a / ldh [HDMA2],a / ldh [HDMA4],a
+			0x3E, 0x01, 0xE0, 0x53, //ld a,$01 / ldh [HDMA3],a
+			0x3E, hdma5, 0xE0, 0x55, //ld a,hdma5 / ldh [HDMA5],a
+			0x00, 0x18, 0xFE, //nop / jr -2
+		)))
+		r := e.RunHeadless(lib.HeadlessOptions{Frames: 10, Breakpoints: []uint16{0x161}})
+		if r.Reason != lib.StopBreakpoint {
+			t.Fatalf("stopped with %s at 0x%04X", r.Reason, r.PC)
+		}
+		return r.Cycles
+	}
+	if stall := cycles(0x07) - cycles(0x00); stall != 7*lib.HDMA_BLOCK_CYCLES {
+		t.Errorf("8 blocks took %d more M-cycles than 1, want %d", stall, 7*lib.HDMA_BLOCK_CYCLES)
+	}
+}
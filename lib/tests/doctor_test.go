@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"gbemulator/lib"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// 30 INC A then LD B,B, the run stops before it
+var doctorCode = append(bytes.Repeat([]uint8{0x3C}, 30), 0x40)
+
+// Gameboy Doctor lines of a run of doctorCode
+func doctorReference(t *testing.T) []string {
+	t.Helper()
+	var log bytes.Buffer
+	e, err := lib.LoadEmulator(lib.WithCartBytes(codeRom(t, doctorCode...)), lib.WithDoctorLog(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := e.RunHeadless(lib.HeadlessOptions{Frames: 1, BreakOnLdBB: true}); r.Reason != lib.StopBreakpoint {
+		t.Fatalf("reference run stopped with %s", r.Reason)
+	}
+	return strings.Split(strings.TrimSpace(log.String()), "\n")
+}
+
+func runDoctorCompare(t *testing.T, reference []string) lib.HeadlessResult {
+	t.Helper()
+	compare := lib.LoadDoctorCompare(strings.NewReader(strings.Join(reference, "\n") + "\n"))
+	e, err := lib.LoadEmulator(lib.WithCartBytes(codeRom(t, doctorCode...)), lib.WithDoctorLog(compare))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.RunHeadless(lib.HeadlessOptions{Frames: 1, BreakOnLdBB: true})
+}
+
+func TestDoctorCompareMatch(t *testing.T) {
+	reference := doctorReference(t)
+	if len(reference) != 32 { //nop, jp and the INCs
+		t.Fatalf("reference has %d lines", len(reference))
+	}
+	if r := runDoctorCompare(t, reference); r.Reason != lib.StopBreakpoint || r.Err != nil {
+		t.Errorf("stopped with %s: %v", r.Reason, r.Err)
+	}
+}
+
+func TestDoctorCompareShortLog(t *testing.T) {
+	reference := doctorReference(t)[:10]
+	r := runDoctorCompare(t, reference)
+	if !errors.Is(r.Err, lib.ErrDoctorLogEnd) {
+		t.Fatalf("stopped with %s: %v", r.Reason, r.Err)
+	}
+	//the 11th instruction is the one that found the log ended
+	if r.PC != 0x150+8 {
+		t.Errorf("stopped at 0x%04X", r.PC)
+	}
+}
+
+func TestDoctorDivergence(t *testing.T) {
+	reference := doctorReference(t)
+	const line = 20
+	got := reference[line-1]
+	want := regexp.MustCompile(`A:[0-9A-F]{2}`).ReplaceAllString(got, "A:EE")
+	reference[line-1] = want
+
+	r := runDoctorCompare(t, reference)
+	var d *lib.DoctorDivergence
+	if !errors.As(r.Err, &d) {
+		t.Fatalf("stopped with %s: %v", r.Reason, r.Err)
+	}
+	if d.Line != line || d.Got != got || d.Want != want {
+		t.Errorf("line %d %q, want line %d %q", d.Line, d.Got, line, got)
+	}
+	if len(d.Recent) != lib.DOCTOR_HISTORY || d.Recent[len(d.Recent)-1] != reference[line-2] {
+		t.Errorf("recent lines %q", d.Recent)
+	}
+
+	message := d.Error()
+	a := regexp.MustCompile(`A:([0-9A-F]{2})`).FindStringSubmatch(got)[1]
+	for _, s := range []string{
+		"line 20 differs",
+		"  A     " + a + ", want EE\n",
+		reference[line-1-lib.DOCTOR_HISTORY] + "  Inc A\n",
+		"> " + got + "  Inc A\n",
+		"< " + want,
+	} {
+		if !strings.Contains(message, s) {
+			t.Errorf("message lacks %q:\n%s", s, message)
+		}
+	}
+	if strings.Contains(message, "  F ") {
+		t.Errorf("message shows registers that match:\n%s", message)
+	}
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"testing"
+)
+
+func loadCode(t *testing.T, rom []uint8) *lib.Emulator {
+	t.Helper()
+	e, err := lib.LoadEmulator(lib.WithCartBytes(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRunFrameLcdOn(t *testing.T) {
+	e := loadCode(t, codeRom(t, nopLoop...))
+	e.RunFrame() //the first frame starts before the ROM does
+
+	for i := 0; i < 60; i++ {
+		frames := e.FrameCount()
+		cycles := e.RunFrame()
+		if e.FrameCount() != frames+1 {
+			t.Fatalf("frame %d: %d frames completed", i, e.FrameCount()-frames)
+		}
+		//frames end on instruction boundaries, the JR of the loop takes 3 M-cycles
+		if cycles < lib.FRAME_CYCLES-2 || cycles > lib.FRAME_CYCLES+2 {
+			t.Errorf("frame %d took %d M-cycles, want %d", i, cycles, lib.FRAME_CYCLES)
+		}
+	}
+}
+
+func TestRunFrameLcdOff(t *testing.T) {
+	tests := []struct {
+		name   string
+		rom    []uint8
+		cycles int
+	}{
+		{"single speed", codeRom(t, lcdOff...), lib.FRAME_CYCLES},
+		{"double speed", cgbRom(codeRom(t, append([]uint8{
+			0x3E, 0x01, 0xE0, 0x4D, //ld a,1 / ldh [KEY1],a
+			0x10, 0x00, //stop, the speed switch
+		}, lcdOff...)...)), 2 * lib.FRAME_CYCLES},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := loadCode(t, test.rom)
+			e.RunCycles(3 * lib.FRAME_CYCLES)
+
+			frames := e.FrameCount()
+			if cycles := e.RunFrame(); cycles != test.cycles {
+				t.Errorf("ran %d M-cycles, want %d", cycles, test.cycles)
+			}
+			if e.FrameCount() != frames {
+				t.Errorf("%d frames completed with the LCD off", e.FrameCount()-frames)
+			}
+		})
+	}
+}
+
+func cgbRom(rom []uint8) []uint8 {
+	rom[0x143] = 0x80
+	rom[0x14D] = lib.HeaderChecksum(rom)
+	return rom
+}
+
+func TestRunCyclesError(t *testing.T) {
+	e := loadCode(t, codeRom(t, 0x00, 0x00, 0xD3)) //nop / nop / illegal
+	if cycles := e.RunCycles(1000); cycles != 7 {
+		t.Errorf("ran %d M-cycles, want 7 before the illegal opcode", cycles)
+	}
+	if e.Err() == nil {
+		t.Fatal("no error")
+	}
+
+	//nothing runs past the error
+	if cycles := e.RunCycles(1000); cycles != 0 {
+		t.Errorf("ran %d M-cycles after the error", cycles)
+	}
+	if cycles := e.RunFrame(); cycles != 0 {
+		t.Errorf("frame ran %d M-cycles after the error", cycles)
+	}
+}
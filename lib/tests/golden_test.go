@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const goldenDir = "../../roms/golden"
+
+// Last frame of every ROM in roms/golden/golden.json against its recorded hash. A mismatch
+// leaves a <name>.diff.png with the changed pixels in red next to the golden PNG.
+// GOLDEN_UPDATE=1 records the current frames as the new goldens
+func TestGolden(t *testing.T) {
+	if testing.Short() {
+		t.Skip("golden ROMs take a while")
+	}
+
+	manifest := filepath.Join(goldenDir, "golden.json")
+	tests, err := lib.LoadGoldenTests(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := os.Getenv("GOLDEN_UPDATE") != ""
+
+	t.Run("roms", func(t *testing.T) {
+		for i := range tests {
+			i, g := i, tests[i]
+			t.Run(g.Name, func(t *testing.T) {
+				t.Parallel()
+				e, err := lib.RunGolden(g, goldenDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				hash, img := e.Frame().Hash(), e.FrameImage()
+				reference := filepath.Join(goldenDir, g.Name+".png")
+
+				if update {
+					tests[i].Hash = hash
+					if err := lib.WritePng(reference, img); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if hash == g.Hash {
+					return
+				}
+				diff := filepath.Join(goldenDir, g.Name+".diff.png")
+				changed, err := lib.WriteGoldenDiff(diff, img, reference)
+				if err != nil {
+					t.Fatalf("frame %d hash %s, want %s, no diff: %v", g.Frames, hash, g.Hash, err)
+				}
+				t.Errorf("frame %d hash %s, want %s, %d pixels changed, see %s", g.Frames, hash, g.Hash, changed, diff)
+			})
+		}
+	})
+
+	if update {
+		if err := lib.SaveGoldenTests(manifest, tests); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiffImage(t *testing.T) {
+	fill := func(w, h int) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Set(x, y, color.White)
+			}
+		}
+		return img
+	}
+	red := color.RGBA{0xFF, 0x00, 0x00, 0xFF}
+
+	want := fill(4, 3)
+	got := fill(4, 3)
+	if _, changed := lib.DiffImage(got, want); changed != 0 {
+		t.Errorf("same images: %d changed", changed)
+	}
+
+	got.Set(1, 0, color.Black)
+	got.Set(3, 2, color.Gray{0x80})
+	diff, changed := lib.DiffImage(got, want)
+	if changed != 2 {
+		t.Errorf("%d changed, want 2", changed)
+	}
+	if diff.RGBAAt(1, 0) != red || diff.RGBAAt(3, 2) != red {
+		t.Error("changed pixels are not red")
+	}
+	if diff.RGBAAt(0, 0) == red {
+		t.Error("unchanged pixel is red")
+	}
+
+	//the column want does not have
+	if _, changed := lib.DiffImage(fill(5, 3), want); changed != 3 {
+		t.Errorf("wider image: %d changed, want 3", changed)
+	}
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"gbemulator/lib"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Header with a broken logo, short ROM and stale checksums, with the fix for it
+func brokenHeader(t *testing.T) ([]uint8, lib.HeaderFix) {
+	t.Helper()
+	rom := headerRom(t, "TEST")[:0x6000]
+	rom[0x110] ^= 0xFF
+	title := "FIXED"
+	return rom, lib.HeaderFix{Logo: true, Pad: true, Title: &title}
+}
+
+func TestFixHeader(t *testing.T) {
+	rom, fix := brokenHeader(t)
+	fixed, changes, err := lib.FixHeader(rom, fix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := lib.LoadCartInfo(writeRom(t, "fixed.gb", fixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := info.Problems(); len(problems) != 0 {
+		t.Errorf("problems after the fix: %q", problems)
+	}
+	if info.Title != "FIXED" {
+		t.Errorf("title %q, want %q", info.Title, "FIXED")
+	}
+
+	//the ROM size already said 32 KiB, so it is not listed
+	want := []string{
+		"padded from 24576 to 32768 bytes",
+		"logo: bad -> ok",
+		`title: "TEST" -> "FIXED"`,
+		fmt.Sprintf("header checksum: 0x%02X -> 0x%02X", rom[0x14D], fixed[0x14D]),
+		fmt.Sprintf("global checksum: 0x%02X%02X -> 0x%02X%02X", rom[0x14E], rom[0x14F], fixed[0x14E], fixed[0x14F]),
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes\n%q\nwant\n%q", changes, want)
+	}
+
+	if _, changes, err := lib.FixHeader(fixed, fix); err != nil || len(changes) != 0 {
+		t.Errorf("fixing again changed %q, %v", changes, err)
+	}
+}
+
+func TestFixHeaderFile(t *testing.T) {
+	rom, fix := brokenHeader(t)
+	in := writeRom(t, "broken.gb", rom)
+	out := filepath.Join(t.TempDir(), "out.gb")
+
+	//-n only reports
+	changes, err := lib.FixHeaderFile(in, out, fix, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Error("dry run reported no changes")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s: %v", out, err)
+	}
+	if _, err := lib.FixHeaderFile(in, "", fix, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(in); !bytes.Equal(data, rom) {
+		t.Error("dry run changed the ROM")
+	}
+
+	if _, err := lib.FixHeaderFile(in, out, fix, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(in); !bytes.Equal(data, rom) {
+		t.Error("fixing into another file changed the ROM")
+	}
+	info, err := lib.LoadCartInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := info.Problems(); len(problems) != 0 {
+		t.Errorf("problems after the fix: %q", problems)
+	}
+
+	//in place without -o
+	if _, err := lib.FixHeaderFile(in, "", fix, false); err != nil {
+		t.Fatal(err)
+	}
+	fixed, _ := os.ReadFile(out)
+	if data, _ := os.ReadFile(in); !bytes.Equal(data, fixed) {
+		t.Error("the ROM was not fixed in place")
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"gbemulator/lib"
+	"regexp"
+	"testing"
+)
+
+// Sends "ok" over the link port, then loops
+var serialOk = append([]uint8{
+	0x3E, 'o', 0xE0, 0x01, 0x3E, 0x81, 0xE0, 0x02, //ld a,'o' / ldh [SB],a / ld a,$81 / ldh [SC],a
+	0x3E, 'k', 0xE0, 0x01, 0x3E, 0x81, 0xE0, 0x02,
+}, nopLoop...)
+
+func TestRunHeadlessStops(t *testing.T) {
+	frames := 0
+	tests := []struct {
+		name    string
+		code    []uint8
+		options lib.HeadlessOptions
+		reason  lib.StopReason
+		check   func(r lib.HeadlessResult) error
+	}{
+		{"frames", nopLoop, lib.HeadlessOptions{Frames: 3}, lib.StopLimit, func(r lib.HeadlessResult) error {
+			if r.Frames != 3 {
+				return fmt.Errorf("ran %d frames", r.Frames)
+			}
+			return nil
+		}},
+		{"cycles", nopLoop, lib.HeadlessOptions{Cycles: 1000}, lib.StopLimit, func(r lib.HeadlessResult) error {
+			if r.Cycles != 1000 || r.Frames != 0 {
+				return fmt.Errorf("ran %d M-cycles, %d frames", r.Cycles, r.Frames)
+			}
+			return nil
+		}},
+		{"LD B,B", []uint8{0x00, 0x00, 0x40, 0x18, 0xFE}, lib.HeadlessOptions{Frames: 10, BreakOnLdBB: true}, lib.StopBreakpoint,
+			func(r lib.HeadlessResult) error {
+				if r.PC != 0x152 {
+					return fmt.Errorf("stopped at 0x%04X", r.PC)
+				}
+				return nil
+			}},
+		{"LD B,B ignored", []uint8{0x00, 0x00, 0x40, 0x18, 0xFE}, lib.HeadlessOptions{Frames: 1}, lib.StopLimit, nil},
+		{"breakpoint", nopLoop, lib.HeadlessOptions{Frames: 10, Breakpoints: []uint16{0x0160}}, lib.StopBreakpoint,
+			func(r lib.HeadlessResult) error {
+				if r.PC != 0x0160 {
+					return fmt.Errorf("stopped at 0x%04X", r.PC)
+				}
+				return nil
+			}},
+		{"serial", serialOk, lib.HeadlessOptions{Frames: 10, SerialMatch: regexp.MustCompile("ok")}, lib.StopSerialMatch, nil},
+		{"serial not matched", serialOk, lib.HeadlessOptions{Frames: 2, SerialMatch: regexp.MustCompile("fail")}, lib.StopLimit, nil},
+		{"error", []uint8{0x00, 0xD3}, lib.HeadlessOptions{Frames: 10}, lib.StopError, func(r lib.HeadlessResult) error {
+			if r.Err == nil {
+				return errors.New("no error")
+			}
+			return nil
+		}},
+		{"condition", nopLoop, lib.HeadlessOptions{Frames: 10, Until: func() bool { frames++; return frames == 4 }}, lib.StopCondition,
+			func(r lib.HeadlessResult) error {
+				if r.Frames != 4 {
+					return fmt.Errorf("ran %d frames", r.Frames)
+				}
+				return nil
+			}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := loadCode(t, codeRom(t, test.code...))
+			r := e.RunHeadless(test.options)
+			if r.Reason != test.reason {
+				t.Fatalf("stopped with %s at 0x%04X, want %s", r.Reason, r.PC, test.reason)
+			}
+			if test.check != nil {
+				if err := test.check(r); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadlessExitCode(t *testing.T) {
+	serial := lib.HeadlessOptions{SerialMatch: regexp.MustCompile("Passed")}
+	tests := []struct {
+		name    string
+		result  lib.HeadlessResult
+		options lib.HeadlessOptions
+		want    int
+	}{
+		{"limit", lib.HeadlessResult{Reason: lib.StopLimit}, lib.HeadlessOptions{}, lib.EXIT_OK},
+		{"limit before the serial matched", lib.HeadlessResult{Reason: lib.StopLimit}, serial, lib.EXIT_NO_MATCH},
+		{"serial matched", lib.HeadlessResult{Reason: lib.StopSerialMatch}, serial, lib.EXIT_OK},
+		{"breakpoint", lib.HeadlessResult{Reason: lib.StopBreakpoint}, lib.HeadlessOptions{}, lib.EXIT_BREAKPOINT},
+		{"cpu error", lib.HeadlessResult{Reason: lib.StopError, Err: errors.New("opcode d3 not implemented")}, lib.HeadlessOptions{}, lib.EXIT_CPU_ERROR},
+		{"doctor log matched", lib.HeadlessResult{Reason: lib.StopError, Err: fmt.Errorf("line 10: %w", lib.ErrDoctorLogEnd)}, lib.HeadlessOptions{}, lib.EXIT_OK},
+		{"condition", lib.HeadlessResult{Reason: lib.StopCondition}, serial, lib.EXIT_OK},
+	}
+	for _, test := range tests {
+		if got := test.result.ExitCode(test.options); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"testing"
+)
+
+// 32 KiB ROM that jumps to code at 0x150
+func codeRom(t *testing.T, code ...uint8) []uint8 {
+	t.Helper()
+	rom := headerRom(t, "CODE")
+	copy(rom[0x100:], []uint8{0x00, 0xC3, 0x50, 0x01}) //nop / jp $150
+	copy(rom[0x150:], code)
+	fixChecksums(rom)
+	return rom
+}
+
+func TestParseButtons(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    lib.Button
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"a", lib.ButtonA, false},
+		{"a,start", lib.ButtonA | lib.ButtonStart, false},
+		{" Up , LEFT ", lib.ButtonUp | lib.ButtonLeft, false},
+		{"down,,b", lib.ButtonDown | lib.ButtonB, false},
+		{"right,select", lib.ButtonRight | lib.ButtonSelect, false},
+		{"a,jump", 0, true},
+		{"start+a", 0, true},
+	}
+	for _, test := range tests {
+		got, err := lib.ParseButtons(test.s)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: error %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %08b, want %08b", test.s, got, test.want)
+		}
+	}
+}
+
+// STOP with IE clear still wakes up on a button press
+func TestStopWakesOnButton(t *testing.T) {
+	rom := codeRom(t,
+		0x3E, 0x20, 0xE0, 0x00, //ld a,$20 / ldh [P1],a, the d-pad
+		0xAF, 0xE0, 0xFF, //xor a / ldh [IE],a
+		0x10, 0x00, //stop
+		0x18, 0xFE, //$159: jr $159
+	)
+	e, err := lib.LoadEmulator(lib.WithCartBytes(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := lib.HeadlessOptions{Cycles: 100000, Breakpoints: []uint16{0x159}}
+
+	if r := e.RunHeadless(options); r.Reason != lib.StopLimit {
+		t.Fatalf("stopped with %s at 0x%04X without a button", r.Reason, r.PC)
+	}
+
+	//a button of the other row does not wake it
+	e.SetButtons(lib.ButtonA)
+	if r := e.RunHeadless(options); r.Reason != lib.StopLimit {
+		t.Fatalf("stopped with %s at 0x%04X with A", r.Reason, r.PC)
+	}
+
+	e.SetButtons(lib.ButtonA | lib.ButtonDown)
+	if r := e.RunHeadless(options); r.Reason != lib.StopBreakpoint {
+		t.Errorf("stopped with %s at 0x%04X with Down", r.Reason, r.PC)
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"math/rand"
+	"testing"
+)
+
+// MMU of a model with the OAM bug, OAM filled with random bytes and the PPU at the start
+// of the OAM search of line 1. Returns the OAM it was filled with
+func oamBugBus(t *testing.T) (*lib.MMU, *lib.PPU, []uint8) {
+	t.Helper()
+	ppu, err := lib.LoadPpu(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := lib.LoadBus(nil, nil, nil, ppu, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu.MMU = m
+	m.SetOamBug(true)
+
+	m.Write(0xFF40, 0x00)
+	oam := make([]uint8, 0xA0)
+	rand.New(rand.NewSource(0x0A)).Read(oam)
+	for i, v := range oam {
+		m.Write(0xFE00+uint16(i), v)
+	}
+
+	m.Write(0xFF40, 0x91)
+	for m.Read(0xFF44) != 1 || m.Read(0xFF41)&0b11 != 2 {
+		ppu.Update(1)
+	}
+	return m, ppu, oam
+}
+
+// OAM with the LCD off, where nothing corrupts it
+func readOam(m *lib.MMU) []uint8 {
+	m.Write(0xFF40, 0x00)
+	oam := make([]uint8, 0xA0)
+	for i := range oam {
+		oam[i] = m.Read(0xFE00 + uint16(i))
+	}
+	return oam
+}
+
+// The formulas of https://gbdev.io/pandocs/OAM_Corruption_Bug.html, row is the offset of
+// the row the OAM search is on
+func oamWord(oam []uint8, i int) uint16 { return uint16(oam[i]) | uint16(oam[i+1])<<8 }
+
+func setOamWord(oam []uint8, i int, v uint16) { oam[i], oam[i+1] = uint8(v), uint8(v>>8) }
+
+func oamBugWrite(oam []uint8, row int) {
+	a, b, c := oamWord(oam, row), oamWord(oam, row-8), oamWord(oam, row-4)
+	setOamWord(oam, row, ((a^c)&(b^c))^c)
+	copy(oam[row+2:row+8], oam[row-6:row])
+}
+
+func oamBugRead(oam []uint8, row int) {
+	a, b, c := oamWord(oam, row), oamWord(oam, row-8), oamWord(oam, row-4)
+	setOamWord(oam, row, b|(a&c))
+	copy(oam[row+2:row+8], oam[row-6:row])
+}
+
+func oamBugReadIncrease(oam []uint8, row int) {
+	if row >= 4*8 && row < len(oam)-8 {
+		a, b, c, d := oamWord(oam, row-16), oamWord(oam, row-8), oamWord(oam, row), oamWord(oam, row-12)
+		setOamWord(oam, row-8, (b&(a|c|d))|(a&c&d))
+		copy(oam[row:row+8], oam[row-8:row])
+		copy(oam[row-16:row-8], oam[row-8:row])
+	}
+	oamBugRead(oam, row)
+}
+
+func TestOamBugPatterns(t *testing.T) {
+	tests := []struct {
+		name   string
+		row    int
+		access func(m *lib.MMU)
+		want   func(oam []uint8, row int)
+	}{
+		{"write", 5, func(m *lib.MMU) { m.Write(0xFE00, 0x42) }, oamBugWrite},
+		{"write to the unusable area", 9, func(m *lib.MMU) { m.Write(0xFEF0, 0x42) }, oamBugWrite},
+		{"16 bit increment", 12, func(m *lib.MMU) { m.OamBug(0xFE10, lib.OamBugWrite) }, oamBugWrite},
+		{"read", 5, func(m *lib.MMU) { m.Read(0xFE00) }, oamBugRead},
+		{"read during increase", 5, func(m *lib.MMU) {
+			m.OamBug(0xFE00, lib.OamBugReadIncrease)
+			m.Read(0xFE00)
+		}, oamBugReadIncrease},
+		{"read during increase in the first rows", 2, func(m *lib.MMU) {
+			m.OamBug(0xFE00, lib.OamBugReadIncrease)
+			m.Read(0xFE00)
+		}, oamBugRead},
+		{"read during increase in the last row", 19, func(m *lib.MMU) {
+			m.OamBug(0xFE00, lib.OamBugReadIncrease)
+			m.Read(0xFE00)
+		}, oamBugRead},
+		{"first row", 0, func(m *lib.MMU) { m.Write(0xFE00, 0x42) }, func([]uint8, int) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, ppu, want := oamBugBus(t)
+			ppu.Update(4 * test.row)
+			test.access(m)
+			if test.row > 0 {
+				test.want(want, test.row*8)
+			}
+
+			got := readOam(m)
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("OAM 0x%04X is 0x%02X, want 0x%02X", 0xFE00+i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// Only accesses during the OAM search corrupt OAM, and only on models with the bug
+func TestOamBugNoCorruption(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *lib.MMU, ppu *lib.PPU)
+	}{
+		{"pixel transfer", func(m *lib.MMU, ppu *lib.PPU) {
+			for m.Read(0xFF41)&0b11 != 3 {
+				ppu.Update(1)
+			}
+		}},
+		{"HBlank", func(m *lib.MMU, ppu *lib.PPU) {
+			for m.Read(0xFF41)&0b11 != 0 {
+				ppu.Update(1)
+			}
+		}},
+		{"no OAM bug", func(m *lib.MMU, ppu *lib.PPU) {
+			m.SetOamBug(false)
+			ppu.Update(4 * 5)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, ppu, want := oamBugBus(t)
+			test.setup(m, ppu)
+			m.Read(0xFE00)
+			m.Write(0xFE00, want[0]) //goes through in HBlank
+			m.OamBug(0xFE00, lib.OamBugWrite)
+
+			got := readOam(m)
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("OAM 0x%04X is 0x%02X, want 0x%02X", 0xFE00+i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// A DMG cart on CGB keeps the colors the boot ROM put in palette RAM, BGP picks among them
+func TestCgbCompatibilityPalettes(t *testing.T) {
+	colors := []uint16{0x7FFF, 0x03E0, 0x001F, 0x7C00}
+	boot := make([]uint8, lib.CGB_BOOT_ROM_SIZE)
+	code := []uint8{0x3E, 0x80, 0xE0, 0x68} //ld a,$80 / ldh [BCPS],a, auto increment
+	for _, c := range colors {
+		code = append(code, 0x3E, uint8(c), 0xE0, 0x69, 0x3E, uint8(c>>8), 0xE0, 0x69) //ldh [BCPD],a
+	}
+	code = append(code,
+		0x3E, 0x91, 0xE0, 0x40, //ld a,$91 / ldh [LCDC],a
+		0xC3, 0xFC, 0x00, //jp $FC
+	)
+	copy(boot, code)
+	copy(boot[0xFC:], []uint8{0x3E, 0x11, 0xE0, 0x50}) //ld a,$11 / ldh [$FF50],a, the cart starts at $100
+
+	rom := codeRom(t, append([]uint8{0x3E, 0x1B, 0xE0, 0x47}, nopLoop...)...) //ld a,$1B / ldh [BGP],a, color 0 is shade 3
+	e, err := lib.LoadEmulator(lib.WithCartBytes(rom), lib.WithBootRom(writeRom(t, "cgb_boot.bin", boot)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Model() != lib.ModelCGB {
+		t.Fatalf("running as %s", e.Model())
+	}
+	for i := 0; i < 5; i++ {
+		e.RunFrame()
+	}
+
+	want := lib.RGB555ToRGBA(colors[3])
+	img := e.FrameImage()
+	for _, p := range [][2]int{{0, 0}, {80, 72}, {159, 143}} {
+		if c := img.RGBAAt(p[0], p[1]); c != want {
+			t.Errorf("pixel %v is %v, want %v", p, c, want)
+		}
+	}
+}
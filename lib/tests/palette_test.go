@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePalette(t *testing.T, text string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "palette.txt")
+	if err := os.WriteFile(p, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadPaletteFile(t *testing.T) {
+	p, err := lib.LoadPaletteFile(writePalette(t, `// comment
+
+bg   E0F8D0 88C070 346856 081820
+OBJ0 #FFFFFF #FF8484 #943A3A #000000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bg := lib.Shades{{0xE0, 0xF8, 0xD0, 0xFF}, {0x88, 0xC0, 0x70, 0xFF}, {0x34, 0x68, 0x56, 0xFF}, {0x08, 0x18, 0x20, 0xFF}}
+	obj0 := lib.Shades{{0xFF, 0xFF, 0xFF, 0xFF}, {0xFF, 0x84, 0x84, 0xFF}, {0x94, 0x3A, 0x3A, 0xFF}, {0x00, 0x00, 0x00, 0xFF}}
+	if p.Bg != bg {
+		t.Errorf("bg is %v, want %v", p.Bg, bg)
+	}
+	if p.Obj0 != obj0 {
+		t.Errorf("obj0 is %v, want %v", p.Obj0, obj0)
+	}
+	if p.Obj1 != bg {
+		t.Errorf("obj1 is %v, want the bg colors", p.Obj1)
+	}
+
+	errors := []struct{ name, text, want string }{
+		{"no bg", "obj0 FFFFFF AAAAAA 555555 000000\n", "no bg line"},
+		{"unknown register", "bg FFFFFF AAAAAA 555555 000000\nwin FFFFFF AAAAAA 555555 000000\n", "line 2: unknown register win"},
+		{"short color", "bg FFFFFF AAAAAA 555 000000\n", "line 1: invalid color 555"},
+		{"not hex", "bg FFFFFF AAAAAA 55555G 000000\n", "line 1: invalid color 55555G"},
+		{"3 colors", "bg FFFFFF AAAAAA 555555\n", "line 1: expected a register and 4 colors"},
+	}
+	for _, test := range errors {
+		if _, err := lib.LoadPaletteFile(writePalette(t, test.text)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestFindPalette(t *testing.T) {
+	for name, want := range lib.DmgPalettes {
+		if p, err := lib.FindPalette(name); err != nil || p != want {
+			t.Errorf("preset %s: %v, %v", name, p, err)
+		}
+	}
+	if p, err := lib.FindPalette(writePalette(t, "bg 000000 000000 000000 000000\n")); err != nil || p.Obj1[0] != (color.RGBA{0, 0, 0, 0xFF}) {
+		t.Errorf("palette file: %v, %v", p, err)
+	}
+	if _, err := lib.FindPalette("sepia"); err == nil {
+		t.Error("no error for an unknown preset")
+	}
+}
+
+// Each pixel gets the colors of the palette register it went through
+func TestFrameImagePalette(t *testing.T) {
+	palette := lib.DmgPalette{
+		Bg:   lib.Shades{{0x10, 0, 0, 0xFF}, {0x11, 0, 0, 0xFF}, {0x12, 0, 0, 0xFF}, {0x13, 0, 0, 0xFF}},
+		Obj0: lib.Shades{{0, 0x20, 0, 0xFF}, {0, 0x21, 0, 0xFF}, {0, 0x22, 0, 0xFF}, {0, 0x23, 0, 0xFF}},
+		Obj1: lib.Shades{{0, 0, 0x30, 0xFF}, {0, 0, 0x31, 0xFF}, {0, 0, 0x32, 0xFF}, {0, 0, 0x33, 0xFF}},
+	}
+	//BGP 0xFC: color 0 is shade 0, the rest shade 3. OBP0 and OBP1 0xFF: shade 3
+	frame := spriteFrame(t, 0x13, [4]uint8{16, 8 + 16, 2, 0}, [4]uint8{16, 8 + 24, 2, 0x10})
+	img := frame.Image(&palette)
+
+	tests := []struct {
+		x    int
+		want color.RGBA
+	}{
+		{0, palette.Bg[0]}, {1, palette.Bg[3]}, {16, palette.Obj0[3]}, {24, palette.Obj1[3]},
+	}
+	for _, test := range tests {
+		if c := img.RGBAAt(test.x, 0); c != test.want {
+			t.Errorf("pixel %d is %v, want %v", test.x, c, test.want)
+		}
+	}
+}
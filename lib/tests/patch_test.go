@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gbemulator/lib"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+// Variable length number of UPS and BPS
+func vli(n int) []uint8 {
+	var b []uint8
+	for {
+		x := uint8(n & 0x7F)
+		n >>= 7
+		if n == 0 {
+			return append(b, x|0x80)
+		}
+		b = append(b, x)
+		n--
+	}
+}
+
+func join(parts ...[]uint8) []uint8 { return bytes.Join(parts, nil) }
+
+// CRC32 of the source, the target and everything before the patch checksum
+func withFooter(body, source, target []uint8) []uint8 {
+	p := binary.LittleEndian.AppendUint32(bytes.Clone(body), crc32.ChecksumIEEE(source))
+	p = binary.LittleEndian.AppendUint32(p, crc32.ChecksumIEEE(target))
+	return binary.LittleEndian.AppendUint32(p, crc32.ChecksumIEEE(p))
+}
+
+// 300 bytes, so the sizes take two bytes as numbers
+func patchSource() []uint8 {
+	rom := make([]uint8, 300)
+	for i := range rom {
+		rom[i] = uint8(i)
+	}
+	return rom
+}
+
+type patchTest struct {
+	name    string
+	rom     []uint8
+	patch   []uint8
+	want    []uint8
+	wantErr string
+}
+
+func runPatchTests(t *testing.T, tests []patchTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := bytes.Clone(test.rom)
+			got, err := lib.ApplyPatch(test.rom, test.patch)
+			if !bytes.Equal(test.rom, original) {
+				t.Error("the source ROM was changed")
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("got  %x\nwant %x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIpsPatch(t *testing.T) {
+	source := patchSource()
+	record := func(offset int, data ...uint8) []uint8 {
+		r := []uint8{uint8(offset >> 16), uint8(offset >> 8), uint8(offset), 0, uint8(len(data))}
+		return append(r, data...)
+	}
+	rle := func(offset, size int, v uint8) []uint8 {
+		return []uint8{uint8(offset >> 16), uint8(offset >> 8), uint8(offset), 0, 0, uint8(size >> 8), uint8(size), v}
+	}
+
+	//records inside the ROM, a run of 0xCC and one past the end growing it
+	want := append(bytes.Clone(source), 0, 0, 0, 0, 0x01, 0x02)
+	want[5], want[6] = 0xAA, 0xBB
+	copy(want[0x100:], []uint8{0xCC, 0xCC, 0xCC})
+
+	truncated := bytes.Clone(source[:0x10])
+	truncated[5] = 0xAA
+
+	runPatchTests(t, []patchTest{
+		{"valid", source, join([]uint8("PATCH"), record(5, 0xAA, 0xBB), rle(0x100, 3, 0xCC), record(304, 0x01, 0x02), []uint8("EOF")), want, ""},
+		{"truncate extension", source, join([]uint8("PATCH"), record(5, 0xAA), []uint8("EOF"), []uint8{0x00, 0x00, 0x10}), truncated, ""},
+		{"truncated record", source, join([]uint8("PATCH"), record(5, 0xAA, 0xBB)[:6]), nil, "truncated"},
+		{"truncated run", source, join([]uint8("PATCH"), rle(0x100, 3, 0xCC)[:7]), nil, "truncated"},
+		{"no EOF", source, join([]uint8("PATCH"), record(5, 0xAA)), nil, "truncated"},
+		{"unknown format", source, []uint8("NOTAPATCH"), nil, "unknown patch format"},
+	})
+}
+
+func TestUpsPatch(t *testing.T) {
+	source := patchSource()
+	target := append(bytes.Clone(source), make([]uint8, 10)...)
+	target[5], target[6] = 0xAA, 0xBB
+	target[200] = 0x11
+	target[305] = 0x42
+
+	//hunks of XORed bytes ending in 0, the skips count from the byte after the 0
+	hunks := join(
+		vli(5), []uint8{5 ^ 0xAA, 6 ^ 0xBB, 0},
+		vli(200-8), []uint8{200 ^ 0x11, 0},
+		vli(305-202), []uint8{0x42, 0},
+	)
+	body := join([]uint8("UPS1"), vli(len(source)), vli(len(target)), hunks)
+	valid := withFooter(body, source, target)
+
+	damaged := bytes.Clone(valid)
+	damaged[len(body)-2] ^= 0xFF
+
+	//sizes and skips of three bytes
+	big := make([]uint8, 20000)
+	bigTarget := bytes.Clone(big)
+	bigTarget[17000] = 0x01
+	bigBody := join([]uint8("UPS1"), vli(len(big)), vli(len(bigTarget)), vli(17000), []uint8{0x01, 0})
+
+	runPatchTests(t, []patchTest{
+		{"valid", source, valid, target, ""},
+		{"long numbers", big, withFooter(bigBody, big, bigTarget), bigTarget, ""},
+		{"truncated hunk", source, withFooter(body[:len(body)-1], source, target), nil, "truncated"},
+		{"truncated file", source, valid[:10], nil, "truncated"},
+		{"source checksum", source[:299], valid, nil, "different ROM"},
+		{"target checksum", source, withFooter(body, source, source), nil, "patched ROM checksum"},
+		{"patch checksum", source, damaged, nil, "damaged"},
+		{"endless number", source, withFooter(join([]uint8("UPS1"), bytes.Repeat([]uint8{0}, 20)), source, target), nil, "too large"},
+		{"huge target", source, withFooter(join([]uint8("UPS1"), vli(len(source)), vli(lib.MAX_PATCHED_ROM+1)), source, target), nil, "largest cart"},
+		{"skip past the end", source, withFooter(join([]uint8("UPS1"), vli(len(source)), vli(len(target)), vli(400), []uint8{1, 0}), source, target), nil, "past the end"},
+	})
+}
+
+func TestBpsPatch(t *testing.T) {
+	source := patchSource()
+	const (
+		sourceRead = iota
+		targetRead
+		sourceCopy
+		targetCopy
+	)
+	action := func(command, length int) []uint8 { return vli((length-1)<<2 | command) }
+	offset := func(delta int) []uint8 {
+		if delta < 0 {
+			return vli(-delta<<1 | 1)
+		}
+		return vli(delta << 1)
+	}
+
+	var target []uint8
+	target = append(target, source[0:4]...)
+	target = append(target, 0xAA, 0xBB, 0xCC)
+	target = append(target, source[200:205]...)
+	target = append(target, source[105:107]...)
+	target = append(target, target[4:10]...)
+	target = append(target, bytes.Repeat(target[19:20], 5)...)
+
+	actions := join(
+		action(sourceRead, 4),
+		action(targetRead, 3), []uint8{0xAA, 0xBB, 0xCC},
+		action(sourceCopy, 5), offset(200),
+		action(sourceCopy, 2), offset(-100), //from 205 back to 105
+		action(targetCopy, 6), offset(4),
+		action(targetCopy, 5), offset(9), //overlaps what it writes, a run of the last byte
+	)
+	header := join([]uint8("BPS1"), vli(len(source)), vli(len(target)), vli(3), []uint8("xyz"))
+	body := join(header, actions)
+	valid := withFooter(body, source, target)
+
+	damaged := bytes.Clone(valid)
+	damaged[len(header)] ^= 0xFF
+
+	runPatchTests(t, []patchTest{
+		{"valid", source, valid, target, ""},
+		{"truncated actions", source, withFooter(body[:len(body)-2], source, target), nil, "truncated"},
+		{"truncated file", source, valid[:8], nil, "truncated"},
+		{"copy outside the source", source, withFooter(join(header, action(sourceCopy, 4), offset(400)), source, target), nil, "outside the ROM"},
+		{"source checksum", source[:299], valid, nil, "different ROM"},
+		{"target checksum", source, withFooter(body, source, source), nil, "patched ROM checksum"},
+		{"patch checksum", source, damaged, nil, "damaged"},
+		{"endless number", source, withFooter(join(header, bytes.Repeat([]uint8{0}, 20)), source, target), nil, "too large"},
+		{"huge target", source, withFooter(join([]uint8("BPS1"), vli(len(source)), vli(lib.MAX_PATCHED_ROM+1), vli(0)), source, target), nil, "largest cart"},
+		{"metadata past the end", source, withFooter(join([]uint8("BPS1"), vli(len(source)), vli(len(target)), vli(1<<20)), source, target), nil, "truncated"},
+	})
+}
@@ -0,0 +1,517 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"testing"
+)
+
+// MMU and PPU with no cart and the LCD off
+func lcdBus(t *testing.T) (*lib.MMU, *lib.PPU) {
+	t.Helper()
+	ppu, err := lib.LoadPpu(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := lib.LoadBus(nil, nil, nil, ppu, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu.MMU = m
+	m.Write(0xFF40, 0x00)
+	return m, ppu
+}
+
+// Runs the PPU dot by dot until STAT shows the mode, returns the dots it took
+func waitMode(m *lib.MMU, ppu *lib.PPU, mode lib.PPUMode) int {
+	dots := 0
+	for lib.PPUMode(m.Read(0xFF41)&0b11) != mode {
+		ppu.Update(1)
+		dots++
+	}
+	return dots
+}
+
+// The CPU sees 0xFF and its writes are dropped while the PPU owns VRAM or OAM
+func TestVramOamBlocking(t *testing.T) {
+	tests := []struct {
+		name                    string
+		lcdOn                   bool
+		modes                   []lib.PPUMode
+		vramBlocked, oamBlocked bool
+	}{
+		{"LCD off", false, nil, false, false},
+		{"OAM search", true, []lib.PPUMode{lib.OamSearch}, false, true},
+		{"pixel transfer", true, []lib.PPUMode{lib.PixelTransfer}, true, true},
+		{"HBlank", true, []lib.PPUMode{lib.PixelTransfer, lib.HBlank}, false, false},
+		{"VBlank", true, []lib.PPUMode{lib.VBlank}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, ppu := lcdBus(t)
+			m.Write(0x8000, 0x11)
+			m.Write(0xFE00, 0x22)
+			if test.lcdOn {
+				m.Write(0xFF40, 0x91)
+			}
+			for _, mode := range test.modes {
+				waitMode(m, ppu, mode)
+			}
+
+			wantVram, wantOam := uint8(0x11), uint8(0x22)
+			if test.vramBlocked {
+				wantVram = 0xFF
+			}
+			if test.oamBlocked {
+				wantOam = 0xFF
+			}
+			if v := m.Read(0x8000); v != wantVram {
+				t.Errorf("VRAM reads 0x%02X, want 0x%02X", v, wantVram)
+			}
+			if v := m.Read(0xFE00); v != wantOam {
+				t.Errorf("OAM reads 0x%02X, want 0x%02X", v, wantOam)
+			}
+
+			m.Write(0x8000, 0x33)
+			m.Write(0xFE00, 0x44)
+			m.Write(0xFF40, 0x00)
+			wantVram, wantOam = 0x33, 0x44
+			if test.vramBlocked {
+				wantVram = 0x11
+			}
+			if test.oamBlocked {
+				wantOam = 0x22
+			}
+			if v := m.Read(0x8000); v != wantVram {
+				t.Errorf("VRAM holds 0x%02X after the write, want 0x%02X", v, wantVram)
+			}
+			if v := m.Read(0xFE00); v != wantOam {
+				t.Errorf("OAM holds 0x%02X after the write, want 0x%02X", v, wantOam)
+			}
+		})
+	}
+}
+
+// Mode 3 length of line 1 and the HBlank after it
+func mode3Length(t *testing.T, setup func(m *lib.MMU)) (transfer, hblank int) {
+	t.Helper()
+	m, ppu := lcdBus(t)
+	m.Write(0xFF40, 0x11)
+	setup(m)
+	m.Write(0xFF40, m.Read(0xFF40)|0x80)
+	waitMode(m, ppu, lib.OamSearch)
+	waitMode(m, ppu, lib.PixelTransfer)
+	transfer = waitMode(m, ppu, lib.HBlank)
+	hblank = waitMode(m, ppu, lib.OamSearch)
+	if transfer+hblank != lib.DOTS_PER_LINE-lib.OAM_SEARCH_DOTS {
+		t.Errorf("mode 3 and HBlank took %d dots, want %d", transfer+hblank, lib.DOTS_PER_LINE-lib.OAM_SEARCH_DOTS)
+	}
+	return transfer, hblank
+}
+
+// The fine scroll, the window and sprites make mode 3 longer and HBlank shorter
+func TestMode3Length(t *testing.T) {
+	base, _ := mode3Length(t, func(m *lib.MMU) {})
+	for scx := uint8(1); scx < 16; scx++ {
+		transfer, _ := mode3Length(t, func(m *lib.MMU) { m.Write(0xFF43, scx) })
+		if transfer != base+int(scx%8) {
+			t.Errorf("SCX %d: mode 3 took %d dots, want %d", scx, transfer, base+int(scx%8))
+		}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(m *lib.MMU)
+	}{
+		{"window", func(m *lib.MMU) {
+			m.Write(0xFF4A, 0)
+			m.Write(0xFF4B, 7+80)
+			m.Write(0xFF40, 0x31)
+		}},
+		{"sprite", func(m *lib.MMU) {
+			m.Write(0xFE00, 16)
+			m.Write(0xFE01, 8+80)
+			m.Write(0xFF40, 0x13)
+		}},
+		{"sprite off the left edge", func(m *lib.MMU) {
+			m.Write(0xFE00, 16)
+			m.Write(0xFE01, 0)
+			m.Write(0xFF40, 0x13)
+		}},
+	}
+	for _, test := range tests {
+		if transfer, _ := mode3Length(t, test.setup); transfer <= base {
+			t.Errorf("%s: mode 3 took %d dots, no longer than the %d without it", test.name, transfer, base)
+		}
+	}
+
+	//each sprite costs its own fetch
+	one, _ := mode3Length(t, tests[1].setup)
+	two, _ := mode3Length(t, func(m *lib.MMU) {
+		tests[1].setup(m)
+		m.Write(0xFE04, 16)
+		m.Write(0xFE05, 8+40)
+	})
+	if two <= one {
+		t.Errorf("mode 3 took %d dots with two sprites, %d with one", two, one)
+	}
+}
+
+// The STAT sources share one interrupt line, a source going high while another one holds it
+// requests nothing
+func TestStatInterruptLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources uint8
+		from    lib.PPUMode // IF is cleared in this mode of line 1
+		to      lib.PPUMode // the mode that follows it
+		want    bool
+	}{
+		{"OAM search", 0x20, lib.HBlank, lib.OamSearch, true},
+		{"HBlank", 0x08, lib.PixelTransfer, lib.HBlank, true},
+		{"HBlank then OAM search", 0x28, lib.HBlank, lib.OamSearch, false},
+		{"LYC then HBlank", 0x48, lib.PixelTransfer, lib.HBlank, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, ppu := lcdBus(t)
+			m.Write(0xFF45, 1)
+			m.Write(0xFF41, test.sources)
+			m.Write(0xFF40, 0x91)
+			waitMode(m, ppu, lib.OamSearch)
+			waitMode(m, ppu, lib.PixelTransfer)
+			waitMode(m, ppu, test.from)
+
+			m.Write(0xFF0F, 0x00)
+			waitMode(m, ppu, test.to)
+			if requested := m.Read(0xFF0F)&0x02 != 0; requested != test.want {
+				t.Errorf("STAT interrupt requested: %t, want %t", requested, test.want)
+			}
+		})
+	}
+}
+
+// LY reads 0 a few dots into line 153, the LYC comparison follows it
+func TestLy153(t *testing.T) {
+	m, ppu := lcdBus(t)
+	m.Write(0xFF45, 0)
+	m.Write(0xFF40, 0x91)
+	for m.Read(0xFF44) != 153 {
+		ppu.Update(1)
+	}
+	if m.Read(0xFF41)&0x04 != 0 {
+		t.Error("LYC=0 matched on line 153")
+	}
+
+	ppu.Update(lib.LY_153_WRAP_DOTS)
+	if ly := m.Read(0xFF44); ly != 0 {
+		t.Errorf("LY reads %d after %d dots of line 153", ly, lib.LY_153_WRAP_DOTS)
+	}
+	if mode := m.Read(0xFF41) & 0b11; mode != uint8(lib.VBlank) {
+		t.Errorf("mode %d, want VBlank for the rest of line 153", mode)
+	}
+	if m.Read(0xFF41)&0x04 == 0 {
+		t.Error("LYC=0 did not match once LY wrapped")
+	}
+
+	waitMode(m, ppu, lib.OamSearch)
+	if ly := m.Read(0xFF44); ly != 0 {
+		t.Errorf("LY reads %d on the next frame", ly)
+	}
+}
+
+func TestStatLyWrites(t *testing.T) {
+	m, ppu := lcdBus(t)
+	m.Write(0xFF45, 1)
+	m.Write(0xFF40, 0x91)
+	waitMode(m, ppu, lib.OamSearch)
+	waitMode(m, ppu, lib.PixelTransfer)
+
+	//mode and coincidence bits are read only, bit 7 reads 1
+	m.Write(0xFF41, 0x00)
+	if v := m.Read(0xFF41); v != 0x80|0x04|uint8(lib.PixelTransfer) {
+		t.Errorf("STAT reads 0x%02X after writing 0x00", v)
+	}
+	m.Write(0xFF41, 0xFF)
+	if v := m.Read(0xFF41); v != 0xFF {
+		t.Errorf("STAT reads 0x%02X after writing 0xFF", v)
+	}
+
+	m.Write(0xFF44, 0x42)
+	if v := m.Read(0xFF44); v != 1 {
+		t.Errorf("LY reads 0x%02X after a write, want 1", v)
+	}
+}
+
+// Turning the LCD off stops the PPU at line 0 in mode 0 and blanks the screen
+func TestLcdOff(t *testing.T) {
+	m, ppu := lcdBus(t)
+	m.Write(0xFF47, 0xFF)
+	m.Write(0xFF40, 0x91)
+	ppu.Update(lib.DOTS_PER_LINE * 160) //into the second frame
+	frames := ppu.FrameCount
+
+	m.Write(0xFF40, 0x11)
+	if ly := m.Read(0xFF44); ly != 0 {
+		t.Errorf("LY reads %d", ly)
+	}
+	if mode := m.Read(0xFF41) & 0b11; mode != uint8(lib.HBlank) {
+		t.Errorf("mode %d, want HBlank", mode)
+	}
+	if ppu.FrameCount != frames+1 {
+		t.Errorf("%d frames shown when the LCD went off, want the blank one", ppu.FrameCount-frames)
+	}
+	frame := ppu.Frame()
+	for _, p := range [][2]int{{0, 0}, {80, 72}, {159, 143}} {
+		if s := frame.Shade(p[0], p[1]); s != 0 {
+			t.Errorf("pixel %v has shade %d, want white", p, s)
+		}
+	}
+
+	m.Write(0xFF0F, 0x00)
+	ppu.Update(lib.DOTS_PER_LINE * lib.LINES_PER_FRAME * 2)
+	if m.Read(0xFF44) != 0 || m.Read(0xFF0F)&0x03 != 0 || ppu.FrameCount != frames+1 {
+		t.Errorf("the PPU ran with the LCD off: LY %d, IF 0x%02X", m.Read(0xFF44), m.Read(0xFF0F))
+	}
+}
+
+// Line 0 after turning the LCD on has no OAM search and is a few dots shorter
+func TestLcdOn(t *testing.T) {
+	m, ppu := lcdBus(t)
+	m.Write(0xFF41, 0x20)
+	m.Write(0xFF0F, 0x00)
+	m.Write(0xFF40, 0x91)
+	if ly, mode := m.Read(0xFF44), m.Read(0xFF41)&0b11; ly != 0 || mode != uint8(lib.HBlank) {
+		t.Errorf("LY %d in mode %d, want line 0 in HBlank", ly, mode)
+	}
+
+	hblank := waitMode(m, ppu, lib.PixelTransfer)
+	if hblank != lib.OAM_SEARCH_DOTS-lib.LCD_ON_SKIP_DOTS {
+		t.Errorf("mode 3 started after %d dots, want %d", hblank, lib.OAM_SEARCH_DOTS-lib.LCD_ON_SKIP_DOTS)
+	}
+	line := hblank + waitMode(m, ppu, lib.HBlank) + waitMode(m, ppu, lib.OamSearch)
+	if line != lib.DOTS_PER_LINE-lib.LCD_ON_SKIP_DOTS {
+		t.Errorf("line 0 took %d dots, want %d", line, lib.DOTS_PER_LINE-lib.LCD_ON_SKIP_DOTS)
+	}
+	if ly := m.Read(0xFF44); ly != 1 {
+		t.Errorf("LY reads %d after line 0", ly)
+	}
+	if m.Read(0xFF0F)&0x02 == 0 {
+		t.Error("no STAT interrupt for the OAM search of line 1")
+	}
+}
+
+// Tile 0 has color indices 0, 1, 2, 3 twice across each row, tile 1 is color 3 all over
+func fifoTiles(m *lib.MMU) {
+	for row := uint16(0); row < 8; row++ {
+		m.Write(0x8000+row*2, 0x55)
+		m.Write(0x8001+row*2, 0x33)
+		m.Write(0x8010+row*2, 0xFF)
+		m.Write(0x8011+row*2, 0xFF)
+	}
+}
+
+func fillMap(m *lib.MMU, base uint16, tileAt func(x int) uint8) {
+	for i := 0; i < 32*32; i++ {
+		m.Write(base+uint16(i), tileAt(i%32))
+	}
+}
+
+// Turns the LCD on and returns the second frame
+func renderFrame(m *lib.MMU, ppu *lib.PPU, lcdc uint8) *lib.FrameBuffer {
+	m.Write(0xFF40, lcdc|0x80)
+	ppu.Update(2 * lib.DOTS_PER_LINE * lib.LINES_PER_FRAME)
+	return ppu.Frame()
+}
+
+func TestFifoFineScroll(t *testing.T) {
+	for scx := 0; scx < 16; scx++ {
+		for _, sprite := range []bool{false, true} {
+			m, ppu := lcdBus(t)
+			fifoTiles(m)
+			fillMap(m, 0x9800, func(x int) uint8 { return uint8(x % 2) })
+			m.Write(0xFF43, uint8(scx))
+			if sprite { //transparent, only stalls the fetcher
+				m.Write(0xFE00, 16)
+				m.Write(0xFE01, 8+37)
+				m.Write(0xFE02, 2)
+			}
+			frame := renderFrame(m, ppu, 0x13)
+
+			for x := 0; x < lib.SCREEN_WIDTH; x++ {
+				bx := (x + scx) % 256
+				want := uint8(bx % 4)
+				if bx/8%2 == 1 {
+					want = 3
+				}
+				if got := frame.At(x, 0); got != want {
+					t.Fatalf("SCX %d, sprite %t: pixel %d has color %d, want %d", scx, sprite, x, got, want)
+				}
+			}
+		}
+	}
+}
+
+// The fetcher reads LCDC for every tile, switching the map in the middle of mode 3 shows on
+// the rest of the line
+func TestFifoMidLineWrite(t *testing.T) {
+	m, ppu := lcdBus(t)
+	fifoTiles(m)
+	fillMap(m, 0x9800, func(int) uint8 { return 1 })
+	fillMap(m, 0x9C00, func(int) uint8 { return 0 })
+	m.Write(0xFF40, 0x91)
+	ppu.Update(lib.DOTS_PER_LINE * lib.LINES_PER_FRAME)
+	waitMode(m, ppu, lib.PixelTransfer)
+	ppu.Update(80)
+	m.Write(0xFF40, 0x99)
+	ppu.Update(lib.DOTS_PER_LINE * lib.LINES_PER_FRAME)
+
+	frame := ppu.Frame()
+	y := 0
+	for x := 0; x < 8; x++ {
+		if c := frame.At(x, y); c != 3 {
+			t.Errorf("pixel %d has color %d before the write, want 3", x, c)
+		}
+	}
+	for x := lib.SCREEN_WIDTH - 8; x < lib.SCREEN_WIDTH; x++ {
+		if c := frame.At(x, y); c != uint8(x%4) {
+			t.Errorf("pixel %d has color %d after the write, want %d", x, c, x%4)
+		}
+	}
+	if c := frame.At(1, 1); c != 1 {
+		t.Errorf("the next line starts with color %d, want the second map", c)
+	}
+}
+
+func TestFifoWindow(t *testing.T) {
+	m, ppu := lcdBus(t)
+	fifoTiles(m)
+	fillMap(m, 0x9800, func(int) uint8 { return 0 })
+	fillMap(m, 0x9C00, func(int) uint8 { return 1 })
+	m.Write(0xFF4A, 10)
+	m.Write(0xFF4B, 7+83)
+	frame := renderFrame(m, ppu, 0x71)
+
+	for _, y := range []int{0, 9, 10, 143} {
+		for x := 0; x < lib.SCREEN_WIDTH; x++ {
+			want := uint8(x % 4)
+			if y >= 10 && x >= 83 {
+				want = 3
+			}
+			if c := frame.At(x, y); c != want {
+				t.Fatalf("pixel %d,%d has color %d, want %d", x, y, c, want)
+			}
+		}
+	}
+}
+
+// Renders sprites over a background of tile 0. Sprite tiles: 2 is color 1 all over, 3 color 2
+// and 4 color 3 on its left column only
+func spriteFrame(t *testing.T, lcdc uint8, sprites ...[4]uint8) *lib.FrameBuffer {
+	t.Helper()
+	m, ppu := lcdBus(t)
+	fifoTiles(m)
+	for row := uint16(0); row < 8; row++ {
+		m.Write(0x8020+row*2, 0xFF)
+		m.Write(0x8031+row*2, 0xFF)
+		m.Write(0x8040+row*2, 0x80)
+		m.Write(0x8041+row*2, 0x80)
+	}
+	fillMap(m, 0x9800, func(int) uint8 { return 0 })
+	for i, s := range sprites {
+		for j, v := range s {
+			m.Write(0xFE00+uint16(i*4+j), v)
+		}
+	}
+	return renderFrame(m, ppu, lcdc)
+}
+
+// Color of a screen pixel, -1 unless it came from a sprite. Sprite color 0 is transparent
+func spritePixel(frame *lib.FrameBuffer, x, y int) int {
+	if frame.Source(x, y) == lib.Bgp {
+		return -1
+	}
+	return int(frame.At(x, y))
+}
+
+// The first 10 sprites in OAM order that cover the line are drawn, whatever their X
+func TestSpriteLimit(t *testing.T) {
+	sprites := [][4]uint8{{16, 8 + 150, 2, 0}}
+	for i := 0; i < 10; i++ {
+		sprites = append(sprites, [4]uint8{16, uint8(8 + i*12), 2, 0})
+	}
+	frame := spriteFrame(t, 0x12, sprites...)
+	for i, s := range sprites {
+		want := 1
+		if i == 10 {
+			want = -1
+		}
+		if c := spritePixel(frame, int(s[1])-8, 0); c != want {
+			t.Errorf("sprite %d: color %d, want %d", i, c, want)
+		}
+	}
+}
+
+func TestSpriteOverlap(t *testing.T) {
+	frame := spriteFrame(t, 0x12,
+		[4]uint8{16, 8 + 24, 3, 0}, [4]uint8{16, 8 + 20, 2, 0}, //the lower X wins
+		[4]uint8{16, 8 + 60, 2, 0}, [4]uint8{16, 8 + 60, 3, 0}, //same X, the lower OAM index wins
+	)
+	tests := []struct{ x, want int }{
+		{20, 1}, {23, 1}, {24, 1}, {27, 1}, {28, 2}, {31, 2},
+		{60, 1}, {67, 1},
+	}
+	for _, test := range tests {
+		if c := spritePixel(frame, test.x, 0); c != test.want {
+			t.Errorf("pixel %d has color %d, want %d", test.x, c, test.want)
+		}
+	}
+}
+
+func TestSpriteFlipAndSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		lcdc   uint8
+		sprite [4]uint8
+		want   map[[2]int]int
+	}{
+		{"x flip", 0x12, [4]uint8{16, 8, 4, 0x20}, map[[2]int]int{{0, 0}: -1, {7, 0}: 3, {7, 7}: 3, {7, 8}: -1}},
+		{"no flip", 0x12, [4]uint8{16, 8, 4, 0}, map[[2]int]int{{0, 0}: 3, {7, 0}: -1}},
+		//bit 0 of the tile index is ignored, the bottom half uses the next tile
+		{"8x16", 0x16, [4]uint8{16, 8, 5, 0}, map[[2]int]int{{0, 0}: 3, {0, 7}: 3, {0, 8}: -1, {1, 0}: -1}},
+		{"8x16 y flip", 0x16, [4]uint8{16, 8, 2, 0x40}, map[[2]int]int{{1, 0}: 2, {1, 7}: 2, {1, 8}: 1, {1, 15}: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := spriteFrame(t, test.lcdc, test.sprite)
+			for p, want := range test.want {
+				if c := spritePixel(frame, p[0], p[1]); c != want {
+					t.Errorf("pixel %v has color %d, want %d", p, c, want)
+				}
+			}
+		})
+	}
+}
+
+// Sprites with the priority bit only show over background color 0, unless the background is off
+func TestSpriteBgPriority(t *testing.T) {
+	frame := spriteFrame(t, 0x13, [4]uint8{16, 8, 2, 0x80}, [4]uint8{16, 8 + 8, 2, 0})
+	for x := 0; x < 8; x++ {
+		want := -1
+		if x%4 == 0 {
+			want = 1
+		}
+		if c := spritePixel(frame, x, 0); c != want {
+			t.Errorf("pixel %d has color %d behind the background, want %d", x, c, want)
+		}
+		if c := spritePixel(frame, 8+x, 0); c != 1 {
+			t.Errorf("pixel %d has color %d without the priority bit, want 1", 8+x, c)
+		}
+	}
+
+	frame = spriteFrame(t, 0x12, [4]uint8{16, 8, 2, 0x80})
+	for x := 0; x < 8; x++ {
+		if c := spritePixel(frame, x, 0); c != 1 {
+			t.Errorf("pixel %d has color %d with the background off, want 1", x, c)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"gbemulator/lib"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const specialRom = "../../roms/01-special.gb"
+
+func zipRom(t *testing.T, name string, rom []uint8) []uint8 {
+	t.Helper()
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	readme, err := z.Create("readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readme.Write([]uint8("not a rom"))
+	f, err := z.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rom)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func gzipRom(t *testing.T, rom []uint8) []uint8 {
+	t.Helper()
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	z.Write(rom)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestUnpackRom(t *testing.T) {
+	rom, err := os.ReadFile(specialRom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []uint8
+	}{
+		{"raw", rom},
+		{"zip", zipRom(t, "01-special.gb", rom)},
+		{"gzip", gzipRom(t, rom)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := lib.UnpackRom(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, rom) {
+				t.Errorf("got %d bytes, want the %d of the ROM", len(got), len(rom))
+			}
+
+			//the content decides, not the extension
+			got, err = lib.ReadRom(writeRom(t, "rom.gb", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, rom) {
+				t.Errorf("file: got %d bytes, want the %d of the ROM", len(got), len(rom))
+			}
+		})
+	}
+
+	if _, err := lib.UnpackRom(zipRom(t, "readme.md", rom)); err == nil {
+		t.Error("zip without a .gb file unpacked")
+	}
+	if _, err := lib.UnpackRom([]uint8{0x1F, 0x8B, 0x00}); err == nil {
+		t.Error("broken gzip unpacked")
+	}
+}
+
+// Archives in memory run like the plain ROM
+func TestWithCartArchives(t *testing.T) {
+	rom, err := os.ReadFile(specialRom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		option func(*lib.Emulator)
+	}{
+		{"bytes", lib.WithCartBytes(rom)},
+		{"zip bytes", lib.WithCartBytes(zipRom(t, "01-special.gb", rom))},
+		{"gzip bytes", lib.WithCartBytes(gzipRom(t, rom))},
+		{"reader", lib.WithCartReader(bytes.NewReader(rom))},
+		{"zip reader", lib.WithCartReader(bytes.NewReader(zipRom(t, "01-special.gb", rom)))},
+		{"gzip reader", lib.WithCartReader(bytes.NewReader(gzipRom(t, rom)))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := lib.LoadEmulator(test.option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := e.RunHeadless(lib.HeadlessOptions{Frames: 600, SerialMatch: regexp.MustCompile("01-special")})
+			if r.Reason != lib.StopSerialMatch {
+				t.Errorf("stopped with %s, serial %q", r.Reason, e.SerialOutput())
+			}
+		})
+	}
+}
+
+// Short ROMs fail to load instead of panicking on the first read past their end
+func TestTruncatedRom(t *testing.T) {
+	declared := headerRom(t, "BIG")
+	declared[0x148] = 0x02 //128 KiB
+	declared[0x147] = 0x01 //MBC1
+	fixChecksums(declared)
+
+	tests := []struct {
+		name    string
+		rom     []uint8
+		wantErr string
+	}{
+		{"32 KiB", headerRom(t, "OK"), ""},
+		{"512 bytes", headerRom(t, "SHORT")[:512], "ROM has 512 bytes"},
+		{"under the header size", declared, "header declares 131072 bytes of ROM, the file has 32768"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := lib.LoadEmulator(lib.WithCartBytes(test.rom))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
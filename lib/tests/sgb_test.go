@@ -0,0 +1,408 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Bus with a Super Game Boy on P1 and the LCD off
+func sgbBus(t *testing.T) (*lib.MMU, *lib.PPU, *lib.SGB) {
+	t.Helper()
+	ppu, err := lib.LoadPpu(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgb := lib.LoadSgb()
+	m, err := lib.LoadBus(nil, nil, nil, ppu, false, sgb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu.MMU = m
+	m.Write(0xFF40, 0x00)
+	return m, ppu, sgb
+}
+
+// Pulses a packet on P1 like games do: a reset, 128 bits on P14 (0) or P15 (1), then the
+// stop bit
+func sendPacket(m *lib.MMU, packet []uint8, stop uint8) {
+	m.Write(0xFF00, 0x00)
+	m.Write(0xFF00, 0x30)
+	pulse := func(bit uint8) {
+		m.Write(0xFF00, [2]uint8{0x20, 0x10}[bit])
+		m.Write(0xFF00, 0x30)
+	}
+	for i := 0; i < lib.SGB_PACKET_SIZE*8; i++ {
+		pulse(packet[i/8] >> (i % 8) & 1)
+	}
+	pulse(stop)
+}
+
+// Sends a command with as many packets as its data needs
+func sendCommand(m *lib.MMU, command lib.SgbCommand, data ...uint8) {
+	packets := (len(data) + lib.SGB_PACKET_SIZE) / lib.SGB_PACKET_SIZE
+	buf := make([]uint8, packets*lib.SGB_PACKET_SIZE)
+	buf[0] = uint8(command)<<3 | uint8(packets)
+	copy(buf[1:], data)
+	for i := 0; i < packets; i++ {
+		sendPacket(m, buf[i*lib.SGB_PACKET_SIZE:(i+1)*lib.SGB_PACKET_SIZE], 0)
+	}
+}
+
+// Shows the tiles at 0x8000 for two frames, tileAt picks the tile of each map cell
+func showTiles(m *lib.MMU, ppu *lib.PPU, tiles []uint8, tileAt func(x, y int) uint8) {
+	m.Write(0xFF40, 0x00)
+	for i, v := range tiles {
+		m.Write(0x8000+uint16(i), v)
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			m.Write(0x9800+uint16(y*32+x), tileAt(x, y))
+		}
+	}
+	m.Write(0xFF47, 0xE4) //shades match the color indices
+	m.Write(0xFF40, 0x91)
+	ppu.Update(2 * lib.DOTS_PER_LINE * lib.LINES_PER_FRAME)
+}
+
+// Shows 4 KiB the way games do for the *_TRN commands, 20 tiles per row, then sends the
+// command and runs the frame it reads
+func sendTransfer(m *lib.MMU, ppu *lib.PPU, data []uint8, command lib.SgbCommand, args ...uint8) {
+	showTiles(m, ppu, data, func(x, y int) uint8 { return uint8(y*lib.SGB_CELLS_X + x) })
+	sendCommand(m, command, args...)
+	ppu.Update(lib.DOTS_PER_LINE * lib.LINES_PER_FRAME)
+}
+
+// Frame where every cell has shades 0, 1, 2 and 3 from left to right, 2 pixels each
+func sgbPattern(m *lib.MMU, ppu *lib.PPU) *lib.FrameBuffer {
+	tile := make([]uint8, 16)
+	for row := 0; row < 8; row++ {
+		tile[row*2], tile[row*2+1] = 0x33, 0x0F
+	}
+	showTiles(m, ppu, tile, func(x, y int) uint8 { return 0 })
+	frame := *ppu.Frame()
+	return &frame
+}
+
+// Distinct colors 1-3 for each palette
+func sgbColor(palette, shade int) uint16 {
+	return uint16(palette+1)<<10 | uint16(shade)<<5 | uint16(palette*4+shade)
+}
+
+func sgbTestPalettes(m *lib.MMU) {
+	data := func(a, b int) []uint8 {
+		d := []uint8{0xFF, 0x7F}
+		for _, p := range []int{a, b} {
+			for shade := 1; shade < 4; shade++ {
+				c := sgbColor(p, shade)
+				d = append(d, uint8(c), uint8(c>>8))
+			}
+		}
+		return d
+	}
+	sendCommand(m, lib.SgbPal01, data(0, 1)...)
+	sendCommand(m, lib.SgbPal23, data(2, 3)...)
+}
+
+// Color of a shade in a cell of the game screen
+func sgbShade(img *image.RGBA, x, y, shade int) color.RGBA {
+	return img.RGBAAt(lib.SGB_SCREEN_X+x*8+shade*2, lib.SGB_SCREEN_Y+y*8)
+}
+
+// Palette of a cell, told apart by shade 3 after sgbTestPalettes
+func sgbCellPalette(img *image.RGBA, x, y int) int {
+	c := sgbShade(img, x, y, 3)
+	for p := 0; p < 4; p++ {
+		if c == lib.RGB555ToRGBA(sgbColor(p, 3)) {
+			return p
+		}
+	}
+	return -1
+}
+
+func TestSgbPacketDecoding(t *testing.T) {
+	m, ppu, sgb := sgbBus(t)
+	frame := sgbPattern(m, ppu)
+	pal01 := func(color0 uint16) []uint8 {
+		return []uint8{uint8(lib.SgbPal01)<<3 | 1, uint8(color0), uint8(color0 >> 8), 0x1F, 0x00, 0x00, 0x00, 0x00, 0x7C,
+			0, 0, 0, 0, 0, 0, 0}
+	}
+	color0 := func() color.RGBA { return sgbShade(sgb.Image(frame), 0, 0, 0) }
+
+	sendPacket(m, pal01(0x03E0), 0)
+	if c := color0(); c != lib.RGB555ToRGBA(0x03E0) {
+		t.Fatalf("color 0 is %v after PAL01", c)
+	}
+	want := []uint16{0x03E0, 0x001F, 0x0000, 0x7C00}
+	for shade, c := range want {
+		if got := sgbShade(sgb.Image(frame), 0, 0, shade); got != lib.RGB555ToRGBA(c) {
+			t.Errorf("shade %d is %v, want %v", shade, got, lib.RGB555ToRGBA(c))
+		}
+	}
+
+	//a 1 where the stop bit goes drops the packet
+	sendPacket(m, pal01(0x001F), 1)
+	if c := color0(); c != lib.RGB555ToRGBA(0x03E0) {
+		t.Errorf("packet with a bad stop bit was used, color 0 is %v", c)
+	}
+
+	//bits only count after a reset
+	m.Write(0xFF00, 0x30)
+	packet := pal01(0x001F)
+	for i := 0; i <= lib.SGB_PACKET_SIZE*8; i++ {
+		if i < lib.SGB_PACKET_SIZE*8 && packet[i/8]>>(i%8)&1 == 1 {
+			m.Write(0xFF00, 0x10)
+		} else {
+			m.Write(0xFF00, 0x20)
+		}
+		m.Write(0xFF00, 0x30)
+	}
+	if c := color0(); c != lib.RGB555ToRGBA(0x03E0) {
+		t.Errorf("packet without a reset was used, color 0 is %v", c)
+	}
+}
+
+func TestSgbMultiPacketCommand(t *testing.T) {
+	m, ppu, sgb := sgbBus(t)
+	frame := sgbPattern(m, ppu)
+	sgbTestPalettes(m)
+
+	//ATTR_BLK with 3 data sets takes 2 packets
+	data := []uint8{uint8(lib.SgbAttrBlk)<<3 | 2, 3,
+		0b111, 3<<4 | 2<<2 | 1, 2, 2, 6, 6, //inside 1, border 2, outside 3
+		0b001, 2, 10, 10, 12, 12, //inside only, the border takes the inside palette
+		0b010, 0, 14, 0, 16, 2, //border only
+	}
+	packets := make([]uint8, 2*lib.SGB_PACKET_SIZE)
+	copy(packets, data)
+
+	sendPacket(m, packets[:lib.SGB_PACKET_SIZE], 0)
+	img := sgb.Image(frame)
+	for _, cell := range [][2]int{{0, 0}, {4, 4}, {2, 2}} {
+		if p := sgbCellPalette(img, cell[0], cell[1]); p != 0 {
+			t.Fatalf("cell %v uses palette %d after the first packet", cell, p)
+		}
+	}
+
+	sendPacket(m, packets[lib.SGB_PACKET_SIZE:], 0)
+	img = sgb.Image(frame)
+	tests := []struct {
+		cell    [2]int
+		palette int
+	}{
+		{[2]int{4, 4}, 1}, {[2]int{2, 2}, 2}, {[2]int{6, 3}, 2}, {[2]int{0, 0}, 3}, {[2]int{19, 17}, 3},
+		{[2]int{11, 11}, 2}, {[2]int{10, 10}, 2},
+		{[2]int{14, 0}, 0}, {[2]int{15, 1}, 3},
+	}
+	for _, test := range tests {
+		if p := sgbCellPalette(img, test.cell[0], test.cell[1]); p != test.palette {
+			t.Errorf("cell %v uses palette %d, want %d", test.cell, p, test.palette)
+		}
+	}
+}
+
+func TestSgbAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		command lib.SgbCommand
+		data    []uint8
+		cells   map[[2]int]int
+	}{
+		{"ATTR_LIN", lib.SgbAttrLin, []uint8{2, 0x80 | 1<<5 | 3, 2<<5 | 5}, //row 3 gets 1, then column 5 gets 2
+			map[[2]int]int{{0, 3}: 1, {19, 3}: 1, {5, 0}: 2, {5, 3}: 2, {5, 17}: 2, {0, 0}: 0}},
+		{"ATTR_DIV", lib.SgbAttrDiv, []uint8{0x40 | 3<<4 | 2<<2 | 1, 9}, //rows above 9 get 2, row 9 gets 3, below 1
+			map[[2]int]int{{0, 0}: 2, {19, 8}: 2, {0, 9}: 3, {19, 9}: 3, {0, 10}: 1, {19, 17}: 1}},
+		{"ATTR_DIV vertical", lib.SgbAttrDiv, []uint8{3<<4 | 2<<2 | 1, 9},
+			map[[2]int]int{{8, 0}: 2, {9, 17}: 3, {10, 0}: 1}},
+		{"ATTR_CHR", lib.SgbAttrChr, []uint8{18, 0, 5, 0, 0, 0b01_10_11_01, 0b10 << 6}, //wraps to the next row
+			map[[2]int]int{{17, 0}: 0, {18, 0}: 1, {19, 0}: 2, {0, 1}: 3, {1, 1}: 1, {2, 1}: 2, {3, 1}: 0}},
+		{"ATTR_CHR vertical", lib.SgbAttrChr, []uint8{0, 16, 3, 0, 1, 0b11_11_11 << 2},
+			map[[2]int]int{{0, 16}: 3, {0, 17}: 3, {1, 0}: 3, {1, 1}: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, ppu, sgb := sgbBus(t)
+			frame := sgbPattern(m, ppu)
+			sgbTestPalettes(m)
+			sendCommand(m, test.command, test.data...)
+
+			img := sgb.Image(frame)
+			for cell, want := range test.cells {
+				if p := sgbCellPalette(img, cell[0], cell[1]); p != want {
+					t.Errorf("cell %v uses palette %d, want %d", cell, p, want)
+				}
+			}
+		})
+	}
+}
+
+// PAL01, PAL23, PAL03 and PAL12 set colors 1-3 of two palettes and color 0 of all four
+func TestSgbPalettes(t *testing.T) {
+	tests := []struct {
+		command lib.SgbCommand
+		a, b    int
+	}{
+		{lib.SgbPal01, 0, 1}, {lib.SgbPal23, 2, 3}, {lib.SgbPal03, 0, 3}, {lib.SgbPal12, 1, 2},
+	}
+	for _, test := range tests {
+		m, ppu, sgb := sgbBus(t)
+		frame := sgbPattern(m, ppu)
+		//column p uses palette p
+		sendCommand(m, lib.SgbAttrLin, 4, 0<<5|0, 1<<5|1, 2<<5|2, 3<<5|3)
+		before := sgb.Image(frame)
+
+		data := []uint8{0x1F, 0x00}
+		for _, p := range []int{test.a, test.b} {
+			for shade := 1; shade < 4; shade++ {
+				c := sgbColor(p, shade)
+				data = append(data, uint8(c), uint8(c>>8))
+			}
+		}
+		sendCommand(m, test.command, data...)
+
+		img := sgb.Image(frame)
+		for p := 0; p < 4; p++ {
+			if c := sgbShade(img, p, 0, 0); c != lib.RGB555ToRGBA(0x001F) {
+				t.Errorf("command %02X: color 0 of palette %d is %v", test.command, p, c)
+			}
+			for shade := 1; shade < 4; shade++ {
+				want := sgbShade(before, p, 0, shade)
+				if p == test.a || p == test.b {
+					want = lib.RGB555ToRGBA(sgbColor(p, shade))
+				}
+				if c := sgbShade(img, p, 0, shade); c != want {
+					t.Errorf("command %02X: shade %d of palette %d is %v, want %v", test.command, shade, p, c, want)
+				}
+			}
+		}
+		if c := img.RGBAAt(0, 0); c != lib.RGB555ToRGBA(0x001F) {
+			t.Errorf("command %02X: backdrop is %v", test.command, c)
+		}
+	}
+}
+
+// PAL_TRN loads the system palettes from the screen, PAL_SET picks four of them
+func TestSgbPalSet(t *testing.T) {
+	m, ppu, sgb := sgbBus(t)
+	frame := sgbPattern(m, ppu)
+
+	system := map[int][4]uint16{
+		5:   {0x0421, 0x0842, 0x0C63, 0x1084},
+		300: {0x7FFF, 0x001F, 0x03E0, 0x7C00},
+	}
+	data := make([]uint8, lib.SGB_TRANSFER_SIZE)
+	for n, colors := range system {
+		for i, c := range colors {
+			data[n*8+i*2], data[n*8+i*2+1] = uint8(c), uint8(c>>8)
+		}
+	}
+	sendTransfer(m, ppu, data, lib.SgbPalTrn)
+
+	sendCommand(m, lib.SgbMaskEn, uint8(lib.MaskBlack))
+	sendCommand(m, lib.SgbAttrLin, 1, 1<<5|1) //column 1 uses palette 1
+	sendCommand(m, lib.SgbPalSet, 5, 0, 44, 1, 5, 0, 5, 0, 0x40)
+
+	img := sgb.Image(frame)
+	for shade := 0; shade < 4; shade++ {
+		if c := sgbShade(img, 0, 0, shade); c != lib.RGB555ToRGBA(system[5][shade]) {
+			t.Errorf("palette 0 shade %d is %v", shade, c)
+		}
+		want := system[300][shade]
+		if shade == 0 {
+			want = system[5][0] //color 0 comes from palette 0
+		}
+		if c := sgbShade(img, 1, 0, shade); c != lib.RGB555ToRGBA(want) {
+			t.Errorf("palette 1 shade %d is %v, want %v", shade, c, lib.RGB555ToRGBA(want))
+		}
+	}
+}
+
+func TestSgbMask(t *testing.T) {
+	m, ppu, sgb := sgbBus(t)
+	frame := sgbPattern(m, ppu)
+	sgbTestPalettes(m)
+
+	sendCommand(m, lib.SgbMaskEn, uint8(lib.MaskBlack))
+	if c := sgbShade(sgb.Image(frame), 0, 0, 3); c != (color.RGBA{0, 0, 0, 0xFF}) {
+		t.Errorf("black mask shows %v", c)
+	}
+	sendCommand(m, lib.SgbMaskEn, uint8(lib.MaskColor0))
+	if c := sgbShade(sgb.Image(frame), 0, 0, 3); c != lib.RGB555ToRGBA(0x7FFF) {
+		t.Errorf("color 0 mask shows %v", c)
+	}
+	sendCommand(m, lib.SgbMaskEn, uint8(lib.MaskNone))
+	if c := sgbShade(sgb.Image(frame), 0, 0, 3); c != lib.RGB555ToRGBA(sgbColor(0, 3)) {
+		t.Errorf("unmasked screen shows %v", c)
+	}
+}
+
+// MLT_REQ turns on multiplayer, P1 then reads the controller and releasing P15 moves on
+func TestSgbMultiplayer(t *testing.T) {
+	tests := []struct {
+		mode uint8
+		ids  []uint8
+	}{
+		{0, []uint8{0, 0, 0}},
+		{1, []uint8{0, 1, 0, 1}},
+		{3, []uint8{0, 1, 2, 3, 0}},
+	}
+	for _, test := range tests {
+		m, _, _ := sgbBus(t)
+		sendCommand(m, lib.SgbMltReq, test.mode)
+		for i, id := range test.ids {
+			if i > 0 {
+				m.Write(0xFF00, 0x10)
+				m.Write(0xFF00, 0x30)
+			}
+			if v := m.Read(0xFF00); v != 0xFF&^id {
+				t.Errorf("mode %d step %d: P1 reads 0x%02X, want 0x%02X", test.mode, i, v, 0xFF&^id)
+			}
+		}
+	}
+}
+
+// CHR_TRN and PCT_TRN load the border tiles, map and palettes from the screen
+func TestSgbBorder(t *testing.T) {
+	m, ppu, sgb := sgbBus(t)
+	frame := sgbPattern(m, ppu)
+	sgbTestPalettes(m)
+
+	tiles := make([]uint8, lib.SGB_TRANSFER_SIZE)
+	for row := 0; row < 8; row++ {
+		tiles[1*32+row*2] = 0xFF //tile 1 is color 1 all over
+		tiles[2*32+row*2] = 0x80 //tile 2 has color 1 on its left column
+	}
+	sendTransfer(m, ppu, tiles, lib.SgbChrTrn, 0)
+
+	picture := make([]uint8, lib.SGB_TRANSFER_SIZE)
+	entry := func(i int, v uint16) { picture[i*2], picture[i*2+1] = uint8(v), uint8(v>>8) }
+	entry(0, 1|4<<10)        //palette 4
+	entry(1, 1)              //palettes 0-3 are not drawn
+	entry(2, 2|5<<10|0x4000) //x flipped
+	entry(32, 2|5<<10)
+	setColor := func(palette, index int, c uint16) {
+		picture[0x800+(palette-4)*32+index*2], picture[0x800+(palette-4)*32+index*2+1] = uint8(c), uint8(c>>8)
+	}
+	setColor(4, 1, 0x001F)
+	setColor(5, 1, 0x7C00)
+	sendTransfer(m, ppu, picture, lib.SgbPctTrn)
+
+	img := sgb.Image(frame)
+	backdrop := lib.RGB555ToRGBA(0x7FFF)
+	tests := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, lib.RGB555ToRGBA(0x001F)}, {7, 7, lib.RGB555ToRGBA(0x001F)},
+		{8, 0, backdrop},
+		{16, 0, backdrop}, {23, 0, lib.RGB555ToRGBA(0x7C00)},
+		{0, 8, lib.RGB555ToRGBA(0x7C00)}, {7, 8, backdrop},
+		{lib.SGB_SCREEN_X + 6, lib.SGB_SCREEN_Y, lib.RGB555ToRGBA(sgbColor(0, 3))}, //the game screen shows through
+	}
+	for _, test := range tests {
+		if c := img.RGBAAt(test.x, test.y); c != test.want {
+			t.Errorf("pixel %d,%d is %v, want %v", test.x, test.y, c, test.want)
+		}
+	}
+}
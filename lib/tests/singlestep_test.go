@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"gbemulator/lib"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Vectors in the SingleStepTests sm83 format, see roms/sm83/gen.go
+const singleStepDir = "../../roms/sm83/v1"
+
+// Every implemented opcode against its vector file, on a flat test bus
+func TestSingleStep(t *testing.T) {
+	if _, err := os.Stat(singleStepDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range lib.SingleStepOpcodes() {
+		op := op
+		t.Run(op, func(t *testing.T) {
+			t.Parallel()
+			tests, err := lib.LoadSingleStepTests(filepath.Join(singleStepDir, op+".json"))
+			if os.IsNotExist(err) {
+				t.Skip("no vectors for", op)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			failed := 0
+			for _, test := range tests {
+				if err := lib.RunSingleStep(test); err != nil {
+					if failed < 5 {
+						t.Errorf("%s: %v", test.Name, err)
+					}
+					failed++
+				}
+			}
+			if failed > 0 {
+				t.Errorf("%d/%d failed", failed, len(tests))
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+//go:build !headless
+
+// Window for the emulator, the only part that needs ebiten and so cgo and X11 on Linux.
+// Builds with the headless tag leave it out
+package ui
+
+import (
+	"gbemulator/lib"
+	"image"
+	"image/draw"
+	"log"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+const (
+	UI_SCALE        = 2
+	TILE_VIEWER_GAP = 2 // tiles between the game screen and the tile viewer
+	MAX_FRAME_SKIP  = 4 // frames run in one update to catch up, a slower host runs slower
+)
+
+// 59.73 Hz, the LCD refresh rate
+const FRAME_TIME = time.Second * lib.DOTS_PER_LINE * lib.LINES_PER_FRAME / lib.CLOCKSPEED
+
+type Screen struct {
+	emulator    *lib.Emulator
+	debugging   bool
+	image       *image.RGBA // game screen on the left, tile viewer on the right
+	tileViewerX int         // in tiles
+	lastUpdate  time.Time
+	behind      time.Duration // emulated time still owed to the wall clock
+}
+
+func (s *Screen) Draw(screen *ebiten.Image) {
+	frame := s.emulator.ScreenImage()
+	draw.Draw(s.image, frame.Bounds(), frame, image.Point{}, draw.Src)
+
+	//debug
+	var tileNum int = 0
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 16; x++ {
+			s.emulator.DebugDisplayTile(s.image, tileNum, x+s.tileViewerX, y)
+			tileNum++
+		}
+	}
+
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(UI_SCALE, UI_SCALE)
+	image := ebiten.NewImageFromImage(s.image)
+	screen.DrawImage(image, op)
+}
+
+func (s *Screen) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
+	size := s.image.Bounds().Size()
+	return size.X * UI_SCALE, size.Y * UI_SCALE
+}
+
+// Updates come as often as the display refreshes, each runs the frames due by the wall
+// clock since the last one
+func (s *Screen) Update() error {
+	now := time.Now()
+	if !s.lastUpdate.IsZero() {
+		s.behind += now.Sub(s.lastUpdate)
+	}
+	s.lastUpdate = now
+
+	for frames := 0; s.behind >= FRAME_TIME && frames < MAX_FRAME_SKIP; frames++ {
+		s.emulator.RunFrame()
+		s.behind -= FRAME_TIME
+	}
+	s.behind = min(s.behind, FRAME_TIME)
+	return nil
+}
+
+func RunGame(e *lib.Emulator) {
+	width, height := lib.SCREEN_WIDTH, lib.SCREEN_HEIGHT
+	if e.SgbImage() != nil {
+		width, height = lib.SGB_WIDTH, lib.SGB_HEIGHT
+	}
+
+	tileViewerX := width/8 + TILE_VIEWER_GAP
+	size := image.Point{tileViewerX*8 + 16*8, max(height, 24*8)}
+	screen := &Screen{
+		emulator:    e,
+		image:       image.NewRGBA(image.Rectangle{image.Point{0, 0}, size}),
+		tileViewerX: tileViewerX,
+	}
+	ebiten.SetWindowSize(size.X*UI_SCALE, size.Y*UI_SCALE)
+	ebiten.SetWindowTitle("GBEmulator")
+
+	ebiten.SetTPS(ebiten.SyncWithFPS)
+	if err := ebiten.RunGame(screen); err != nil {
+		log.Fatal(err)
+	}
+}
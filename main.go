@@ -1,28 +1,114 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"gbemulator/lib"
 	"os"
 )
 
+var (
+	palette       = flag.String("palette", "grey", "color preset (grey, dmg, pocket, light, contrast) or palette file")
+	sgb           = flag.Bool("sgb", false, "run as a Super Game Boy when the cart supports it")
+	model         = flag.String("model", "", "hardware to emulate (DMG0, DMG, MGB, SGB, SGB2, CGB, AGB), picked from the cart by default")
+	patch         = flag.String("patch", "", "IPS, UPS or BPS patch to apply, by default one with the ROM's name is used")
+	boot          = flag.String("boot", "", "boot ROM to run before the cart (256 bytes for DMG/MGB/SGB, 2304 for CGB)")
+	doctor        = flag.String("doctor", "", "write a Gameboy Doctor log to this file, LY reads 0x90 while logging")
+	compare       = flag.String("doctor-compare", "", "check every instruction against a Gameboy Doctor log, stopping at the first difference")
+	compareCycles = flag.Uint64("doctor-cycles", 300_000_000, "M-cycles -doctor-compare runs before giving up on a log that never ends, 0 for no limit")
+)
+
 func main() {
-	if len(os.Args) <= 1 {
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Println("no file passed")
 		return
 	}
-	file := os.Args[1]
-	//logging for gb doctor
-	//f, err := os.Create("../gameboy-doctor/debug.txt")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//defer f.Close()
-	e, err := lib.LoadEmulator(lib.WithCart(file))
+	switch flag.Arg(0) {
+	case "info":
+		runInfo(flag.Args()[1:])
+		return
+	case "fix":
+		runFix(flag.Args()[1:])
+		return
+	case "headless":
+		runHeadless(flag.Args()[1:])
+		return
+	case "compat":
+		runCompat(flag.Args()[1:])
+		return
+	}
+	file := flag.Arg(0)
+
+	e, err := loadEmulator(file)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	lib.RunGame(e)
+	if *compare != "" {
+		runDoctorCompare(e)
+		return
+	}
+	runWindow(e)
+}
+
+// Emulator for the ROM with the options given before the command
+func loadEmulator(file string) (*lib.Emulator, error) {
+	options, err := commonOptions()
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, lib.WithCart(file))
+
+	if *model == "" && (*doctor != "" || *compare != "") {
+		options = append(options, lib.WithModel(lib.ModelDMG)) //Gameboy Doctor logs start from the DMG state
+	}
+	if *patch != "" {
+		options = append(options, lib.WithPatch(*patch))
+	}
+	switch {
+	case *doctor != "" && *compare != "":
+		return nil, errors.New("-doctor and -doctor-compare cannot be used together")
+	case *doctor != "":
+		f, err := os.Create(*doctor)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, lib.WithDoctorLog(f))
+	case *compare != "":
+		f, err := os.Open(*compare)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, lib.WithDoctorLog(lib.LoadDoctorCompare(f)))
+	}
+
+	return lib.LoadEmulator(options...)
+}
+
+// Options that apply to any ROM, so several emulators can share them
+func commonOptions() ([]func(*lib.Emulator), error) {
+	colors, err := lib.FindPalette(*palette)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []func(*lib.Emulator){lib.WithPalette(colors)}
+	if *sgb {
+		options = append(options, lib.WithSgb())
+	}
+	if *model != "" {
+		m, err := lib.ParseModel(*model)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, lib.WithModel(m))
+	}
+	if *boot != "" {
+		options = append(options, lib.WithBootRom(*boot))
+	}
+	return options, nil
 }
@@ -0,0 +1,182 @@
+//go:build ignore
+
+// Writes menu.gb, a four item menu for the golden tests with scripted input. Down and Up
+// move the cursor, A fills the item under it. Input is read once per frame at VBlank and
+// only new presses count.
+//
+//	go run menu.go
+package main
+
+import (
+	"os"
+)
+
+var logo = []uint8{
+	0xCE, 0xED, 0x66, 0x66, 0xCC, 0x0D, 0x00, 0x0B, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0C, 0x00, 0x0D,
+	0x00, 0x08, 0x11, 0x1F, 0x88, 0x89, 0x00, 0x0E, 0xDC, 0xCC, 0x6E, 0xE6, 0xDD, 0xDD, 0xD9, 0x99,
+	0xBB, 0xBB, 0x67, 0x63, 0x6E, 0x0E, 0xEC, 0xCC, 0xDD, 0xDC, 0x99, 0x9F, 0xBB, 0xB9, 0x33, 0x3E,
+}
+
+const (
+	ORIGIN = 0x150
+	CURSOR = 0x80   // HRAM, item under the cursor
+	HELD   = 0x81   // HRAM, buttons held last frame, d-pad in the low nibble
+	FIRST  = 0x9842 // cursor of the first item, items are two rows apart
+)
+
+// Just enough of an assembler for relative jumps to labels
+type asm struct {
+	code   []uint8
+	labels map[string]int
+	fixups map[int]string
+}
+
+func (a *asm) op(b ...uint8)     { a.code = append(a.code, b...) }
+func (a *asm) label(name string) { a.labels[name] = len(a.code) }
+
+func (a *asm) jr(op uint8, label string) {
+	a.op(op, 0)
+	a.fixups[len(a.code)-1] = label
+}
+
+func lo(v uint16) uint8 { return uint8(v) }
+func hi(v uint16) uint8 { return uint8(v >> 8) }
+
+func (a *asm) link() []uint8 {
+	for pos, label := range a.fixups {
+		a.code[pos] = uint8(a.labels[label] - (pos + 1))
+	}
+	return a.code
+}
+
+const (
+	JR    = 0x18
+	JR_NZ = 0x20
+	JR_Z  = 0x28
+	JR_C  = 0x38
+)
+
+func program() []uint8 {
+	a := &asm{labels: map[string]int{}, fixups: map[int]string{}}
+	a.op(0xF3)             //di
+	a.op(0x31, 0xFE, 0xFF) //ld sp,$FFFE
+
+	//the LCD only goes off in VBlank
+	a.label("vblank")
+	a.op(0xF0, 0x44)       //ldh a,[LY]
+	a.op(0xFE, 144)        //cp 144
+	a.jr(JR_C, "vblank")   //jr c,vblank
+	a.op(0xAF, 0xE0, 0x40) //xor a / ldh [LCDC],a
+	a.op(0xE0, CURSOR, 0xE0, HELD)
+
+	//tile 0 blank, tile 1 solid black, tile 2 light grey
+	a.op(0x21, 0x00, 0x80) //ld hl,$8000
+	a.op(0x06, 16)         //ld b,16
+	a.label("blank")
+	a.op(0x22, 0x05) //ld [hl+],a / dec b
+	a.jr(JR_NZ, "blank")
+	a.op(0x06, 16, 0x3E, 0xFF) //ld b,16 / ld a,$FF
+	a.label("solid")
+	a.op(0x22, 0x05)
+	a.jr(JR_NZ, "solid")
+	a.op(0x06, 8) //ld b,8
+	a.label("grey")
+	a.op(0x3E, 0xFF, 0x22, 0xAF, 0x22, 0x05) //ld a,$FF / ld [hl+],a / xor a / ld [hl+],a / dec b
+	a.jr(JR_NZ, "grey")
+
+	//clear the map and draw the items, 8 tiles wide from column 4
+	a.op(0x21, 0x00, 0x98, 0x01, 0x00, 0x04) //ld hl,$9800 / ld bc,$400
+	a.label("clear")
+	a.op(0xAF, 0x22, 0x0B, 0x78, 0xB1) //xor a / ld [hl+],a / dec bc / ld a,b / or c
+	a.jr(JR_NZ, "clear")
+	a.op(0x21, lo(FIRST+2), hi(FIRST+2), 0x0E, 4) //ld hl,FIRST+2 / ld c,4
+	a.label("item")
+	a.op(0x06, 8, 0x3E, 2) //ld b,8 / ld a,2
+	a.label("itemTile")
+	a.op(0x22, 0x05)
+	a.jr(JR_NZ, "itemTile")
+	a.op(0x11, 56, 0x00, 0x19, 0x0D) //ld de,56 / add hl,de / dec c
+	a.jr(JR_NZ, "item")
+
+	a.op(0x3E, 0xE4, 0xE0, 0x47) //ld a,$E4 / ldh [BGP],a
+	a.op(0x3E, 0x91, 0xE0, 0x40) //ld a,$91 / ldh [LCDC],a
+
+	a.label("frame")
+	a.op(0xF0, 0x44, 0xFE, 144) //ldh a,[LY] / cp 144
+	a.jr(JR_NZ, "frame")
+
+	//d-pad in the low nibble, buttons in the high one, 1 for pressed
+	a.op(0x3E, 0x20, 0xE0, 0x00, 0xF0, 0x00, 0xF0, 0x00) //ld a,$20 / ldh [P1],a / ldh a,[P1] twice
+	a.op(0x2F, 0xE6, 0x0F, 0x47)                         //cpl / and $0F / ld b,a
+	a.op(0x3E, 0x10, 0xE0, 0x00, 0xF0, 0x00, 0xF0, 0x00) //ld a,$10 / ldh [P1],a / ldh a,[P1] twice
+	a.op(0x2F, 0xE6, 0x0F, 0xCB, 0x37, 0xB0, 0x47)       //cpl / and $0F / swap a / or b / ld b,a
+	a.op(0x3E, 0x30, 0xE0, 0x00)                         //ld a,$30 / ldh [P1],a
+	a.op(0xF0, HELD, 0x2F, 0xA0, 0x4F)                   //ldh a,[HELD] / cpl / and b / ld c,a
+	a.op(0x78, 0xE0, HELD)                               //ld a,b / ldh [HELD],a
+
+	a.op(0xCB, 0x59) //bit 3,c
+	a.jr(JR_Z, "noDown")
+	a.op(0xF0, CURSOR, 0xFE, 3) //ldh a,[CURSOR] / cp 3
+	a.jr(JR_Z, "noDown")
+	a.op(0x3C, 0xE0, CURSOR) //inc a / ldh [CURSOR],a
+	a.label("noDown")
+
+	a.op(0xCB, 0x51) //bit 2,c
+	a.jr(JR_Z, "noUp")
+	a.op(0xF0, CURSOR, 0xA7) //ldh a,[CURSOR] / and a
+	a.jr(JR_Z, "noUp")
+	a.op(0x3D, 0xE0, CURSOR) //dec a / ldh [CURSOR],a
+	a.label("noUp")
+
+	//hl = cursor position, the item starts 2 columns to the right
+	a.op(0x21, lo(FIRST), hi(FIRST), 0x11, 64, 0x00) //ld hl,FIRST / ld de,64
+	a.op(0x06, 4)                                    //ld b,4
+	a.label("erase")
+	a.op(0x36, 0x00, 0x19, 0x05) //ld [hl],0 / add hl,de / dec b
+	a.jr(JR_NZ, "erase")
+	a.op(0x21, lo(FIRST), hi(FIRST)) //ld hl,FIRST
+	a.op(0xF0, CURSOR, 0xA7)         //ldh a,[CURSOR] / and a
+	a.jr(JR_Z, "draw")
+	a.label("down")
+	a.op(0x19, 0x3D) //add hl,de / dec a
+	a.jr(JR_NZ, "down")
+	a.label("draw")
+	a.op(0x36, 0x01) //ld [hl],1
+
+	a.op(0xCB, 0x61) //bit 4,c
+	a.jr(JR_Z, "wait")
+	a.op(0x23, 0x23, 0x06, 8, 0x3E, 1) //inc hl twice / ld b,8 / ld a,1
+	a.label("fill")
+	a.op(0x22, 0x05)
+	a.jr(JR_NZ, "fill")
+
+	//once per frame
+	a.label("wait")
+	a.op(0xF0, 0x44, 0xFE, 144) //ldh a,[LY] / cp 144
+	a.jr(JR_Z, "wait")
+	a.jr(JR, "frame")
+	return a.link()
+}
+
+func main() {
+	rom := make([]uint8, 0x8000)
+	copy(rom[0x100:], []uint8{0x00, 0xC3, lo(ORIGIN), hi(ORIGIN)}) //nop / jp ORIGIN
+	copy(rom[0x104:], logo)
+	copy(rom[0x134:], "MENU")
+	copy(rom[ORIGIN:], program())
+
+	var header uint8
+	for _, v := range rom[0x134:0x14D] {
+		header = header - v - 1
+	}
+	rom[0x14D] = header
+	var global uint16
+	for _, v := range rom {
+		global += uint16(v)
+	}
+	rom[0x14E], rom[0x14F] = uint8(global>>8), uint8(global)
+
+	if err := os.WriteFile("menu.gb", rom, 0644); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,574 @@
+//go:build ignore
+
+// Writes SingleStepTests style vectors into v1, a file per opcode. The instructions are
+// modeled here from the Pan Docs tables, apart from the emulator, so the two can be
+// checked against each other until the vectors of https://github.com/SingleStepTests/sm83
+// replace these. Cycles hold the read or write of each M-cycle like the suite does, and
+// null for the ones the CPU spends inside. STOP is left out, its behavior depends on the
+// hardware around the CPU.
+//
+//	go run gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const CASES = 10 // per opcode
+
+type state struct {
+	PC  uint16      `json:"pc"`
+	SP  uint16      `json:"sp"`
+	A   uint8       `json:"a"`
+	B   uint8       `json:"b"`
+	C   uint8       `json:"c"`
+	D   uint8       `json:"d"`
+	E   uint8       `json:"e"`
+	F   uint8       `json:"f"`
+	H   uint8       `json:"h"`
+	L   uint8       `json:"l"`
+	IME uint8       `json:"ime"`
+	Ram [][2]uint16 `json:"ram"`
+}
+
+type test struct {
+	Name    string `json:"name"`
+	Initial state  `json:"initial"`
+	Final   state  `json:"final"`
+	Cycles  []any  `json:"cycles"`
+}
+
+// Memory that makes up a random value the first time an address is used, and remembers it
+// as part of the initial state
+type memory struct {
+	rng            *rand.Rand
+	initial, value map[uint16]uint8
+}
+
+func (m *memory) read(a uint16) uint8 {
+	if _, ok := m.value[a]; !ok {
+		v := uint8(m.rng.Intn(0x100))
+		m.initial[a], m.value[a] = v, v
+	}
+	return m.value[a]
+}
+
+func (m *memory) write(a uint16, v uint8) {
+	m.read(a)
+	m.value[a] = v
+}
+
+func ram(values map[uint16]uint8) [][2]uint16 {
+	r := [][2]uint16{}
+	for a, v := range values {
+		r = append(r, [2]uint16{a, uint16(v)})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i][0] < r[j][0] })
+	return r
+}
+
+type cpu struct {
+	s      state
+	mem    *memory
+	cycles []any
+}
+
+const (
+	flagZ = 0x80
+	flagN = 0x40
+	flagH = 0x20
+	flagC = 0x10
+)
+
+func (c *cpu) flag(f uint8) bool { return c.s.F&f != 0 }
+
+func (c *cpu) setFlags(z, n, h, carry bool) {
+	c.s.F = 0
+	for _, f := range []struct {
+		on  bool
+		bit uint8
+	}{{z, flagZ}, {n, flagN}, {h, flagH}, {carry, flagC}} {
+		if f.on {
+			c.s.F |= f.bit
+		}
+	}
+}
+
+func (c *cpu) read(a uint16) uint8 {
+	v := c.mem.read(a)
+	c.cycles = append(c.cycles, []any{a, v, "r-m"})
+	return v
+}
+
+func (c *cpu) write(a uint16, v uint8) {
+	c.mem.write(a, v)
+	c.cycles = append(c.cycles, []any{a, v, "-wm"})
+}
+
+// An M-cycle without a memory access
+func (c *cpu) idle() { c.cycles = append(c.cycles, nil) }
+
+func (c *cpu) fetch() uint8 {
+	v := c.read(c.s.PC)
+	c.s.PC++
+	return v
+}
+
+func (c *cpu) fetch16() uint16 {
+	lo := c.fetch()
+	return uint16(c.fetch())<<8 | uint16(lo)
+}
+
+func (c *cpu) push(v uint16) {
+	c.idle() //SP is decremented before the first write
+	c.s.SP--
+	c.write(c.s.SP, uint8(v>>8))
+	c.s.SP--
+	c.write(c.s.SP, uint8(v))
+}
+
+func (c *cpu) pop() uint16 {
+	lo := c.read(c.s.SP)
+	c.s.SP++
+	hi := c.read(c.s.SP)
+	c.s.SP++
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func (c *cpu) hl() uint16 { return uint16(c.s.H)<<8 | uint16(c.s.L) }
+
+func (c *cpu) setHl(v uint16) { c.s.H, c.s.L = uint8(v>>8), uint8(v) }
+
+// BC, DE, HL, SP
+func (c *cpu) r16(i uint8) uint16 {
+	switch i {
+	case 0:
+		return uint16(c.s.B)<<8 | uint16(c.s.C)
+	case 1:
+		return uint16(c.s.D)<<8 | uint16(c.s.E)
+	case 2:
+		return c.hl()
+	}
+	return c.s.SP
+}
+
+func (c *cpu) setR16(i uint8, v uint16) {
+	switch i {
+	case 0:
+		c.s.B, c.s.C = uint8(v>>8), uint8(v)
+	case 1:
+		c.s.D, c.s.E = uint8(v>>8), uint8(v)
+	case 2:
+		c.setHl(v)
+	default:
+		c.s.SP = v
+	}
+}
+
+// B, C, D, E, H, L, (HL), A
+func (c *cpu) r8(i uint8) uint8 {
+	switch i {
+	case 0:
+		return c.s.B
+	case 1:
+		return c.s.C
+	case 2:
+		return c.s.D
+	case 3:
+		return c.s.E
+	case 4:
+		return c.s.H
+	case 5:
+		return c.s.L
+	case 6:
+		return c.read(c.hl())
+	}
+	return c.s.A
+}
+
+func (c *cpu) setR8(i uint8, v uint8) {
+	switch i {
+	case 0:
+		c.s.B = v
+	case 1:
+		c.s.C = v
+	case 2:
+		c.s.D = v
+	case 3:
+		c.s.E = v
+	case 4:
+		c.s.H = v
+	case 5:
+		c.s.L = v
+	case 6:
+		c.write(c.hl(), v)
+	default:
+		c.s.A = v
+	}
+}
+
+// NZ, Z, NC, C
+func (c *cpu) condition(i uint8) bool {
+	switch i {
+	case 0:
+		return !c.flag(flagZ)
+	case 1:
+		return c.flag(flagZ)
+	case 2:
+		return !c.flag(flagC)
+	}
+	return c.flag(flagC)
+}
+
+// ADD, ADC, SUB, SBC, AND, XOR, OR, CP
+func (c *cpu) alu(op uint8, v uint8) {
+	a := c.s.A
+	carry := uint8(0)
+	if (op == 1 || op == 3) && c.flag(flagC) {
+		carry = 1
+	}
+	switch op {
+	case 0, 1:
+		r := int(a) + int(v) + int(carry)
+		c.s.A = uint8(r)
+		c.setFlags(uint8(r) == 0, false, a&0xF+v&0xF+carry > 0xF, r > 0xFF)
+	case 2, 3, 7:
+		r := int(a) - int(v) - int(carry)
+		if op != 7 {
+			c.s.A = uint8(r)
+		}
+		c.setFlags(uint8(r) == 0, true, int(a&0xF)-int(v&0xF)-int(carry) < 0, r < 0)
+	case 4:
+		c.s.A = a & v
+		c.setFlags(c.s.A == 0, false, true, false)
+	case 5:
+		c.s.A = a ^ v
+		c.setFlags(c.s.A == 0, false, false, false)
+	case 6:
+		c.s.A = a | v
+		c.setFlags(c.s.A == 0, false, false, false)
+	}
+}
+
+// RLC, RRC, RL, RR, SLA, SRA, SWAP, SRL
+func (c *cpu) shift(op uint8, v uint8) uint8 {
+	carryIn := uint8(0)
+	if c.flag(flagC) {
+		carryIn = 1
+	}
+	var r uint8
+	var carry bool
+	switch op {
+	case 0:
+		r, carry = v<<1|v>>7, v&0x80 != 0
+	case 1:
+		r, carry = v>>1|v<<7, v&1 != 0
+	case 2:
+		r, carry = v<<1|carryIn, v&0x80 != 0
+	case 3:
+		r, carry = v>>1|carryIn<<7, v&1 != 0
+	case 4:
+		r, carry = v<<1, v&0x80 != 0
+	case 5:
+		r, carry = v>>1|v&0x80, v&1 != 0
+	case 6:
+		r = v<<4 | v>>4
+	case 7:
+		r, carry = v>>1, v&1 != 0
+	}
+	c.setFlags(r == 0, false, false, carry)
+	return r
+}
+
+// SP plus a signed byte, the flags come from the unsigned add of the low byte
+func (c *cpu) spOffset() uint16 {
+	e := c.fetch()
+	sp := c.s.SP
+	c.setFlags(false, false, sp&0xF+uint16(e)&0xF > 0xF, sp&0xFF+uint16(e) > 0xFF)
+	return sp + uint16(int8(e))
+}
+
+// Runs one instruction, false for opcodes that have no vectors
+func (c *cpu) step() bool {
+	op := c.fetch()
+	x, y, z := op>>6, op>>3&7, op&7
+
+	switch {
+	case op == 0x00:
+	case op == 0x10:
+		return false
+	case op == 0x76: //HALT with nothing pending moves on to the next instruction
+	case op == 0x08:
+		a := c.fetch16()
+		c.write(a, uint8(c.s.SP))
+		c.write(a+1, uint8(c.s.SP>>8))
+	case op == 0x18:
+		e := int8(c.fetch())
+		c.s.PC += uint16(e)
+		c.idle()
+	case x == 0 && z == 0 && y >= 4: //JR cc
+		e := int8(c.fetch())
+		if c.condition(y - 4) {
+			c.s.PC += uint16(e)
+			c.idle()
+		}
+	case x == 0 && z == 1 && y&1 == 0:
+		c.setR16(y>>1, c.fetch16())
+	case x == 0 && z == 1: //ADD HL,rr
+		hl, v := c.hl(), c.r16(y>>1)
+		c.setHl(hl + v)
+		c.setFlags(c.flag(flagZ), false, hl&0xFFF+v&0xFFF > 0xFFF, uint32(hl)+uint32(v) > 0xFFFF)
+		c.idle()
+	case x == 0 && z == 2: //LD (rr),A and LD A,(rr), with HL+ and HL-
+		var a uint16
+		switch y >> 1 {
+		case 0, 1:
+			a = c.r16(y >> 1)
+		case 2:
+			a = c.hl()
+			c.setHl(a + 1)
+		case 3:
+			a = c.hl()
+			c.setHl(a - 1)
+		}
+		if y&1 == 0 {
+			c.write(a, c.s.A)
+		} else {
+			c.s.A = c.read(a)
+		}
+	case x == 0 && z == 3: //INC rr, DEC rr
+		v := c.r16(y >> 1)
+		if y&1 == 0 {
+			v++
+		} else {
+			v--
+		}
+		c.setR16(y>>1, v)
+		c.idle()
+	case x == 0 && (z == 4 || z == 5): //INC r, DEC r
+		v := c.r8(y)
+		carry := c.flag(flagC)
+		if z == 4 {
+			c.setR8(y, v+1)
+			c.setFlags(v+1 == 0, false, v&0xF == 0xF, carry)
+		} else {
+			c.setR8(y, v-1)
+			c.setFlags(v-1 == 0, true, v&0xF == 0, carry)
+		}
+	case x == 0 && z == 6:
+		c.setR8(y, c.fetch())
+	case x == 0 && z == 7 && y < 4: //RLCA, RRCA, RLA, RRA
+		c.s.A = c.shift(y, c.s.A)
+		c.s.F &^= flagZ
+	case op == 0x27: //DAA
+		a, carry := c.s.A, c.flag(flagC)
+		if !c.flag(flagN) {
+			if carry || a > 0x99 {
+				a += 0x60
+				carry = true
+			}
+			if c.flag(flagH) || a&0xF > 9 {
+				a += 0x06
+			}
+		} else {
+			if carry {
+				a -= 0x60
+			}
+			if c.flag(flagH) {
+				a -= 0x06
+			}
+		}
+		c.s.A = a
+		c.setFlags(a == 0, c.flag(flagN), false, carry)
+	case op == 0x2F: //CPL
+		c.s.A = ^c.s.A
+		c.s.F |= flagN | flagH
+	case op == 0x37: //SCF
+		c.setFlags(c.flag(flagZ), false, false, true)
+	case op == 0x3F: //CCF
+		c.setFlags(c.flag(flagZ), false, false, !c.flag(flagC))
+	case x == 1:
+		c.setR8(y, c.r8(z))
+	case x == 2:
+		c.alu(y, c.r8(z))
+	case x == 3 && z == 0 && y < 4: //RET cc
+		c.idle()
+		if c.condition(y) {
+			c.s.PC = c.pop()
+			c.idle()
+		}
+	case op == 0xE0:
+		c.write(0xFF00+uint16(c.fetch()), c.s.A)
+	case op == 0xF0:
+		c.s.A = c.read(0xFF00 + uint16(c.fetch()))
+	case op == 0xE8: //ADD SP,e
+		c.s.SP = c.spOffset()
+		c.idle()
+		c.idle()
+	case op == 0xF8: //LD HL,SP+e
+		c.setHl(c.spOffset())
+		c.idle()
+	case x == 3 && z == 1 && y&1 == 0: //POP
+		v := c.pop()
+		switch y >> 1 {
+		case 3:
+			c.s.A, c.s.F = uint8(v>>8), uint8(v)&0xF0
+		default:
+			c.setR16(y>>1, v)
+		}
+	case op == 0xC9, op == 0xD9: //RET, RETI
+		c.s.PC = c.pop()
+		c.idle()
+		if op == 0xD9 {
+			c.s.IME = 1
+		}
+	case op == 0xE9:
+		c.s.PC = c.hl()
+	case op == 0xF9:
+		c.s.SP = c.hl()
+		c.idle()
+	case x == 3 && z == 2 && y < 4: //JP cc
+		a := c.fetch16()
+		if c.condition(y) {
+			c.s.PC = a
+			c.idle()
+		}
+	case op == 0xE2:
+		c.write(0xFF00+uint16(c.s.C), c.s.A)
+	case op == 0xF2:
+		c.s.A = c.read(0xFF00 + uint16(c.s.C))
+	case op == 0xEA:
+		c.write(c.fetch16(), c.s.A)
+	case op == 0xFA:
+		c.s.A = c.read(c.fetch16())
+	case op == 0xC3:
+		c.s.PC = c.fetch16()
+		c.idle()
+	case op == 0xCB:
+		cb := c.fetch()
+		x, y, z := cb>>6, cb>>3&7, cb&7
+		v := c.r8(z)
+		switch x {
+		case 0:
+			c.setR8(z, c.shift(y, v))
+		case 1:
+			c.setFlags(v&(1<<y) == 0, false, true, c.flag(flagC))
+		case 2:
+			c.setR8(z, v&^(1<<y))
+		case 3:
+			c.setR8(z, v|1<<y)
+		}
+	case op == 0xF3:
+		c.s.IME = 0
+	case op == 0xFB: //IME is set after the next instruction, counted as set
+		c.s.IME = 1
+	case x == 3 && z == 4 && y < 4: //CALL cc
+		a := c.fetch16()
+		if c.condition(y) {
+			c.push(c.s.PC)
+			c.s.PC = a
+		}
+	case x == 3 && z == 5 && y&1 == 0: //PUSH
+		v := c.r16(y >> 1)
+		if y>>1 == 3 {
+			v = uint16(c.s.A)<<8 | uint16(c.s.F)
+		}
+		c.push(v)
+	case op == 0xCD:
+		a := c.fetch16()
+		c.push(c.s.PC)
+		c.s.PC = a
+	case x == 3 && z == 6:
+		c.alu(y, c.fetch())
+	case x == 3 && z == 7: //RST
+		c.push(c.s.PC)
+		c.s.PC = uint16(y) * 8
+	default: //no such opcode
+		return false
+	}
+	return true
+}
+
+func randomState(rng *rand.Rand) state {
+	r := func() uint8 { return uint8(rng.Intn(0x100)) }
+	return state{
+		PC: uint16(rng.Intn(0x10000)), SP: uint16(rng.Intn(0x10000)),
+		A: r(), B: r(), C: r(), D: r(), E: r(), F: r() & 0xF0, H: r(), L: r(),
+		IME: uint8(rng.Intn(2)),
+	}
+}
+
+func generate(rng *rand.Rand, opcode []uint8, name string) ([]test, bool) {
+	var tests []test
+	for i := 0; i < CASES; i++ {
+		mem := &memory{rng: rng, initial: map[uint16]uint8{}, value: map[uint16]uint8{}}
+		initial := randomState(rng)
+		for j, b := range opcode {
+			mem.initial[initial.PC+uint16(j)], mem.value[initial.PC+uint16(j)] = b, b
+		}
+
+		c := &cpu{s: initial, mem: mem}
+		if !c.step() {
+			return nil, false
+		}
+		c.s.Ram = ram(mem.value)
+		initial.Ram = ram(mem.initial)
+		tests = append(tests, test{
+			Name:    fmt.Sprintf("%s %04d", name, i),
+			Initial: initial,
+			Final:   c.s,
+			Cycles:  c.cycles,
+		})
+	}
+	return tests, true
+}
+
+// One test per line, so the files stay readable and diff well
+func write(p string, tests []test) error {
+	var b bytes.Buffer
+	b.WriteString("[\n")
+	for i, t := range tests {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		if i < len(tests)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("]\n")
+	return os.WriteFile(p, b.Bytes(), 0644)
+}
+
+func main() {
+	rng := rand.New(rand.NewSource(0x5383))
+	if err := os.MkdirAll("v1", 0755); err != nil {
+		panic(err)
+	}
+	for op := 0; op < 0x100; op++ {
+		opcode, name := []uint8{uint8(op)}, fmt.Sprintf("%02x", op)
+		if op == 0xCB {
+			continue
+		}
+		if tests, ok := generate(rng, opcode, name); ok {
+			if err := write(filepath.Join("v1", name+".json"), tests); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for op := 0; op < 0x100; op++ {
+		name := fmt.Sprintf("cb %02x", op)
+		tests, _ := generate(rng, []uint8{0xCB, uint8(op)}, name)
+		if err := write(filepath.Join("v1", name+".json"), tests); err != nil {
+			panic(err)
+		}
+	}
+}
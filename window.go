@@ -0,0 +1,10 @@
+//go:build !headless
+
+package main
+
+import (
+	"gbemulator/lib"
+	"gbemulator/lib/ui"
+)
+
+func runWindow(e *lib.Emulator) { ui.RunGame(e) }
@@ -0,0 +1,15 @@
+//go:build headless
+
+package main
+
+import (
+	"fmt"
+	"gbemulator/lib"
+	"os"
+)
+
+// Builds with the headless tag have no window, only the commands that run without one
+func runWindow(e *lib.Emulator) {
+	fmt.Println("built without a window, use headless")
+	os.Exit(lib.EXIT_USAGE)
+}